@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig configures the admin API. It has a listener of its own so it
+// can be kept off the network clients reach.
+type AdminConfig struct {
+	// Listen is the admin API's address; it defaults to loopback only
+	Listen string `json:"listen,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c AdminConfig) withDefaults() AdminConfig {
+	if c.Listen == "" {
+		c.Listen = "127.0.0.1:9901"
+	}
+	return c
+}
+
+// requireAdmin protects gateway management endpoints with a static bearer
+// token. With no token configured the endpoints are switched off entirely.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin API disabled: start the gateway with -admin-token", http.StatusForbidden)
+			return
+		}
+
+		given, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminHandler returns the admin API, served on its own listener. Every
+// endpoint needs the admin token:
+//
+//	GET  /gateway/routes                          routes with their traffic rate, errors, latency, bulkhead and hedging
+//	GET  /gateway/upstreams                       instances with health, circuit state and in-flight counts
+//	POST /gateway/upstreams/{route}/{host}/drain  take an instance out of rotation
+//	POST /gateway/upstreams/{route}/{host}/enable put a drained instance back
+//	GET  /gateway/health                          every route's instances with their probe results
+//	POST /gateway/reload                          re-read the config file
+//
+// plus the key, cache, traffic split, shadow and fault injection endpoints.
+func (g *Gateway) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway/routes", g.routesHandler)
+	mux.HandleFunc("/gateway/upstreams", g.upstreamsHandler)
+	mux.HandleFunc("/gateway/upstreams/", g.drainHandler)
+	mux.HandleFunc("/gateway/health", g.healthHandler)
+	mux.HandleFunc("/gateway/reload", g.reloadHandler)
+	mux.HandleFunc("/gateway/keys", g.keysHandler)
+	mux.HandleFunc("/gateway/keys/", g.keysHandler)
+	mux.HandleFunc("/gateway/cache", g.cacheHandler)
+	mux.HandleFunc("/gateway/versions", g.versionsHandler)
+	mux.HandleFunc("/gateway/versions/", g.versionsHandler)
+	mux.HandleFunc("/gateway/shadow", g.shadowHandler)
+	mux.HandleFunc("/gateway/faults", g.faultsHandler)
+	mux.HandleFunc("/gateway/faults/", g.faultsHandler)
+	return requireAdmin(token, mux.ServeHTTP)
+}
+
+// ==================== ROUTES ====================
+
+// routeStatus is the admin view of one route
+type routeStatus struct {
+	Name       string             `json:"name"`
+	PathPrefix string             `json:"path_prefix"`
+	Host       string             `json:"host,omitempty"`
+	Methods    []string           `json:"methods,omitempty"`
+	Auth       string             `json:"auth"`
+	Strategy   string             `json:"strategy"`
+	Upstreams  int                `json:"upstreams"`
+	Available  int                `json:"available"`
+	Stats      routeStatsSnapshot `json:"stats"`
+	Bulkhead   *bulkheadStatus    `json:"bulkhead,omitempty"`
+	Hedging    *hedgeStatus       `json:"hedging,omitempty"`
+}
+
+// routesHandler serves GET /gateway/routes with every active route and its traffic
+func (g *Gateway) routesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	table := g.table.Load()
+	out := []routeStatus{}
+	for i, rc := range table.cfg.Routes {
+		p := table.pools[i]
+		rs := routeStatus{
+			Name:       rc.Name,
+			PathPrefix: rc.PathPrefix,
+			Host:       rc.Host,
+			Methods:    rc.Methods,
+			Auth:       rc.Auth,
+			Strategy:   p.Strategy,
+			Upstreams:  len(p.Upstreams),
+			Stats:      g.routeStats(rc.Name).snapshot(),
+			Bulkhead:   p.bulkhead.status(),
+			Hedging:    p.hedge.status(),
+		}
+		if available, err := p.available(); err == nil {
+			rs.Available = len(available)
+		}
+		out = append(out, rs)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// routeStats returns a route's traffic counters, creating them on first use.
+// They are kept by name so a reload does not reset them.
+func (g *Gateway) routeStats(route string) *routeStats {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	if g.stats == nil {
+		g.stats = make(map[string]*routeStats)
+	}
+	s, ok := g.stats[route]
+	if !ok {
+		s = &routeStats{}
+		g.stats[route] = s
+	}
+	return s
+}
+
+// ==================== DRAINING ====================
+
+// drainHandler serves POST /gateway/upstreams/{route}/{host}/drain and
+// /enable. A drained instance gets no new requests, while those already on
+// it finish; its in_flight count shows when it is safe to stop.
+func (g *Gateway) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/gateway/upstreams/"), "/"), "/")
+	if len(parts) != 3 || (parts[2] != "drain" && parts[2] != "enable") {
+		http.Error(w, "expected /gateway/upstreams/{route}/{host}/drain or /enable", http.StatusNotFound)
+		return
+	}
+	route, host, drain := parts[0], parts[1], parts[2] == "drain"
+
+	var pool *Pool
+	for _, p := range g.table.Load().pools {
+		if p.Route == route {
+			pool = p
+		}
+	}
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("no route %q", route), http.StatusNotFound)
+		return
+	}
+
+	var target *Upstream
+	for _, u := range pool.Upstreams {
+		if u.URL.Host == host {
+			target = u
+		}
+	}
+	if target == nil {
+		http.Error(w, fmt.Sprintf("route %q has no upstream %q", route, host), http.StatusNotFound)
+		return
+	}
+
+	target.draining.Store(drain)
+	g.rememberDrained(route, host, drain)
+	if drain {
+		log.Printf("🚰 Draining %s on %s: no new requests, %d in flight", host, route, target.InFlight())
+	} else {
+		log.Printf("✅ %s on %s back in rotation", host, route)
+	}
+
+	for _, us := range pool.status().Upstreams {
+		if us.URL == target.URL.String() {
+			writeJSON(w, http.StatusOK, us)
+			return
+		}
+	}
+}
+
+// rememberDrained keeps an operator's drain so a config reload does not undo it
+func (g *Gateway) rememberDrained(route, host string, drain bool) {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	if g.drained == nil {
+		g.drained = make(map[string]bool)
+	}
+	if drain {
+		g.drained[route+"/"+host] = true
+	} else {
+		delete(g.drained, route+"/"+host)
+	}
+}
+
+// restoreDrained re-applies drains to a freshly built pool
+func (g *Gateway) restoreDrained(p *Pool) {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	for _, u := range p.Upstreams {
+		if g.drained[p.Route+"/"+u.URL.Host] {
+			u.draining.Store(true)
+			log.Printf("🚰 Keeping %s on %s drained", u.URL.Host, p.Route)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		auth  string
+		want  int
+	}{
+		{"disabled without a token", "", "Bearer s3cret", http.StatusForbidden},
+		{"right token", "s3cret", "Bearer s3cret", http.StatusOK},
+		{"scheme in lower case", "s3cret", "bearer s3cret", http.StatusOK},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"other scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"no header", "s3cret", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		h := requireAdmin(tt.token, func(w http.ResponseWriter, r *http.Request) {})
+		r := httptest.NewRequest("GET", "/gateway/routes", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+// adminRequest sends one request to the gateway's admin API
+func adminRequest(g *Gateway, method, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	g.adminHandler("s3cret").ServeHTTP(w, r)
+	return w
+}
+
+// servedBy sends n requests through the gateway and counts them by the instance that answered
+func servedBy(t *testing.T, g *Gateway, n int) map[string]int {
+	t.Helper()
+	seen := make(map[string]int)
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil))
+		seen[w.Body.String()]++
+	}
+	return seen
+}
+
+func TestDrainAndEnable(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) }))
+	}
+	a, b := named("a"), named("b")
+	defer a.Close()
+	defer b.Close()
+	config := upstreamsConfig("", a.URL, b.URL)
+	g := testGateway(t, config)
+	drainPath := "/gateway/upstreams/user/" + strings.TrimPrefix(b.URL, "http://")
+
+	w := adminRequest(g, "POST", drainPath+"/drain")
+	var st upstreamStatus
+	json.NewDecoder(w.Body).Decode(&st)
+	if w.Code != http.StatusOK || st.URL != b.URL || !st.Draining {
+		t.Fatalf("drain: %d %+v", w.Code, st)
+	}
+	if seen := servedBy(t, g, 10); seen["a"] != 10 {
+		t.Fatalf("while b is drained: served %v", seen)
+	}
+
+	// The drain is the operator's call and survives a reload
+	if err := reloadConfig(t, g, config); err != nil {
+		t.Fatal(err)
+	}
+	if seen := servedBy(t, g, 10); seen["a"] != 10 {
+		t.Fatalf("after a reload: served %v, want b still drained", seen)
+	}
+
+	w = adminRequest(g, "POST", drainPath+"/enable")
+	st = upstreamStatus{}
+	json.NewDecoder(w.Body).Decode(&st)
+	if w.Code != http.StatusOK || st.Draining {
+		t.Fatalf("enable: %d %+v", w.Code, st)
+	}
+	if err := reloadConfig(t, g, config); err != nil {
+		t.Fatal(err)
+	}
+	if seen := servedBy(t, g, 10); seen["a"] != 5 || seen["b"] != 5 {
+		t.Fatalf("after enabling b: served %v", seen)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", drainPath + "/drain", http.StatusMethodNotAllowed},
+		{"POST", drainPath + "/pause", http.StatusNotFound},
+		{"POST", "/gateway/upstreams/payment/" + strings.TrimPrefix(b.URL, "http://") + "/drain", http.StatusNotFound},
+		{"POST", "/gateway/upstreams/user/10.0.0.9:8001/drain", http.StatusNotFound},
+	} {
+		if w := adminRequest(g, tt.method, tt.path); w.Code != tt.want {
+			t.Errorf("%s %s: %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HashConfig says what consistent_hash load balancing keys requests on;
+// exactly one of Header, Cookie, PathSegment and SourceIP is set
+type HashConfig struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+
+	// PathSegment is the 1-based segment of the client's path, e.g. 2 for the ID in /user/42/orders
+	PathSegment int `json:"path_segment,omitempty"`
+
+	// SourceIP keys on the client address, taken from X-Forwarded-For when forwarded headers are trusted
+	SourceIP bool `json:"source_ip,omitempty"`
+
+	// LoadFactor bounds every instance to this multiple of the average
+	// in-flight load; keys beyond it spill over to the next instance on the ring
+	LoadFactor float64 `json:"load_factor,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c HashConfig) withDefaults() HashConfig {
+	if c.LoadFactor == 0 {
+		c.LoadFactor = 1.25
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c HashConfig) validate() error {
+	sources := 0
+	for _, set := range []bool{c.Header != "", c.Cookie != "", c.PathSegment != 0, c.SourceIP} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("hash needs exactly one of header, cookie, path_segment or source_ip")
+	}
+	if c.PathSegment < 0 {
+		return errors.New("hash path_segment must be 1 or more")
+	}
+	if c.LoadFactor != 0 && c.LoadFactor < 1 {
+		return errors.New("hash load_factor must be at least 1")
+	}
+	return nil
+}
+
+// key extracts the request's hash key; ok is false when the request has none
+func (c HashConfig) key(r *http.Request) (key string, ok bool) {
+	switch {
+	case c.Header != "":
+		key = r.Header.Get(c.Header)
+	case c.Cookie != "":
+		if ck, err := r.Cookie(c.Cookie); err == nil {
+			key = ck.Value
+		}
+	case c.PathSegment > 0:
+		segments := strings.Split(strings.Trim(clientPath(r), "/"), "/")
+		if c.PathSegment <= len(segments) {
+			key = segments[c.PathSegment-1]
+		}
+	case c.SourceIP:
+		key = clientIP(r)
+	}
+	return key, key != ""
+}
+
+// clientPath returns the path the client asked for, before any rewrite
+func clientPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+// clientIP returns the original client's address. The proxy has already
+// appended the peer to X-Forwarded-For, after dropping the client's own
+// value unless forwarded headers are trusted, so its first entry is the client.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		first, _, _ := strings.Cut(xff, ",")
+		return strings.TrimSpace(first)
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// ==================== CONSISTENT HASH ====================
+
+// ringReplicas is how many points each unit of weight puts on the ring;
+// more points spread keys more evenly between instances
+const ringReplicas = 100
+
+// ringPoint is one virtual node on the hash ring
+type ringPoint struct {
+	hash     uint64
+	upstream *Upstream
+}
+
+// consistentHash sends requests with the same key to the same instance. Each
+// instance owns points on a ring and a key goes to the next point clockwise,
+// so adding or losing an instance only moves the keys next to its points.
+// Load is bounded: an instance already above LoadFactor times the average
+// in-flight load is passed over for the next one on the ring.
+type consistentHash struct {
+	cfg      HashConfig
+	ring     []ringPoint
+	fallback powerOfTwo
+}
+
+// build places every instance of the pool on the ring. Points depend only on
+// the instance's URL, so the same instance lands in the same place on every
+// reload and unhealthy instances are simply skipped rather than removed.
+func (b *consistentHash) build(upstreams []*Upstream) {
+	b.ring = b.ring[:0]
+	for _, u := range upstreams {
+		for i := 0; i < ringReplicas*max(u.Weight, 1); i++ {
+			sum := sha256.Sum256([]byte(u.URL.String() + "#" + strconv.Itoa(i)))
+			b.ring = append(b.ring, ringPoint{hash: binary.BigEndian.Uint64(sum[:8]), upstream: u})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+func (b *consistentHash) Pick(r *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 0 {
+		return nil
+	}
+	key, ok := b.cfg.key(r)
+	if !ok || len(b.ring) == 0 {
+		return b.fallback.Pick(r, candidates)
+	}
+
+	// An instance may take at most its share of the load, plus the slack the factor allows
+	allowed := make(map[*Upstream]bool, len(candidates))
+	var total int64
+	for _, u := range candidates {
+		allowed[u] = true
+		total += u.InFlight()
+	}
+	limit := int64(math.Ceil(b.cfg.LoadFactor * float64(total+1) / float64(len(candidates))))
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := mix64(h.Sum64())
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= sum })
+
+	var first *Upstream
+	for i := 0; i < len(b.ring); i++ {
+		u := b.ring[(start+i)%len(b.ring)].upstream
+		if !allowed[u] {
+			continue
+		}
+		if first == nil {
+			first = u
+		}
+		if u.InFlight() < limit {
+			return u
+		}
+	}
+	return first
+}
+
+// mix64 spreads FNV's output over the whole ring; short keys that differ only
+// in their last byte would otherwise hash close together
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// ==================== STICKY SESSIONS ====================
+
+// StickySessionConfig pins a client to the instance that first served it,
+// through a cookie the gateway sets; it works with any load balancer
+type StickySessionConfig struct {
+	Cookie string   `json:"cookie,omitempty"`
+	TTL    Duration `json:"ttl,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c StickySessionConfig) withDefaults() StickySessionConfig {
+	if c.Cookie == "" {
+		c.Cookie = "gw_upstream"
+	}
+	if c.TTL == 0 {
+		c.TTL = Duration(time.Hour)
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c StickySessionConfig) validate() error {
+	if c.TTL < 0 {
+		return errors.New("sticky_session ttl must not be negative")
+	}
+	return nil
+}
+
+// upstreamID names an instance in a sticky cookie without revealing its address
+func upstreamID(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// stickyUpstream returns the candidate the client's cookie pins it to, if that
+// instance can still take the request
+func (p *Pool) stickyUpstream(r *http.Request, candidates []*Upstream) *Upstream {
+	if p.sticky == nil {
+		return nil
+	}
+	c, err := r.Cookie(p.sticky.Cookie)
+	if err != nil {
+		return nil
+	}
+	for _, u := range candidates {
+		if u.id == c.Value {
+			return u
+		}
+	}
+	return nil
+}
+
+// pinSession points the client's sticky cookie at the instance that answered,
+// unless it already does. It runs after the response has been rewritten, so
+// a route's path rewrite is never applied to the gateway's own cookie.
+func (p *Pool) pinSession(resp *http.Response) {
+	if p.sticky == nil || resp.Request == nil {
+		return
+	}
+	var up *Upstream
+	for _, u := range p.Upstreams {
+		if u.URL.Host == resp.Request.URL.Host {
+			up = u
+		}
+	}
+	if up == nil {
+		return
+	}
+	if c, err := resp.Request.Cookie(p.sticky.Cookie); err == nil && c.Value == up.id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     p.sticky.Cookie,
+		Value:    up.id,
+		Path:     p.prefix,
+		MaxAge:   int(time.Duration(p.sticky.TTL).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
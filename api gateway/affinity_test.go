@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hashPool returns a consistent_hash balancer keyed on X-Tenant over n idle instances
+func hashPool(t *testing.T, n int, factor float64) (*consistentHash, []*Upstream) {
+	t.Helper()
+	b, err := newBalancer(ConsistentHash, &HashConfig{Header: "X-Tenant", LoadFactor: factor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	weights := make([]int, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	ups := testUpstreams(weights...)
+	ch := b.(*consistentHash)
+	ch.build(ups)
+	return ch, ups
+}
+
+// tenant returns a request keyed on the given tenant
+func tenant(key string) *http.Request {
+	r := httptest.NewRequest("GET", "/user/1", nil)
+	r.Header.Set("X-Tenant", key)
+	return r
+}
+
+func TestConsistentHashAffinity(t *testing.T) {
+	ch, ups := hashPool(t, 4, 0)
+
+	// Every key sticks to one instance, and the keys spread over all of them
+	home := make(map[string]*Upstream)
+	count := make(map[*Upstream]int)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("tenant-%d", i)
+		u := ch.Pick(tenant(key), ups)
+		if again := ch.Pick(tenant(key), ups); again != u {
+			t.Fatalf("%s went to %s, then %s", key, u.URL.Host, again.URL.Host)
+		}
+		home[key] = u
+		count[u]++
+	}
+	for _, u := range ups {
+		if count[u] < 300 {
+			t.Errorf("%s owns only %d of 2000 keys", u.URL.Host, count[u])
+		}
+	}
+
+	// Losing an instance only moves the keys it owned
+	rest := ups[1:]
+	for key, u := range home {
+		got := ch.Pick(tenant(key), rest)
+		if u != ups[0] && got != u {
+			t.Fatalf("%s moved from %s to %s when %s left", key, u.URL.Host, got.URL.Host, ups[0].URL.Host)
+		}
+		if got == ups[0] {
+			t.Fatalf("%s still sent to the removed instance", key)
+		}
+	}
+
+	// A rebuilt ring, as after a reload, places every key where it was
+	fresh, _ := newBalancer(ConsistentHash, &HashConfig{Header: "X-Tenant"})
+	fresh.(*consistentHash).build(ups)
+	for key, u := range home {
+		if got := fresh.Pick(tenant(key), ups); got != u {
+			t.Fatalf("%s moved from %s to %s after a rebuild", key, u.URL.Host, got.URL.Host)
+		}
+	}
+}
+
+func TestConsistentHashBoundedLoad(t *testing.T) {
+	ch, ups := hashPool(t, 4, 1.25)
+	r := tenant("acme")
+	home := ch.Pick(r, ups)
+
+	limit := func() int64 {
+		var total int64
+		for _, u := range ups {
+			total += u.InFlight()
+		}
+		return int64(math.Ceil(1.25 * float64(total+1) / float64(len(ups))))
+	}
+	set := func(homeLoad, others int64) {
+		for _, u := range ups {
+			u.inflight.Store(others)
+		}
+		home.inflight.Store(homeLoad)
+	}
+
+	// Walk the home instance's load up: it keeps the key until it reaches the limit
+	for load := int64(0); load < 40; load++ {
+		set(load, 10)
+		got := ch.Pick(r, ups)
+		if want := load < limit(); (got == home) != want {
+			t.Fatalf("home at %d of limit %d: picked home %v, want %v", load, limit(), got == home, want)
+		}
+	}
+
+	// Spilled keys go to the same next instance every time
+	set(40, 0)
+	next := ch.Pick(r, ups)
+	if next == home {
+		t.Fatal("overloaded home instance kept the key")
+	}
+	for i := 0; i < 10; i++ {
+		if got := ch.Pick(r, ups); got != next {
+			t.Fatalf("spill went to %s, then %s", next.URL.Host, got.URL.Host)
+		}
+	}
+}
+
+func TestConsistentHashHotKey(t *testing.T) {
+	// One hot key cannot push any instance past the load factor
+	for _, factor := range []float64{1.25, 1.5, 2} {
+		ch, ups := hashPool(t, 5, factor)
+		r := tenant("hot")
+		for i := 1; i <= 500; i++ {
+			ch.Pick(r, ups).inflight.Add(1)
+
+			var max int64
+			for _, u := range ups {
+				if u.InFlight() > max {
+					max = u.InFlight()
+				}
+			}
+			if bound := int64(math.Ceil(factor * float64(i) / float64(len(ups)))); max > bound {
+				t.Fatalf("factor %v after %d requests: an instance has %d in flight, bound %d", factor, i, max, bound)
+			}
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   HashConfig
+		setup func(r *http.Request)
+		want  string
+	}{
+		{"header", HashConfig{Header: "X-Tenant"}, func(r *http.Request) { r.Header.Set("X-Tenant", "acme") }, "acme"},
+		{"missing header", HashConfig{Header: "X-Tenant"}, func(r *http.Request) {}, ""},
+		{"cookie", HashConfig{Cookie: "cart"}, func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "cart", Value: "c42"}) }, "c42"},
+		{"path segment", HashConfig{PathSegment: 2}, func(r *http.Request) {}, "42"},
+		{"path segment past the end", HashConfig{PathSegment: 5}, func(r *http.Request) {}, ""},
+		{"path segment before a rewrite", HashConfig{PathSegment: 2}, func(r *http.Request) { r.URL.Path = "/v2/users/42/orders" }, "42"},
+		{"source ip", HashConfig{SourceIP: true}, func(r *http.Request) { r.RemoteAddr = "10.0.0.7:5123" }, "10.0.0.7"},
+		{"forwarded source ip", HashConfig{SourceIP: true}, func(r *http.Request) { r.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1") }, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/user/42/orders", nil)
+		tt.setup(r)
+		got, ok := tt.cfg.key(r)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("%s: key %q, %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// Requests without a key are still served, by load
+	ch, ups := hashPool(t, 3, 0)
+	if u := ch.Pick(httptest.NewRequest("GET", "/", nil), ups); u == nil {
+		t.Fatal("request without a key was not routed")
+	}
+}
+
+func TestHashConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg   HashConfig
+		valid bool
+	}{
+		{HashConfig{Header: "X-Tenant"}, true},
+		{HashConfig{SourceIP: true, LoadFactor: 1}, true},
+		{HashConfig{}, false},
+		{HashConfig{Header: "X-Tenant", Cookie: "cart"}, false},
+		{HashConfig{PathSegment: -1}, false},
+		{HashConfig{Header: "X-Tenant", LoadFactor: 0.5}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: error %v, want valid %v", tt.cfg, err, tt.valid)
+		}
+	}
+}
+
+func TestStickySessionWithRewrite(t *testing.T) {
+	// The upstream serves at its root and scopes its own cookie to it
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	rc := RouteConfig{
+		Name:          "user",
+		PathPrefix:    "/user/",
+		Upstreams:     []UpstreamConfig{{URL: backend.URL, Weight: 1}},
+		Rewrite:       &RewriteConfig{StripPrefix: "/user"},
+		StickySession: &StickySessionConfig{},
+	}
+	pool, err := newPool(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := reverseproxy(pool, rc, &Config{}, newRetryBudget(RetryBudgetConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil))
+	paths := make(map[string]string)
+	var sticky *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		paths[c.Name] = c.Path
+		if c.Name == "gw_upstream" {
+			sticky = c
+		}
+	}
+	if w.Body.String() != "/1" {
+		t.Fatalf("upstream saw %q, want the stripped path", w.Body.String())
+	}
+	if paths["session"] != "/user/" {
+		t.Errorf("upstream cookie path %q, want it mapped back to /user/", paths["session"])
+	}
+	if sticky == nil || sticky.Path != "/user/" {
+		t.Fatalf("sticky cookie %v, want one scoped to the route prefix /user/", sticky)
+	}
+
+	// A client already pinned to the instance is not sent the cookie again
+	r := httptest.NewRequest("GET", "/user/2", nil)
+	r.AddCookie(&http.Cookie{Name: sticky.Name, Value: sticky.Value})
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sticky.Name {
+			t.Errorf("pinned client was sent %s again", c)
+		}
+	}
+}
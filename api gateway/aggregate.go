@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// aggregateErrorsKey holds the failures of optional calls in a partial response
+const aggregateErrorsKey = "_errors"
+
+// pathVar matches a {name} variable in an aggregate or call path
+var pathVar = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// AggregateConfig is a composite endpoint: one client request fans out to
+// several gateway routes in parallel and the JSON answers are merged
+type AggregateConfig struct {
+	// Name identifies the endpoint in logs and error documents
+	Name string `json:"name"`
+
+	// Path is the endpoint's path; {name} segments become variables, e.g. "/dashboard/{id}"
+	Path string `json:"path"`
+
+	// Timeout is the default for calls that do not set their own
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Calls are made in parallel; each one's result goes under its name
+	Calls []AggregateCall `json:"calls"`
+}
+
+// AggregateCall is one request made by a composite endpoint
+type AggregateCall struct {
+	// Name is the key the call's result is stored under
+	Name string `json:"name"`
+
+	// Path is requested through the gateway's own routes, so their auth,
+	// caching and load balancing apply; it may use the endpoint's variables
+	Path string `json:"path"`
+
+	// Timeout bounds this call
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Optional calls that fail are reported in "_errors" instead of failing the request
+	Optional bool `json:"optional,omitempty"`
+
+	// Merge puts the fields of the call's JSON object at the top level instead of under Name
+	Merge bool `json:"merge,omitempty"`
+}
+
+// validate checks an aggregate and returns every problem found
+func (ag *AggregateConfig) validate() []error {
+	var errs []error
+	if !strings.HasPrefix(ag.Path, "/") {
+		errs = append(errs, fmt.Errorf("path %q must start with \"/\"", ag.Path))
+	}
+	if ag.Timeout < 0 {
+		errs = append(errs, errors.New("timeout must not be negative"))
+	}
+	if len(ag.Calls) == 0 {
+		errs = append(errs, errors.New("no calls defined"))
+	}
+
+	vars := make(map[string]bool)
+	for _, m := range pathVar.FindAllStringSubmatch(ag.Path, -1) {
+		vars[m[1]] = true
+	}
+
+	names := make(map[string]bool)
+	for _, c := range ag.Calls {
+		switch {
+		case c.Name == "" && !c.Merge:
+			errs = append(errs, errors.New("calls need a name unless they merge"))
+		case strings.HasPrefix(c.Name, "_"):
+			errs = append(errs, fmt.Errorf("call name %q must not start with \"_\"", c.Name))
+		case c.Name != "" && names[c.Name]:
+			errs = append(errs, fmt.Errorf("call %q listed twice", c.Name))
+		}
+		names[c.Name] = true
+
+		if !strings.HasPrefix(c.Path, "/") {
+			errs = append(errs, fmt.Errorf("call %q: path %q must start with \"/\"", c.Name, c.Path))
+		}
+		for _, m := range pathVar.FindAllStringSubmatch(c.Path, -1) {
+			if !vars[m[1]] {
+				errs = append(errs, fmt.Errorf("call %q: variable {%s} is not in the endpoint path", c.Name, m[1]))
+			}
+		}
+		if c.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("call %q: timeout must not be negative", c.Name))
+		}
+	}
+	return errs
+}
+
+// callResult is the outcome of one aggregate call
+type callResult struct {
+	status int
+	body   interface{}
+	err    error
+}
+
+// callFailure is how a failed optional call is reported to the client
+type callFailure struct {
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error"`
+}
+
+type aggregateCallKey struct{}
+
+// newAggregateHandler serves a composite endpoint, dispatching its calls to router
+func newAggregateHandler(ag AggregateConfig, router http.Handler) http.Handler {
+	defaultTimeout := time.Duration(ag.Timeout)
+	if defaultTimeout <= 0 {
+		defaultTimeout = 5 * time.Second
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A call that lands on another composite endpoint could fan out forever
+		if r.Context().Value(aggregateCallKey{}) != nil {
+			aggregateError(w, r, ag.Name, http.StatusLoopDetected, "aggregate_loop", "aggregate calls may not target another aggregate")
+			return
+		}
+
+		start := time.Now()
+		vars := mux.Vars(r)
+		results := make([]callResult, len(ag.Calls))
+
+		var wg sync.WaitGroup
+		for i, c := range ag.Calls {
+			timeout := time.Duration(c.Timeout)
+			if timeout <= 0 {
+				timeout = defaultTimeout
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// Calls run outside the server's handler goroutine, so nothing else
+				// would recover a panic on the way; it fails the call instead
+				defer func() {
+					if p := recover(); p != nil {
+						results[i] = callResult{status: http.StatusBadGateway, err: fmt.Errorf("call aborted: %v", p)}
+					}
+				}()
+				results[i] = aggregateCall(r, router, expandPath(c.Path, vars), timeout)
+			}()
+		}
+		wg.Wait()
+
+		doc := make(map[string]interface{})
+		failures := make(map[string]callFailure)
+		for i, c := range ag.Calls {
+			res := results[i]
+			if res.err != nil {
+				// Merged calls may have no name of their own
+				label := c.Name
+				if label == "" {
+					label = c.Path
+				}
+
+				if !c.Optional {
+					// A required call decides the outcome; pass client errors such as 401 through
+					status := http.StatusBadGateway
+					switch {
+					case errors.Is(res.err, context.DeadlineExceeded):
+						status = http.StatusGatewayTimeout
+					case res.status >= 400 && res.status < 500:
+						status = res.status
+					}
+					log.Printf("🧩 Aggregate %s [%s] failed: call %s: %v", ag.Name, requestID(r), label, res.err)
+					aggregateError(w, r, ag.Name, status, "aggregate_call_failed", fmt.Sprintf("call %q failed: %v", label, res.err))
+					return
+				}
+				failures[label] = callFailure{Status: res.status, Error: res.err.Error()}
+				continue
+			}
+
+			if obj, ok := res.body.(map[string]interface{}); ok && c.Merge {
+				for k, v := range obj {
+					doc[k] = v
+				}
+			} else {
+				doc[c.Name] = res.body
+			}
+		}
+		if len(failures) > 0 {
+			doc[aggregateErrorsKey] = failures
+		}
+
+		log.Printf("🧩 Aggregate %s [%s]: %d call(s), %d failed, in %v", ag.Name, requestID(r), len(ag.Calls), len(failures), time.Since(start).Round(time.Millisecond))
+		writeJSON(w, http.StatusOK, doc)
+	})
+}
+
+// aggregateCall makes one call through the gateway's routes and decodes its JSON answer
+func aggregateCall(r *http.Request, router http.Handler, target string, timeout time.Duration) callResult {
+	// The call is not served by the http.Server, so it must not look like it
+	// is: the proxy aborts a broken response with a panic only a server recovers
+	ctx := context.WithValue(r.Context(), http.ServerContextKey, nil)
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, aggregateCallKey{}, true), timeout)
+	defer cancel()
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return callResult{err: err}
+	}
+
+	// The call carries the client's credentials and request ID, but no body
+	cr := r.Clone(ctx)
+	cr.Method = http.MethodGet
+	cr.URL = u
+	cr.RequestURI = u.RequestURI()
+	cr.Body = http.NoBody
+	cr.ContentLength = 0
+	cr.Header.Del("Content-Type")
+	cr.Header.Del("Content-Length")
+	cr.Header.Del("Accept-Encoding")
+	cr.Header.Set("Accept", "application/json")
+
+	resp := newBufferedResponse()
+	router.ServeHTTP(resp, cr)
+
+	if err := ctx.Err(); err != nil {
+		return callResult{err: err}
+	}
+	if resp.status < 200 || resp.status > 299 {
+		return callResult{status: resp.status, err: fmt.Errorf("%s returned %d %s", u.Path, resp.status, http.StatusText(resp.status))}
+	}
+
+	var body interface{}
+	if resp.body.Len() > 0 {
+		if err := json.Unmarshal(resp.body.Bytes(), &body); err != nil {
+			return callResult{status: resp.status, err: fmt.Errorf("%s did not return JSON: %v", u.Path, err)}
+		}
+	}
+	return callResult{status: resp.status, body: body}
+}
+
+// expandPath substitutes the endpoint's variables into a call path
+func expandPath(path string, vars map[string]string) string {
+	return pathVar.ReplaceAllStringFunc(path, func(m string) string {
+		return url.PathEscape(vars[m[1:len(m)-1]])
+	})
+}
+
+// aggregateError rejects a composite request with the gateway's JSON error document
+func aggregateError(w http.ResponseWriter, r *http.Request, name string, status int, class, msg string) {
+	writeJSON(w, status, errorDocument{
+		Error:     class,
+		Message:   msg,
+		Status:    status,
+		Route:     name,
+		RequestID: requestID(r),
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// aggregateRouter returns a router with routes for the calls to land on,
+// plus the aggregate under test at /dashboard/{id}
+func aggregateRouter(ag AggregateConfig) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/user/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": %q, "name": "alice"}`, mux.Vars(r)["id"])
+	})
+	router.HandleFunc("/prefs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"theme": "dark", "lang": "en"}`)
+	})
+	router.HandleFunc("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	router.HandleFunc("/private", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "who are you", http.StatusUnauthorized)
+	})
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	router.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not json")
+	})
+	router.Handle("/dashboard/{id}", newAggregateHandler(ag, router))
+	router.Handle("/other", newAggregateHandler(AggregateConfig{Name: "other", Calls: []AggregateCall{{Name: "user", Path: "/user/1"}}}, router))
+	return router
+}
+
+func TestAggregate(t *testing.T) {
+	user := AggregateCall{Name: "user", Path: "/user/{id}"}
+	tests := []struct {
+		name       string
+		calls      []AggregateCall
+		wantStatus int
+		wantClass  string
+		wantKeys   []string
+		wantErrors []string
+	}{
+		{
+			name:       "every call succeeds",
+			calls:      []AggregateCall{user, {Path: "/prefs/{id}", Merge: true}},
+			wantStatus: 200, wantKeys: []string{"user", "theme", "lang"},
+		},
+		{
+			name:       "optional call fails",
+			calls:      []AggregateCall{user, {Name: "orders", Path: "/orders/{id}", Optional: true}},
+			wantStatus: 200, wantKeys: []string{"user"}, wantErrors: []string{"orders"},
+		},
+		{
+			name:       "optional calls failing in different ways",
+			calls:      []AggregateCall{user, {Name: "slow", Path: "/slow", Timeout: Duration(30 * time.Millisecond), Optional: true}, {Name: "text", Path: "/text", Optional: true}, {Name: "loop", Path: "/other", Optional: true}},
+			wantStatus: 200, wantKeys: []string{"user"}, wantErrors: []string{"slow", "text", "loop"},
+		},
+		{
+			name:       "required call fails",
+			calls:      []AggregateCall{user, {Name: "orders", Path: "/orders/{id}"}},
+			wantStatus: http.StatusBadGateway, wantClass: "aggregate_call_failed",
+		},
+		{
+			name:       "required call is refused",
+			calls:      []AggregateCall{user, {Name: "private", Path: "/private"}},
+			wantStatus: http.StatusUnauthorized, wantClass: "aggregate_call_failed",
+		},
+		{
+			name:       "required call times out",
+			calls:      []AggregateCall{user, {Name: "slow", Path: "/slow", Timeout: Duration(30 * time.Millisecond)}},
+			wantStatus: http.StatusGatewayTimeout, wantClass: "aggregate_call_failed",
+		},
+	}
+	for _, tt := range tests {
+		h := aggregateRouter(AggregateConfig{Name: "dashboard", Path: "/dashboard/{id}", Calls: tt.calls})
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/42", nil))
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%s: answered after %v, want calls bounded by their timeouts", tt.name, elapsed)
+		}
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body, tt.wantStatus)
+			continue
+		}
+		var doc map[string]json.RawMessage
+		json.NewDecoder(w.Body).Decode(&doc)
+		if tt.wantClass != "" {
+			if string(doc["error"]) != fmt.Sprintf("%q", tt.wantClass) {
+				t.Errorf("%s: error %s, want %s", tt.name, doc["error"], tt.wantClass)
+			}
+			continue
+		}
+
+		for _, k := range tt.wantKeys {
+			if _, ok := doc[k]; !ok {
+				t.Errorf("%s: no %q in %v", tt.name, k, doc)
+			}
+		}
+		var failures map[string]callFailure
+		json.Unmarshal(doc[aggregateErrorsKey], &failures)
+		if len(failures) != len(tt.wantErrors) {
+			t.Errorf("%s: failures %v, want %v", tt.name, failures, tt.wantErrors)
+		}
+		for _, name := range tt.wantErrors {
+			if _, ok := failures[name]; !ok {
+				t.Errorf("%s: call %q not reported in %s", tt.name, name, aggregateErrorsKey)
+			}
+		}
+		var got struct{ ID, Name string }
+		json.Unmarshal(doc["user"], &got)
+		if got.ID != "42" || got.Name != "alice" {
+			t.Errorf("%s: user %s, want the successful call's result", tt.name, doc["user"])
+		}
+	}
+}
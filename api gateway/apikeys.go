@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers used by API key authentication
+const (
+	apiKeyHeader     = "X-API-Key"
+	consumerIDHeader = "X-Consumer-ID"
+	apiKeyIDHeader   = "X-API-Key-ID"
+)
+
+// errUnknownAPIKey is returned when an admin request names a key that was never issued
+var errUnknownAPIKey = errors.New("no such api key")
+
+// APIKey is a consumer credential issued by the gateway. Only a hash of the
+// secret is stored; the secret itself is shown once, when the key is created.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Consumer  string     `json:"consumer"`
+	Prefix    string     `json:"prefix"`
+	Hash      string     `json:"hash,omitempty"`
+	Routes    []string   `json:"routes"`
+	Methods   []string   `json:"methods,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// allows checks whether the key may be used for the route and method right
+// now. A dead key is a 401; a live key used outside its scope is a 403.
+func (k *APIKey) allows(route, method string, now time.Time) (status int, err error) {
+	switch {
+	case k.RevokedAt != nil:
+		return http.StatusUnauthorized, errors.New("api key revoked")
+	case k.ExpiresAt != nil && now.After(*k.ExpiresAt):
+		return http.StatusUnauthorized, errors.New("api key expired")
+	case !containsString(k.Routes, route) && !containsString(k.Routes, "*"):
+		return http.StatusForbidden, fmt.Errorf("api key not valid for route %q", route)
+	case len(k.Methods) > 0 && !containsString(k.Methods, method):
+		return http.StatusForbidden, fmt.Errorf("api key not valid for %s", method)
+	}
+	return http.StatusOK, nil
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey returns the stored form of a key secret. The secrets are 256-bit
+// random values, so a plain SHA-256 is enough; there is nothing to brute-force.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyStore holds every issued key and persists them to a JSON file
+type apiKeyStore struct {
+	path string
+
+	mu     sync.RWMutex
+	byID   map[string]*APIKey
+	byHash map[string]*APIKey
+}
+
+// loadAPIKeyStore reads the key file at path; a missing file is an empty store
+func loadAPIKeyStore(path string) (*apiKeyStore, error) {
+	s := &apiKeyStore{path: path, byID: make(map[string]*APIKey), byHash: make(map[string]*APIKey)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, k := range keys {
+		s.byID[k.ID] = k
+		s.byHash[k.Hash] = k
+	}
+	return s, nil
+}
+
+// save writes the store to disk through a temporary file so a crash never leaves half a file
+func (s *apiKeyStore) save() error {
+	keys := make([]*APIKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		keys = append(keys, k)
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".api-keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// create issues a new key and returns it together with its secret
+func (s *apiKeyStore) create(consumer string, routes, methods []string, ttl time.Duration) (*APIKey, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := "gw_" + base64.RawURLEncoding.EncodeToString(raw)
+
+	id := make([]byte, 6)
+	rand.Read(id)
+
+	k := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Consumer:  consumer,
+		Prefix:    secret[:8],
+		Hash:      hashAPIKey(secret),
+		Routes:    routes,
+		Methods:   methods,
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		exp := k.CreatedAt.Add(ttl)
+		k.ExpiresAt = &exp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[k.ID] = k
+	s.byHash[k.Hash] = k
+	if err := s.save(); err != nil {
+		delete(s.byID, k.ID)
+		delete(s.byHash, k.Hash)
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+// revoke marks a key as revoked; revoked keys are kept so they show up in listings
+func (s *apiKeyStore) revoke(id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.byID[id]
+	if !ok {
+		return nil, errUnknownAPIKey
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		k.RevokedAt = &now
+		if err := s.save(); err != nil {
+			k.RevokedAt = nil
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// list returns a copy of every key, without hashes
+func (s *apiKeyStore) list() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]APIKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		c := *k
+		c.Hash = ""
+		out = append(out, c)
+	}
+	return out
+}
+
+// lookup finds the key for a secret presented by a client
+func (s *apiKeyStore) lookup(secret string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byHash[hashAPIKey(secret)]
+	return k, ok
+}
+
+// ==================== ROUTE MIDDLEWARE ====================
+
+// withAPIKey rejects requests without a valid key for the route, and tells the
+// upstream which consumer is calling. The key itself never leaves the gateway.
+func withAPIKey(route string, required bool, store *apiKeyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(apiKeyHeader)
+		r.Header.Del(apiKeyHeader)
+		r.Header.Del(consumerIDHeader)
+		r.Header.Del(apiKeyIDHeader)
+
+		if !required {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if secret == "" {
+			apiKeyError(w, r, route, http.StatusUnauthorized, "missing api key")
+			return
+		}
+		k, ok := store.lookup(secret)
+		if !ok {
+			apiKeyError(w, r, route, http.StatusUnauthorized, "unknown api key")
+			return
+		}
+
+		store.mu.RLock()
+		status, err := k.allows(route, r.Method, time.Now())
+		store.mu.RUnlock()
+		if err != nil {
+			apiKeyError(w, r, route, status, fmt.Sprintf("%v (key %s)", err, k.ID))
+			return
+		}
+
+		r.Header.Set(consumerIDHeader, k.Consumer)
+		r.Header.Set(apiKeyIDHeader, k.ID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyError rejects a request at the edge with the gateway's JSON error document
+func apiKeyError(w http.ResponseWriter, r *http.Request, route string, status int, msg string) {
+	class := "invalid_api_key"
+	if status == http.StatusForbidden {
+		class = "forbidden"
+	}
+	log.Printf("🚫 %s [%s] %s %s: %s", route, requestID(r), r.Method, r.URL.Path, msg)
+
+	writeJSON(w, status, errorDocument{
+		Error:     class,
+		Message:   msg,
+		Status:    status,
+		Route:     route,
+		RequestID: requestID(r),
+	})
+}
+
+// ==================== ADMIN ENDPOINTS ====================
+
+// createKeyRequest is the body of POST /gateway/keys
+type createKeyRequest struct {
+	Consumer  string   `json:"consumer"`
+	Routes    []string `json:"routes"`
+	Methods   []string `json:"methods,omitempty"`
+	ExpiresIn Duration `json:"expires_in,omitempty"`
+}
+
+// keysHandler serves the key admin API:
+//
+//	GET    /gateway/keys       list keys
+//	POST   /gateway/keys       create a key; the response holds the secret, shown only this once
+//	DELETE /gateway/keys/{id}  revoke a key
+func (g *Gateway) keysHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/gateway/keys"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, g.keys.list())
+
+	case r.Method == http.MethodPost && id == "":
+		var req createKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Consumer == "" || len(req.Routes) == 0 {
+			http.Error(w, "consumer and routes are required", http.StatusBadRequest)
+			return
+		}
+		for i, m := range req.Methods {
+			req.Methods[i] = strings.ToUpper(m)
+		}
+
+		k, secret, err := g.keys.create(req.Consumer, req.Routes, req.Methods, time.Duration(req.ExpiresIn))
+		if err != nil {
+			log.Printf("❌ Creating api key: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("🔑 API key %s created for %s (routes %v)", k.ID, k.Consumer, k.Routes)
+
+		c := *k
+		c.Hash = ""
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"key": secret, "api_key": c})
+
+	case r.Method == http.MethodDelete && id != "":
+		k, err := g.keys.revoke(id)
+		if errors.Is(err, errUnknownAPIKey) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("❌ Revoking api key %s: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("🔑 API key %s for %s revoked", k.ID, k.Consumer)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAllows(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		name   string
+		key    APIKey
+		route  string
+		method string
+		want   int
+	}{
+		{"in scope", APIKey{Routes: []string{"user"}}, "user", "GET", http.StatusOK},
+		{"any route", APIKey{Routes: []string{"*"}}, "payment", "POST", http.StatusOK},
+		{"other route", APIKey{Routes: []string{"user"}}, "payment", "GET", http.StatusForbidden},
+		{"allowed method", APIKey{Routes: []string{"user"}, Methods: []string{"GET"}}, "user", "GET", http.StatusOK},
+		{"other method", APIKey{Routes: []string{"user"}, Methods: []string{"GET"}}, "user", "DELETE", http.StatusForbidden},
+		{"not yet expired", APIKey{Routes: []string{"user"}, ExpiresAt: &future}, "user", "GET", http.StatusOK},
+		{"expired", APIKey{Routes: []string{"user"}, ExpiresAt: &past}, "user", "GET", http.StatusUnauthorized},
+		{"revoked", APIKey{Routes: []string{"*"}, RevokedAt: &past}, "user", "GET", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got, _ := tt.key.allows(tt.route, tt.method, now); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// keysRequest sends a request to the key admin API
+func keysRequest(g *Gateway, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	g.keysHandler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys.json")
+	store, err := loadAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gateway{keys: store}
+
+	// Issue a key for reads on the user route
+	w := keysRequest(g, "POST", "/gateway/keys", `{"consumer": "acme", "routes": ["user"], "methods": ["get"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var created struct {
+		Key    string `json:"key"`
+		APIKey APIKey `json:"api_key"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if !strings.HasPrefix(created.Key, created.APIKey.Prefix) || created.APIKey.Hash != "" {
+		t.Fatalf("create returned %+v", created)
+	}
+
+	// Listings never show the hash
+	w = keysRequest(g, "GET", "/gateway/keys", "")
+	var listed []APIKey
+	json.NewDecoder(w.Body).Decode(&listed)
+	if len(listed) != 1 || listed[0].ID != created.APIKey.ID || listed[0].Hash != "" {
+		t.Fatalf("list: %+v", listed)
+	}
+
+	var consumer, leaked string
+	h := withAPIKey("user", true, store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		consumer, leaked = r.Header.Get(consumerIDHeader), r.Header.Get(apiKeyHeader)
+	}))
+	call := func(method, key string) int {
+		r := httptest.NewRequest(method, "/user/1", nil)
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	steps := []struct {
+		name   string
+		method string
+		key    string
+		want   int
+	}{
+		{"valid key", "GET", created.Key, http.StatusOK},
+		{"method out of scope", "DELETE", created.Key, http.StatusForbidden},
+		{"no key", "GET", "", http.StatusUnauthorized},
+		{"unknown key", "GET", "gw_not-a-key", http.StatusUnauthorized},
+	}
+	for _, s := range steps {
+		if got := call(s.method, s.key); got != s.want {
+			t.Errorf("%s: %d, want %d", s.name, got, s.want)
+		}
+	}
+	if consumer != "acme" || leaked != "" {
+		t.Errorf("upstream saw consumer %q and key %q, want acme and no key", consumer, leaked)
+	}
+	other := withAPIKey("payment", true, store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/payment/1", nil)
+	r.Header.Set(apiKeyHeader, created.Key)
+	w = httptest.NewRecorder()
+	other.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("route out of scope: %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Keys survive a restart
+	reloaded, err := loadAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := reloaded.lookup(created.Key); !ok || k.Consumer != "acme" {
+		t.Fatal("key lost after reloading the store")
+	}
+
+	// A revoked key is refused, and stays revoked after a restart
+	if w := keysRequest(g, "DELETE", "/gateway/keys/"+created.APIKey.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if got := call("GET", created.Key); got != http.StatusUnauthorized {
+		t.Errorf("revoked key: %d, want %d", got, http.StatusUnauthorized)
+	}
+	reloaded, _ = loadAPIKeyStore(path)
+	if k, _ := reloaded.lookup(created.Key); k == nil || k.RevokedAt == nil {
+		t.Error("revocation lost after reloading the store")
+	}
+	if w := keysRequest(g, "DELETE", "/gateway/keys/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoke unknown key: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPIKeyRevokeSaveFailure(t *testing.T) {
+	store, _ := loadAPIKeyStore(filepath.Join(t.TempDir(), "api-keys.json"))
+	g := &Gateway{keys: store}
+	k, secret, err := store.create("acme", []string{"user"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key file can no longer be written
+	store.path = filepath.Join(t.TempDir(), "gone", "api-keys.json")
+	if w := keysRequest(g, "DELETE", "/gateway/keys/"+k.ID, ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("revoke without a writable key file: %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if k, _ := store.lookup(secret); k.RevokedAt != nil {
+		t.Fatal("key revoked in memory although the revocation was not saved")
+	}
+}
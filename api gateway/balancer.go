@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Upstream is one instance of a backend service that a route can send requests to
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+
+	// Version is the version of the service the instance runs, when the route splits traffic
+	Version string
+
+	// id names the instance in sticky session cookies
+	id string
+
+	// inflight counts requests sent to this instance whose response has not
+	// finished yet; it is shared with the same instance in the previous route
+	// table, so requests started before a reload still count
+	inflight *atomic.Int64
+
+	// requests counts every request ever sent to this instance
+	requests atomic.Int64
+
+	// draining is set by an operator to take the instance out of rotation;
+	// requests already on it are left to finish
+	draining atomic.Bool
+
+	// healthy is false while active health checks have taken the instance out of rotation
+	healthy atomic.Bool
+	health  healthState
+
+	// breaker fails requests fast while the instance keeps failing; nil when not configured
+	breaker *circuitBreaker
+}
+
+// Healthy reports whether the instance is in rotation
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// InFlight returns the number of outstanding requests on this instance
+func (u *Upstream) InFlight() int64 {
+	return u.inflight.Load()
+}
+
+// Draining reports whether an operator has taken the instance out of rotation
+func (u *Upstream) Draining() bool {
+	return u.draining.Load()
+}
+
+// Balancer chooses which upstream instance receives the next request
+type Balancer interface {
+	Pick(r *http.Request, candidates []*Upstream) *Upstream
+}
+
+// Names of the supported load-balancing strategies, as used in the config file
+const (
+	RoundRobin         = "round_robin"
+	WeightedRoundRobin = "weighted_round_robin"
+	LeastRequests      = "least_requests"
+	PowerOfTwoChoices  = "p2c"
+	ConsistentHash     = "consistent_hash"
+)
+
+// newBalancer returns a fresh balancer for the named strategy; hash configures consistent_hash
+func newBalancer(strategy string, hash *HashConfig) (Balancer, error) {
+	switch strategy {
+	case "", RoundRobin:
+		return &roundRobin{}, nil
+	case WeightedRoundRobin:
+		return &weightedRoundRobin{current: make(map[*Upstream]int)}, nil
+	case LeastRequests:
+		return &leastRequests{}, nil
+	case PowerOfTwoChoices:
+		return powerOfTwo{}, nil
+	case ConsistentHash:
+		if hash == nil {
+			return nil, errors.New("load_balancer consistent_hash needs a hash section")
+		}
+		return &consistentHash{cfg: hash.withDefaults()}, nil
+	default:
+		return nil, fmt.Errorf("unknown load_balancer %q", strategy)
+	}
+}
+
+// ==================== ROUND ROBIN ====================
+
+// roundRobin cycles through the candidates in order
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobin) Pick(_ *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 0 {
+		return nil
+	}
+	n := b.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// ==================== WEIGHTED ROUND ROBIN ====================
+
+// weightedRoundRobin is the "smooth" weighted round robin used by nginx:
+// heavier instances get proportionally more requests without long bursts
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Upstream]int
+}
+
+func (b *weightedRoundRobin) Pick(_ *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Upstream
+	total := 0
+	for _, u := range candidates {
+		b.current[u] += u.Weight
+		total += u.Weight
+		if best == nil || b.current[u] > b.current[best] {
+			best = u
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// ==================== LEAST OUTSTANDING REQUESTS ====================
+
+// leastRequests sends each request to the instance with the fewest requests in flight
+type leastRequests struct {
+	// tie rotates the starting point so equally loaded instances share traffic
+	tie atomic.Uint64
+}
+
+func (b *leastRequests) Pick(_ *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	start := int(b.tie.Add(1) % uint64(len(candidates)))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		u := candidates[(start+i)%len(candidates)]
+		if u.InFlight() < best.InFlight() {
+			best = u
+		}
+	}
+	return best
+}
+
+// ==================== POWER OF TWO CHOICES ====================
+
+// powerOfTwo samples two random instances and keeps the less loaded one,
+// which gets close to least-requests without scanning the whole pool
+type powerOfTwo struct{}
+
+func (powerOfTwo) Pick(_ *http.Request, candidates []*Upstream) *Upstream {
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := candidates[i], candidates[j]
+	if b.InFlight() < a.InFlight() {
+		return b
+	}
+	return a
+}
+
+// ==================== POOL ====================
+
+// Pool is the set of upstream instances behind one route
+type Pool struct {
+	Route     string
+	Strategy  string
+	Upstreams []*Upstream
+	balancer  Balancer
+
+	// checker actively probes the instances; nil when the route has no health_check
+	checker *healthChecker
+
+	// outlier ejects instances based on the responses they give; nil when not configured
+	outlier *outlierDetector
+
+	// bulkhead limits the outstanding requests to the route's upstream service,
+	// shared with other routes to it; nil when not configured
+	bulkhead *bulkhead
+
+	// hedge sends slow read requests to a second instance too; nil when not configured
+	hedge *hedger
+
+	// tlsConfig is used for https upstreams, by the proxy and the health checker alike
+	tlsConfig *tls.Config
+
+	// split divides requests between versions; nil when the route has a single version
+	split *trafficSplit
+
+	// shadow mirrors a sample of requests to a second upstream; nil when not configured
+	shadow *shadower
+
+	// faults are the route's fault injection rules, switched on and off at runtime
+	faults []*faultRule
+
+	// sticky pins clients to an instance by cookie, scoped to prefix; nil when not configured
+	sticky *StickySessionConfig
+	prefix string
+}
+
+// newPool builds a pool from a route's upstream config
+func newPool(rc RouteConfig) (*Pool, error) {
+	balancer, err := newBalancer(rc.LoadBalancer, rc.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newUpstreamTLS(rc.UpstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pool{Route: rc.Name, Strategy: rc.LoadBalancer, balancer: balancer, tlsConfig: tlsConfig, prefix: rc.PathPrefix}
+	if p.Strategy == "" {
+		p.Strategy = RoundRobin
+	}
+
+	// Every version's instances share the pool; Pick keeps each request within its version
+	versions := rc.Versions
+	if len(versions) == 0 {
+		versions = []VersionConfig{{Upstreams: rc.Upstreams}}
+	}
+	for _, v := range versions {
+		for _, uc := range v.Upstreams {
+			u, err := parseUpstream(uc.URL)
+			if err != nil {
+				return nil, err
+			}
+			up := &Upstream{URL: u, Weight: uc.Weight, Version: v.Name, id: upstreamID(u), inflight: new(atomic.Int64)}
+			up.breaker = newCircuitBreaker(rc.Name+"/"+u.Host, rc.CircuitBreaker)
+			up.healthy.Store(true)
+			p.Upstreams = append(p.Upstreams, up)
+		}
+	}
+	if ch, ok := balancer.(*consistentHash); ok {
+		ch.build(p.Upstreams)
+	}
+	if rc.StickySession != nil {
+		sticky := rc.StickySession.withDefaults()
+		p.sticky = &sticky
+	}
+	p.split = newTrafficSplit(rc)
+	p.faults = newFaultRules(rc)
+	if p.shadow, err = newShadower(rc, tlsConfig); err != nil {
+		return nil, err
+	}
+
+	p.checker = newHealthChecker(p, rc.HealthCheck)
+	p.outlier = newOutlierDetector(p, rc.OutlierDetection)
+	p.hedge = newHedger(rc.Hedge)
+	return p, nil
+}
+
+// Pick chooses an instance for the request, preferring ones not in tried. It
+// fails with errNoUpstream when no instance is healthy, undrained and not ejected and with *errCircuitOpen
+// when the healthy ones all have their circuit open.
+func (p *Pool) Pick(r *http.Request, tried map[*Upstream]bool) (*Upstream, error) {
+	candidates, err := p.available()
+	if err != nil {
+		return nil, err
+	}
+
+	// Stay within the request's version. If none of its instances can take the
+	// request, another version serves it, unless a tester forced this one.
+	if choice, ok := requestVersion(r); ok && p.split != nil {
+		same := make([]*Upstream, 0, len(candidates))
+		for _, u := range candidates {
+			if u.Version == choice.version {
+				same = append(same, u)
+			}
+		}
+		switch {
+		case len(same) > 0:
+			candidates = same
+		case choice.forced:
+			return nil, errNoUpstream
+		}
+	}
+
+	// A retry goes to a different instance when the pool has one left to try
+	if len(tried) > 0 {
+		fresh := make([]*Upstream, 0, len(candidates))
+		for _, u := range candidates {
+			if !tried[u] {
+				fresh = append(fresh, u)
+			}
+		}
+		if len(fresh) > 0 {
+			candidates = fresh
+		}
+	}
+	// A client with a sticky session stays on its instance while it can take requests
+	if u := p.stickyUpstream(r, candidates); u != nil {
+		return u, nil
+	}
+	return p.balancer.Pick(r, candidates), nil
+}
+
+// available returns the instances currently in rotation
+func (p *Pool) available() ([]*Upstream, error) {
+	out := make([]*Upstream, 0, len(p.Upstreams))
+	var open *errCircuitOpen
+
+	for _, u := range p.Upstreams {
+		if !u.Healthy() || u.Draining() || p.outlier.ejected(u) {
+			continue
+		}
+		if ok, wait := u.breaker.ready(); !ok {
+			// Remember the soonest any open circuit will let a trial through
+			if open == nil || wait < open.retryAfter {
+				open = &errCircuitOpen{retryAfter: wait}
+			}
+			continue
+		}
+		out = append(out, u)
+	}
+
+	switch {
+	case len(out) > 0:
+		return out, nil
+	case open != nil:
+		return nil, open
+	default:
+		return nil, errNoUpstream
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testUpstreams returns healthy instances named a, b, c... with the given weights
+func testUpstreams(weights ...int) []*Upstream {
+	out := make([]*Upstream, len(weights))
+	for i, w := range weights {
+		u := &url.URL{Scheme: "http", Host: string(rune('a' + i))}
+		out[i] = &Upstream{URL: u, Weight: w, id: upstreamID(u), inflight: new(atomic.Int64)}
+		out[i].healthy.Store(true)
+	}
+	return out
+}
+
+// picks runs n picks and returns the sequence of chosen hosts
+func picks(b Balancer, candidates []*Upstream, n int) string {
+	r := httptest.NewRequest("GET", "/", nil)
+	var seq strings.Builder
+	for i := 0; i < n; i++ {
+		seq.WriteString(b.Pick(r, candidates).URL.Host)
+	}
+	return seq.String()
+}
+
+func TestBalancerDistribution(t *testing.T) {
+	tests := []struct {
+		strategy string
+		weights  []int
+		n        int
+		want     map[string]int
+	}{
+		{RoundRobin, []int{1, 1, 1}, 300, map[string]int{"a": 100, "b": 100, "c": 100}},
+		{RoundRobin, []int{5, 1, 1}, 300, map[string]int{"a": 100, "b": 100, "c": 100}},
+		{WeightedRoundRobin, []int{5, 1, 1}, 700, map[string]int{"a": 500, "b": 100, "c": 100}},
+		{WeightedRoundRobin, []int{3, 2}, 500, map[string]int{"a": 300, "b": 200}},
+		{WeightedRoundRobin, []int{1, 1, 1}, 300, map[string]int{"a": 100, "b": 100, "c": 100}},
+		{LeastRequests, []int{1, 1, 1}, 300, map[string]int{"a": 100, "b": 100, "c": 100}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.strategy, tt.weights), func(t *testing.T) {
+			b, err := newBalancer(tt.strategy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, host := range picks(b, testUpstreams(tt.weights...), tt.n) {
+				got[string(host)]++
+			}
+			for host, want := range tt.want {
+				if got[host] != want {
+					t.Errorf("%s got %d requests, want %d (all: %v)", host, got[host], want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBalancerOrder(t *testing.T) {
+	tests := []struct {
+		strategy string
+		weights  []int
+		want     string
+	}{
+		{RoundRobin, []int{1, 1, 1}, "abcabc"},
+
+		// Smooth weighted round robin spreads the heavy instance's turns out
+		{WeightedRoundRobin, []int{5, 1, 1}, "aabacaa" + "aabacaa"},
+		{WeightedRoundRobin, []int{2, 1}, "aba" + "aba"},
+	}
+	for _, tt := range tests {
+		b, _ := newBalancer(tt.strategy, nil)
+		if got := picks(b, testUpstreams(tt.weights...), len(tt.want)); got != tt.want {
+			t.Errorf("%s %v: order %q, want %q", tt.strategy, tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestBalancerPrefersIdleInstances(t *testing.T) {
+	for _, strategy := range []string{LeastRequests, PowerOfTwoChoices} {
+		t.Run(strategy, func(t *testing.T) {
+			b, _ := newBalancer(strategy, nil)
+			ups := testUpstreams(1, 1, 1)
+			ups[0].inflight.Store(10)
+			ups[1].inflight.Store(2)
+			ups[2].inflight.Store(5)
+
+			// The busiest instance always loses, whichever two p2c samples
+			got := make(map[string]int)
+			for _, host := range picks(b, ups, 600) {
+				got[string(host)]++
+			}
+			if got["a"] != 0 {
+				t.Errorf("busiest instance got %d requests, want 0", got["a"])
+			}
+			if strategy == LeastRequests && got["b"] != 600 {
+				t.Errorf("least loaded instance got %d of 600 requests", got["b"])
+			}
+			// p2c picks c only when it samples a and c together, a third of the time
+			if strategy == PowerOfTwoChoices && (got["b"] < 300 || got["c"] == 0) {
+				t.Errorf("p2c split %v, want most on b and some on c", got)
+			}
+		})
+	}
+
+	b, _ := newBalancer(PowerOfTwoChoices, nil)
+	if got := picks(b, testUpstreams(1), 3); got != "aaa" {
+		t.Errorf("p2c with one instance: %q", got)
+	}
+	if got := b.Pick(httptest.NewRequest("GET", "/", nil), nil); got != nil {
+		t.Errorf("p2c with no instances: %v", got.URL)
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	p, err := newPool(RouteConfig{Name: "user", Upstreams: []UpstreamConfig{
+		{URL: "http://a", Weight: 1}, {URL: "http://b", Weight: 1}, {URL: "http://c", Weight: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := p.Upstreams[0], p.Upstreams[1], p.Upstreams[2]
+	r := httptest.NewRequest("GET", "/", nil)
+
+	pickHosts := func(tried map[*Upstream]bool, n int) map[string]int {
+		got := make(map[string]int)
+		for i := 0; i < n; i++ {
+			u, err := p.Pick(r, tried)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[u.URL.Host]++
+		}
+		return got
+	}
+
+	// Instances out of rotation get nothing
+	b.healthy.Store(false)
+	c.draining.Store(true)
+	if got := pickHosts(nil, 10); got["a"] != 10 {
+		t.Errorf("with b unhealthy and c draining: %v, want all on a", got)
+	}
+
+	// A retry avoids the instances already tried while others are left
+	b.healthy.Store(true)
+	c.draining.Store(false)
+	if got := pickHosts(map[*Upstream]bool{a: true, b: true}, 10); got["c"] != 10 {
+		t.Errorf("retry after a and b: %v, want all on c", got)
+	}
+	if got := pickHosts(map[*Upstream]bool{a: true, b: true, c: true}, 30); got["a"] != 10 || got["b"] != 10 || got["c"] != 10 {
+		t.Errorf("retry after trying everything: %v, want the whole pool", got)
+	}
+
+	a.healthy.Store(false)
+	b.healthy.Store(false)
+	c.draining.Store(true)
+	if _, err := p.Pick(r, nil); !errors.Is(err, errNoUpstream) {
+		t.Errorf("nothing in rotation: error %v, want errNoUpstream", err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig configures the circuit breaker kept for every upstream instance of a route
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures trips the circuit after this many failures in a row
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+
+	// ErrorRate trips the circuit when the share of failures in the current
+	// window reaches it (0.5 = 50%); 0 disables the rate check
+	ErrorRate float64 `json:"error_rate,omitempty"`
+
+	// MinRequests is how many requests a window needs before ErrorRate applies
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// Window is the length of the window ErrorRate is measured over
+	Window Duration `json:"window,omitempty"`
+
+	// OpenTimeout is how long the circuit stays open before trial requests are let through
+	OpenTimeout Duration `json:"open_timeout,omitempty"`
+
+	// HalfOpenRequests is how many trial requests may run, and must succeed, before the circuit closes
+	HalfOpenRequests int `json:"half_open_requests,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+	if c.Window <= 0 {
+		c.Window = Duration(10 * time.Second)
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = Duration(30 * time.Second)
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c CircuitBreakerConfig) validate() error {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("circuit_breaker error_rate %v must be between 0 and 1", c.ErrorRate)
+	}
+	return nil
+}
+
+// circuitState is one of closed, open or half-open
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// outcome is what a request that held a breaker slot reports back
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeAbandoned means the client went away first; it says nothing about the instance
+	outcomeAbandoned
+)
+
+// attemptOutcome classifies an upstream attempt. Running out of time, whether
+// on the route's timeout or the caller's deadline, counts against the
+// instance; only a client that cancelled leaves it unjudged.
+func attemptOutcome(req *http.Request, resp *http.Response, err error) outcome {
+	switch {
+	case err == nil && resp.StatusCode < 500:
+		return outcomeSuccess
+	case errors.Is(req.Context().Err(), context.Canceled):
+		return outcomeAbandoned
+	}
+	return outcomeFailure
+}
+
+// errCircuitOpen is returned instead of proxying when every candidate's circuit is open
+type errCircuitOpen struct {
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit open, retry after %v", e.retryAfter)
+}
+
+// circuitBreaker tracks the failures of one upstream instance
+type circuitBreaker struct {
+	name string
+	cfg  CircuitBreakerConfig
+
+	mu          sync.Mutex
+	state       circuitState
+	consecutive int
+	openedAt    time.Time
+
+	// the current error-rate window
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	// trial requests while half-open
+	trials    int
+	successes int
+}
+
+// newCircuitBreaker returns a breaker for the named instance, or nil when breaking is not configured
+func newCircuitBreaker(name string, cfg *CircuitBreakerConfig) *circuitBreaker {
+	if cfg == nil {
+		return nil
+	}
+	return &circuitBreaker{name: name, cfg: cfg.withDefaults(), windowStart: time.Now()}
+}
+
+// ready reports whether a request could be let through right now, without
+// reserving it. When it could not, wait is how long until it might.
+func (b *circuitBreaker) ready() (ok bool, wait time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.advance(now)
+	switch b.state {
+	case circuitOpen:
+		return false, b.openedAt.Add(time.Duration(b.cfg.OpenTimeout)).Sub(now)
+	case circuitHalfOpen:
+		return b.trials < b.cfg.HalfOpenRequests, time.Second
+	}
+	return true, 0
+}
+
+// allow reserves a slot for one request. When it returns a nil error the
+// caller must report the outcome through done exactly once.
+func (b *circuitBreaker) allow() (done func(outcome), err error) {
+	if b == nil {
+		return func(outcome) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.advance(now)
+	trial := false
+	switch b.state {
+	case circuitOpen:
+		return nil, &errCircuitOpen{retryAfter: b.openedAt.Add(time.Duration(b.cfg.OpenTimeout)).Sub(now)}
+	case circuitHalfOpen:
+		if b.trials >= b.cfg.HalfOpenRequests {
+			return nil, &errCircuitOpen{retryAfter: time.Second}
+		}
+		b.trials++
+		trial = true
+	}
+
+	var once sync.Once
+	return func(o outcome) {
+		once.Do(func() { b.record(o, trial) })
+	}, nil
+}
+
+// inherit takes over the state of the same instance's breaker in the previous
+// table. Trial requests still running belong to the old breaker, so a
+// half-open circuit starts its trials afresh.
+func (b *circuitBreaker) inherit(old *circuitBreaker) {
+	if b == nil || old == nil {
+		return
+	}
+	old.mu.Lock()
+	state, consecutive, openedAt := old.state, old.consecutive, old.openedAt
+	windowStart, requests, failures := old.windowStart, old.requests, old.failures
+	old.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state, b.consecutive, b.openedAt = state, consecutive, openedAt
+	b.windowStart, b.requests, b.failures = windowStart, requests, failures
+}
+
+// advance moves an open circuit to half-open once its timeout has passed
+// and starts a new error-rate window when the current one is over
+func (b *circuitBreaker) advance(now time.Time) {
+	if b.state == circuitOpen && now.Sub(b.openedAt) >= time.Duration(b.cfg.OpenTimeout) {
+		b.setState(circuitHalfOpen, "open timeout elapsed")
+		b.trials, b.successes = 0, 0
+	}
+	if now.Sub(b.windowStart) >= time.Duration(b.cfg.Window) {
+		b.windowStart = now
+		b.requests, b.failures = 0, 0
+	}
+}
+
+// record applies the outcome of one request to the breaker
+func (b *circuitBreaker) record(o outcome, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.advance(now)
+
+	if o == outcomeAbandoned {
+		// Hand an abandoned trial's slot to the next request instead
+		if trial && b.state == circuitHalfOpen && b.trials > 0 {
+			b.trials--
+		}
+		return
+	}
+	success := o == outcomeSuccess
+
+	switch b.state {
+	case circuitHalfOpen:
+		if !trial {
+			// Admitted before the circuit last opened; only trial requests decide now
+			return
+		}
+		if !success {
+			b.trip(now, "trial request failed")
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(circuitClosed, fmt.Sprintf("%d trial requests succeeded", b.successes))
+			b.consecutive = 0
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+		return
+
+	case circuitOpen:
+		// Admitted before the circuit tripped; it changes nothing now
+		return
+	}
+
+	b.requests++
+	if success {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.consecutive >= b.cfg.ConsecutiveFailures {
+		b.trip(now, fmt.Sprintf("%d consecutive failures", b.consecutive))
+		return
+	}
+	if b.cfg.ErrorRate > 0 && b.requests >= b.cfg.MinRequests {
+		if rate := float64(b.failures) / float64(b.requests); rate >= b.cfg.ErrorRate {
+			b.trip(now, fmt.Sprintf("error rate %.0f%% over %d requests", rate*100, b.requests))
+		}
+	}
+}
+
+// trip opens the circuit
+func (b *circuitBreaker) trip(now time.Time, reason string) {
+	b.openedAt = now
+	b.setState(circuitOpen, reason)
+}
+
+// setState changes state and logs the transition
+func (b *circuitBreaker) setState(s circuitState, reason string) {
+	if b.state == s {
+		return
+	}
+	log.Printf("⚡ Circuit %s: %s -> %s (%s)", b.name, b.state, s, reason)
+	b.state = s
+}
+
+// State returns the current state, for status reporting
+func (b *circuitBreaker) State() string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(time.Now())
+	return b.state.String()
+}
+
+// retryAfterSeconds turns an errCircuitOpen into a Retry-After value, rounding up to at least one second
+func retryAfterSeconds(err error) (int, bool) {
+	var open *errCircuitOpen
+	if !errors.As(err, &open) {
+		return 0, false
+	}
+	return int(math.Max(1, math.Ceil(open.retryAfter.Seconds()))), true
+}
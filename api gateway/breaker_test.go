@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runBreaker drives a breaker through steps separated by spaces and checks
+// its state after each one, written as step=state. The steps are:
+//
+//	ok, fail, cancel     send a request and report that outcome
+//	hold                 send a request and keep its result for later
+//	ok!, fail!, cancel!  report the oldest held request's outcome
+//	rejected             a request is refused with the circuit open
+//	expire               the open timeout passes
+func runBreaker(t *testing.T, cfg CircuitBreakerConfig, script string) {
+	t.Helper()
+	b := newCircuitBreaker("test", &cfg)
+	outcomes := map[string]outcome{"ok": outcomeSuccess, "fail": outcomeFailure, "cancel": outcomeAbandoned}
+	var held []func(outcome)
+
+	for _, step := range strings.Fields(script) {
+		do, want, _ := strings.Cut(step, "=")
+		switch {
+		case do == "expire":
+			b.mu.Lock()
+			b.openedAt = b.openedAt.Add(-time.Duration(b.cfg.OpenTimeout))
+			b.mu.Unlock()
+		case do == "rejected":
+			if _, err := b.allow(); err == nil {
+				t.Fatalf("%s: request let through", step)
+			}
+		case do == "hold":
+			done, err := b.allow()
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			held = append(held, done)
+		case strings.HasSuffix(do, "!"):
+			held[0](outcomes[strings.TrimSuffix(do, "!")])
+			held = held[1:]
+		default:
+			done, err := b.allow()
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			done(outcomes[do])
+		}
+		if want != "" {
+			if got := b.State(); got != want {
+				t.Fatalf("after %s: state %s, want %s (script %q)", do, got, want, script)
+			}
+		}
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    CircuitBreakerConfig
+		script string
+	}{
+		{
+			name:   "consecutive failures trip",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 3},
+			script: "fail fail ok=closed fail fail=closed fail=open rejected=open",
+		},
+		{
+			name:   "abandoned request neither counts nor resets",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 3},
+			script: "fail fail cancel=closed fail=open",
+		},
+		{
+			name:   "trial success closes",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 1},
+			script: "fail=open expire=half-open ok=closed ok=closed fail=open",
+		},
+		{
+			name:   "trial failure reopens",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 1},
+			script: "fail=open expire=half-open fail=open rejected=open expire=half-open",
+		},
+		{
+			name:   "trials are limited and must all succeed",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 1, HalfOpenRequests: 2},
+			script: "fail expire hold hold rejected=half-open ok!=half-open ok!=closed",
+		},
+		{
+			name:   "one failed trial of several reopens",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 1, HalfOpenRequests: 2},
+			script: "fail expire hold hold ok!=half-open fail!=open",
+		},
+		{
+			name:   "abandoned trial frees its slot",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 1},
+			script: "fail expire hold rejected cancel!=half-open ok=closed",
+		},
+		{
+			name:   "request admitted before the trip is ignored",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 2},
+			script: "hold hold fail fail=open ok!=open expire=half-open fail!=half-open ok=closed",
+		},
+		{
+			name:   "error rate trips once the window has enough requests",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 100, ErrorRate: 0.5, MinRequests: 4},
+			script: "ok fail ok=closed fail=open",
+		},
+		{
+			name:   "error rate below the threshold",
+			cfg:    CircuitBreakerConfig{ConsecutiveFailures: 100, ErrorRate: 0.5, MinRequests: 4},
+			script: "fail ok ok ok fail ok ok ok=closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runBreaker(t, tt.cfg, tt.script)
+		})
+	}
+}
+
+func TestCircuitBreakerInherit(t *testing.T) {
+	cfg := &CircuitBreakerConfig{ConsecutiveFailures: 1}
+	old := newCircuitBreaker("test", cfg)
+	done, _ := old.allow()
+	done(outcomeFailure)
+
+	b := newCircuitBreaker("test", cfg)
+	b.inherit(old)
+	if got := b.State(); got != "open" {
+		t.Fatalf("state after reload %s, want open", got)
+	}
+	if _, err := b.allow(); err == nil {
+		t.Fatal("reloaded breaker let a request through")
+	}
+
+	var nilBreaker *circuitBreaker
+	if ok, _ := nilBreaker.ready(); !ok {
+		t.Fatal("a route without a breaker must always be ready")
+	}
+}
+
+func TestAttemptOutcome(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+		err    error
+		want   outcome
+	}{
+		{"ok", context.Background(), http.StatusOK, nil, outcomeSuccess},
+		{"client error", context.Background(), http.StatusNotFound, nil, outcomeSuccess},
+		{"server error", context.Background(), http.StatusServiceUnavailable, nil, outcomeFailure},
+		{"connection refused", context.Background(), 0, errors.New("connection refused"), outcomeFailure},
+		{"client cancelled", cancelled, 0, context.Canceled, outcomeAbandoned},
+		{"deadline passed", expired, 0, context.DeadlineExceeded, outcomeFailure},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(tt.ctx)
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := attemptOutcome(req, resp, tt.err); got != tt.want {
+			t.Errorf("%s: outcome %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+		ok   bool
+	}{
+		{&errCircuitOpen{retryAfter: 10 * time.Second}, 10, true},
+		{&errCircuitOpen{retryAfter: 1500 * time.Millisecond}, 2, true},
+		{&errCircuitOpen{retryAfter: 0}, 1, true},
+		{errNoUpstream, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := retryAfterSeconds(tt.err); got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfterSeconds(%v) = %d, %v, want %d, %v", tt.err, got, ok, tt.want, tt.ok)
+		}
+	}
+}
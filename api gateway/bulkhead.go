@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Error classes reported to clients when a route's bulkhead sheds a request
+const (
+	errClassBulkheadFull = "bulkhead_full"
+	errClassQueueTimeout = "queue_timeout"
+)
+
+// BulkheadConfig caps how many requests the gateway can have outstanding at
+// an upstream service, so one slow backend cannot tie up every connection and
+// goroutine the gateway has and starve the routes to healthy ones
+type BulkheadConfig struct {
+	// Service names the upstream service the limit protects; every route with
+	// a bulkhead for the same service shares its slots. By default it is the
+	// route's set of upstream hosts, so routes to the same instances share one.
+	Service string `json:"service,omitempty"`
+
+	// MaxConcurrent is how many requests may be in progress at once
+	MaxConcurrent int `json:"max_concurrent"`
+
+	// MaxQueue is how many more may wait for a free slot; beyond that requests
+	// are rejected at once. 0 means none wait.
+	MaxQueue int `json:"max_queue,omitempty"`
+
+	// QueueTimeout is how long a request waits in the queue before it is rejected
+	QueueTimeout Duration `json:"queue_timeout,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c BulkheadConfig) withDefaults() BulkheadConfig {
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = Duration(time.Second)
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c BulkheadConfig) validate() error {
+	if c.MaxConcurrent <= 0 {
+		return errors.New("bulkhead max_concurrent must be above 0")
+	}
+	if c.MaxQueue < 0 {
+		return errors.New("bulkhead max_queue must not be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return errors.New("bulkhead queue_timeout must not be negative")
+	}
+	return nil
+}
+
+// errBulkheadFull and errQueueTimeout are why the bulkhead turned a request away
+var (
+	errBulkheadFull = errors.New("bulkhead full")
+	errQueueTimeout = errors.New("timed out waiting in the bulkhead queue")
+)
+
+// bulkhead is a service's concurrency limit with its wait queue
+type bulkhead struct {
+	service string
+	cfg     BulkheadConfig
+	slots   chan struct{}
+
+	queued   atomic.Int64
+	rejected atomic.Int64
+	timedOut atomic.Int64
+}
+
+// newBulkhead returns the bulkhead for a service; cfg has its defaults applied
+func newBulkhead(service string, cfg BulkheadConfig) *bulkhead {
+	return &bulkhead{service: service, cfg: cfg, slots: make(chan struct{}, cfg.MaxConcurrent)}
+}
+
+// sharedBulkhead returns the bulkhead for the service behind a pool, shared by
+// every route of the table that sends to that service. One whose settings
+// did not change is carried over from the previous table, along with the
+// requests still holding its slots.
+func (t *routeTable) sharedBulkhead(cfg BulkheadConfig, p *Pool, prev *routeTable) (*bulkhead, error) {
+	cfg = cfg.withDefaults()
+	service := cfg.Service
+	if service == "" {
+		hosts := make([]string, 0, len(p.Upstreams))
+		for _, u := range p.Upstreams {
+			if !containsString(hosts, u.URL.Host) {
+				hosts = append(hosts, u.URL.Host)
+			}
+		}
+		sort.Strings(hosts)
+		service = strings.Join(hosts, ",")
+	}
+
+	if b, ok := t.bulkheads[service]; ok {
+		if b.cfg != cfg {
+			return nil, fmt.Errorf("bulkhead settings differ from another route's for service %q", service)
+		}
+		return b, nil
+	}
+	b := newBulkhead(service, cfg)
+	if prev != nil {
+		if old, ok := prev.bulkheads[service]; ok && old.cfg == cfg {
+			b = old
+		}
+	}
+	if t.bulkheads == nil {
+		t.bulkheads = make(map[string]*bulkhead)
+	}
+	t.bulkheads[service] = b
+	return b, nil
+}
+
+// acquire takes a slot, waiting in the queue for one when there is room. The
+// wait ends at the queue timeout or the request's deadline, whichever is first.
+// On success the caller must call release once the request is done.
+func (b *bulkhead) acquire(r *http.Request) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if b.queued.Add(1) > int64(b.cfg.MaxQueue) {
+		b.queued.Add(-1)
+		b.rejected.Add(1)
+		return errBulkheadFull
+	}
+	defer b.queued.Add(-1)
+
+	t := time.NewTimer(time.Duration(b.cfg.QueueTimeout))
+	defer t.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		b.timedOut.Add(1)
+		return errQueueTimeout
+	case <-r.Context().Done():
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			b.timedOut.Add(1)
+			return errQueueTimeout
+		}
+		return r.Context().Err()
+	}
+}
+
+// release frees the slot taken by acquire
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+// withBulkhead runs next only once the service's bulkhead has a slot for the
+// request, and sheds the request with a 503 when it cannot get one in time
+func withBulkhead(route string, b *bulkhead, next http.Handler) http.Handler {
+	if b == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := b.acquire(r); err != nil {
+			if errors.Is(err, context.Canceled) {
+				// The client gave up while queued; nobody is left to answer
+				return
+			}
+
+			class := errClassBulkheadFull
+			if errors.Is(err, errQueueTimeout) {
+				class = errClassQueueTimeout
+			}
+			log.Printf("🚧 %s [%s] %s %s shed by the %s bulkhead: %v (%d in progress, %d queued)", route, requestID(r), r.Method, r.URL.Path, b.service, err, len(b.slots), b.queued.Load())
+
+			w.Header().Set("Retry-After", strconv.Itoa(1))
+			writeJSON(w, http.StatusServiceUnavailable, errorDocument{
+				Error:     class,
+				Message:   fmt.Sprintf("upstream service is at its limit of %d concurrent requests", b.cfg.MaxConcurrent),
+				Status:    http.StatusServiceUnavailable,
+				Route:     route,
+				RequestID: requestID(r),
+			})
+			return
+		}
+		defer b.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bulkheadStatus is the admin view of the bulkhead a route shares with the other routes to its service
+type bulkheadStatus struct {
+	Service       string `json:"service"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	InProgress    int    `json:"in_progress"`
+	MaxQueue      int    `json:"max_queue"`
+	Queued        int64  `json:"queued"`
+	Rejected      int64  `json:"rejected"`
+	TimedOut      int64  `json:"timed_out"`
+}
+
+// status returns a snapshot of the bulkhead's occupancy and counters
+func (b *bulkhead) status() *bulkheadStatus {
+	if b == nil {
+		return nil
+	}
+	return &bulkheadStatus{
+		Service:       b.service,
+		MaxConcurrent: b.cfg.MaxConcurrent,
+		InProgress:    len(b.slots),
+		MaxQueue:      b.cfg.MaxQueue,
+		Queued:        b.queued.Load(),
+		Rejected:      b.rejected.Load(),
+		TimedOut:      b.timedOut.Load(),
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// heldBulkhead returns a bulkhead handler whose only slot is taken until release is closed
+func heldBulkhead(t *testing.T, cfg BulkheadConfig) (b *bulkhead, h http.Handler, release chan struct{}) {
+	t.Helper()
+	cfg.MaxConcurrent = 1
+	b = newBulkhead("user-svc", cfg.withDefaults())
+	release = make(chan struct{})
+	h = withBulkhead("user", b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/user/slow" {
+			<-release
+		}
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/slow", nil))
+	deadline := time.Now().Add(time.Second)
+	for len(b.slots) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow request never took the slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return b, h, release
+}
+
+// shedClass returns the error class of a shed request, or "" when it was served
+func shedClass(w *httptest.ResponseRecorder) string {
+	if w.Code != http.StatusServiceUnavailable {
+		return ""
+	}
+	var doc errorDocument
+	json.NewDecoder(w.Body).Decode(&doc)
+	return doc.Error
+}
+
+func TestBulkheadQueueFull(t *testing.T) {
+	b, h, release := heldBulkhead(t, BulkheadConfig{MaxQueue: 1, QueueTimeout: Duration(5 * time.Second)})
+
+	// One request waits in the queue...
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil))
+		queued <- w
+	}()
+	deadline := time.Now().Add(time.Second)
+	for b.queued.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// ...and the next is turned away at once
+	w := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/user/2", nil))
+	if class := shedClass(w); class != errClassBulkheadFull || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("request over the queue: %d %q, want %s with Retry-After", w.Code, class, errClassBulkheadFull)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("rejection took %v, want it immediate", elapsed)
+	}
+
+	// The queued request gets the slot once it is free
+	close(release)
+	if w := <-queued; w.Code != http.StatusOK {
+		t.Errorf("queued request: %d, want it served", w.Code)
+	}
+	if st := b.status(); st.Rejected != 1 || st.TimedOut != 0 || st.InProgress != 0 || st.Queued != 0 {
+		t.Errorf("status %+v", st)
+	}
+}
+
+func TestBulkheadQueueWait(t *testing.T) {
+	tests := []struct {
+		name         string
+		queueTimeout time.Duration
+		deadline     time.Duration
+		cancel       bool
+		wantClass    string
+		wantTimedOut int64
+	}{
+		{"queue timeout", 30 * time.Millisecond, 0, false, errClassQueueTimeout, 1},
+		{"request deadline before the queue timeout", 5 * time.Second, 30 * time.Millisecond, false, errClassQueueTimeout, 1},
+		{"client gives up", 5 * time.Second, 0, true, "", 0},
+	}
+	for _, tt := range tests {
+		b, h, release := heldBulkhead(t, BulkheadConfig{MaxQueue: 5, QueueTimeout: Duration(tt.queueTimeout)})
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if tt.deadline > 0 {
+			ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+		}
+		if tt.cancel {
+			ctx, cancel = context.WithCancel(ctx)
+			time.AfterFunc(30*time.Millisecond, cancel)
+		}
+
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil).WithContext(ctx))
+		elapsed := time.Since(start)
+		cancel()
+		close(release)
+
+		if elapsed > time.Second {
+			t.Errorf("%s: waited %v in the queue", tt.name, elapsed)
+		}
+		if class := shedClass(w); class != tt.wantClass {
+			t.Errorf("%s: shed as %q, want %q", tt.name, class, tt.wantClass)
+		}
+		if tt.cancel && w.Body.Len() != 0 {
+			t.Errorf("%s: answered %q to a client that left", tt.name, w.Body)
+		}
+		if got := b.timedOut.Load(); got != tt.wantTimedOut {
+			t.Errorf("%s: %d timed out, want %d", tt.name, got, tt.wantTimedOut)
+		}
+	}
+}
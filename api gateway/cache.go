@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheStatusHeader tells the client how the gateway cache handled the response
+const cacheStatusHeader = "X-Cache"
+
+// Values of the X-Cache header
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// CacheConfig sizes the gateway-wide response cache shared by all routes
+type CacheConfig struct {
+	// MaxBytes bounds the total size of cached responses
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// MaxEntryBytes bounds a single cached response; larger ones are never stored
+	MaxEntryBytes int64 `json:"max_entry_bytes,omitempty"`
+}
+
+// RouteCacheConfig turns on response caching for a route. Upstream
+// Cache-Control and Expires headers always take precedence over these defaults.
+type RouteCacheConfig struct {
+	// DefaultTTL is the freshness lifetime of responses that carry no freshness information
+	DefaultTTL Duration `json:"default_ttl,omitempty"`
+
+	// StaleWhileRevalidate serves a stale entry while refreshing it in the background
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate,omitempty"`
+
+	// StaleIfError serves a stale entry when the upstream fails
+	StaleIfError Duration `json:"stale_if_error,omitempty"`
+}
+
+// withDefaults fills in any size the config file left out
+func (c CacheConfig) withDefaults() CacheConfig {
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 64 << 20
+	}
+	if c.MaxEntryBytes == 0 {
+		c.MaxEntryBytes = 1 << 20
+	}
+	return c
+}
+
+// validate rejects sizes that cannot work
+func (c CacheConfig) validate() error {
+	c = c.withDefaults()
+	if c.MaxBytes < 0 || c.MaxEntryBytes < 0 {
+		return errors.New("cache sizes must not be negative")
+	}
+	if c.MaxEntryBytes > c.MaxBytes {
+		return fmt.Errorf("cache max_entry_bytes %d is larger than max_bytes %d", c.MaxEntryBytes, c.MaxBytes)
+	}
+	return nil
+}
+
+// validate rejects negative durations
+func (c RouteCacheConfig) validate() error {
+	if c.DefaultTTL < 0 || c.StaleWhileRevalidate < 0 || c.StaleIfError < 0 {
+		return errors.New("cache durations must not be negative")
+	}
+	return nil
+}
+
+// cacheableStatus lists the status codes that may be stored (RFC 9111 heuristically cacheable)
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusNotFound: true,
+	http.StatusMethodNotAllowed: true, http.StatusGone: true, http.StatusPermanentRedirect: true,
+}
+
+// cacheControl is a parsed Cache-Control header; directive names are lower case
+type cacheControl map[string]string
+
+// parseCacheControl splits a Cache-Control header into its directives
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// has reports whether the directive is present
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive as a duration
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// ==================== ENTRIES ====================
+
+// cacheEntry is one stored response variant
+type cacheEntry struct {
+	key     string
+	primary string
+	path    string
+
+	status int
+	header http.Header
+	body   []byte
+
+	// storedAt is when the response was received; initialAge is the Age it arrived with
+	storedAt   time.Time
+	initialAge time.Duration
+
+	lifetime time.Duration
+	swr      time.Duration
+	sie      time.Duration
+
+	// vary holds the request header values this variant was stored for
+	vary map[string]string
+
+	revalidating atomic.Bool
+}
+
+// age returns the entry's current age
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.storedAt)
+}
+
+// size approximates the memory the entry holds
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.body) + len(e.key))
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// matches reports whether the entry's Vary values agree with the request
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if name == "*" || strings.Join(r.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ==================== LRU STORE ====================
+
+// responseCache is an LRU of response variants bounded by total byte size
+type responseCache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	variants map[string][]*cacheEntry
+	bytes    int64
+}
+
+// newResponseCache returns an empty cache, with defaults for unset sizes
+func newResponseCache(cfg CacheConfig) *responseCache {
+	c := &responseCache{
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		variants: make(map[string][]*cacheEntry),
+	}
+	c.resize(cfg)
+	return c
+}
+
+// resize applies new size limits, evicting entries if the cache shrank
+func (c *responseCache) resize(cfg CacheConfig) {
+	cfg = cfg.withDefaults()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes, c.maxEntryBytes = cfg.MaxBytes, cfg.MaxEntryBytes
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// get returns the variant stored for the request, marking it recently used
+func (c *responseCache) get(primary string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.variants[primary] {
+		if e.matches(r) {
+			c.lru.MoveToFront(c.entries[e.key])
+			return e
+		}
+	}
+	return nil
+}
+
+// put stores an entry, replacing the variant with the same key, then evicts
+// least recently used entries until the cache fits its byte limit again.
+// A nil entry (an uncacheable response) is ignored.
+func (c *responseCache) put(e *cacheEntry) {
+	if e == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e.size() > c.maxEntryBytes {
+		return
+	}
+
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el.Value.(*cacheEntry))
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.variants[e.primary] = append(c.variants[e.primary], e)
+	c.bytes += e.size()
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// remove drops one entry; the caller holds c.mu
+func (c *responseCache) remove(e *cacheEntry) {
+	el, ok := c.entries[e.key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.bytes -= e.size()
+
+	vs := c.variants[e.primary]
+	for i, v := range vs {
+		if v == e {
+			vs = append(vs[:i], vs[i+1:]...)
+			break
+		}
+	}
+	if len(vs) == 0 {
+		delete(c.variants, e.primary)
+	} else {
+		c.variants[e.primary] = vs
+	}
+}
+
+// entryLimit returns the largest response the cache will store
+func (c *responseCache) entryLimit() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxEntryBytes
+}
+
+// purgePrefix drops every entry whose path starts with prefix and returns how many went
+func (c *responseCache) purgePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, el := range c.entries {
+		if e := el.Value.(*cacheEntry); strings.HasPrefix(e.path, prefix) {
+			c.remove(e)
+			n++
+		}
+	}
+	return n
+}
+
+// stats reports the cache's size, for the admin endpoint
+func (c *responseCache) stats() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.bytes
+}
+
+// ==================== RESPONSE CAPTURE ====================
+
+// bufferedResponse is a ResponseWriter that keeps the whole response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// teeResponse writes through to the client while keeping a copy of the body,
+// up to limit bytes, so a cache miss can be stored without delaying the client
+type teeResponse struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (t *teeResponse) WriteHeader(status int) {
+	t.status = status
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeResponse) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	if !t.overflow {
+		if int64(t.buf.Len()+len(p)) > t.limit {
+			t.overflow = true
+			t.buf = bytes.Buffer{}
+		} else {
+			t.buf.Write(p)
+		}
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses streaming through the cache layer
+func (t *teeResponse) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ==================== ROUTE MIDDLEWARE ====================
+
+// routeCache applies the shared cache to one route
+type routeCache struct {
+	route string
+	cfg   RouteCacheConfig
+	store *responseCache
+	next  http.Handler
+}
+
+// withCache serves the route's GET requests from the cache when it can
+func withCache(route string, cfg *RouteCacheConfig, store *responseCache, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+	return &routeCache{route: route, cfg: *cfg, store: store, next: next}
+}
+
+func (rc *routeCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqCC := parseCacheControl(r.Header)
+	if r.Method != http.MethodGet || reqCC.has("no-store") {
+		w.Header().Set(cacheStatusHeader, cacheBypass)
+		rc.next.ServeHTTP(w, r)
+		return
+	}
+
+	// Versions of a service may answer differently, so each has its own entries
+	primary := rc.route + " " + r.Host + " " + r.URL.RequestURI()
+	if choice, ok := requestVersion(r); ok {
+		primary = choice.version + " " + primary
+	}
+	e := rc.store.get(primary, r)
+	if e == nil {
+		rc.fetch(w, r, primary)
+		return
+	}
+
+	now := time.Now()
+	age := e.age(now)
+	fresh := age < e.lifetime && !reqCC.has("no-cache")
+
+	switch {
+	case fresh:
+		rc.serve(w, r, e, cacheHit, now)
+
+	case age < e.lifetime+e.swr && !reqCC.has("no-cache"):
+		// Serve the stale copy now and refresh it for the next client
+		rc.serve(w, r, e, cacheStale, now)
+		if e.revalidating.CompareAndSwap(false, true) {
+			go rc.revalidateInBackground(r, primary, e)
+		}
+
+	default:
+		rc.revalidate(w, r, primary, e)
+	}
+}
+
+// serve writes a stored response to the client
+func (rc *routeCache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string, now time.Time) {
+	h := w.Header()
+	for k, vs := range e.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	h.Set(cacheStatusHeader, status)
+
+	// The client may already hold this exact version
+	if etag := e.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// fetch handles a miss: proxy straight to the client and keep a copy
+func (rc *routeCache) fetch(w http.ResponseWriter, r *http.Request, primary string) {
+	w.Header().Set(cacheStatusHeader, cacheMiss)
+	tee := &teeResponse{ResponseWriter: w, limit: rc.store.entryLimit()}
+	rc.next.ServeHTTP(tee, r)
+
+	if !tee.overflow {
+		rc.store.put(rc.newEntry(r, primary, tee.status, w.Header(), tee.buf.Bytes(), time.Now()))
+	}
+}
+
+// revalidate asks the upstream whether the stale entry is still good, and
+// falls back to the stale copy if the upstream fails within stale-if-error
+func (rc *routeCache) revalidate(w http.ResponseWriter, r *http.Request, primary string, e *cacheEntry) {
+	resp := rc.conditionalRequest(r, e)
+	now := time.Now()
+
+	switch {
+	case resp.status == http.StatusNotModified:
+		e = rc.refresh(r, primary, e, resp.header, now)
+		rc.serve(w, r, e, cacheRevalidated, now)
+
+	case resp.status >= 500 && e.age(now) < e.lifetime+e.sie:
+		log.Printf("♻️ %s: upstream answered %d, serving stale %s", rc.route, resp.status, r.URL.Path)
+		rc.serve(w, r, e, cacheStale, now)
+
+	default:
+		rc.store.put(rc.newEntry(r, primary, resp.status, resp.header, resp.body.Bytes(), now))
+		h := w.Header()
+		for k, vs := range resp.header {
+			h[k] = vs
+		}
+		h.Set(cacheStatusHeader, cacheMiss)
+		w.WriteHeader(resp.status)
+		w.Write(resp.body.Bytes())
+	}
+}
+
+// revalidateInBackground refreshes an entry served stale-while-revalidate
+func (rc *routeCache) revalidateInBackground(r *http.Request, primary string, e *cacheEntry) {
+	defer e.revalidating.Store(false)
+
+	// The client has its answer already, so this must not depend on its context
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp := rc.conditionalRequest(r.WithContext(ctx), e)
+	now := time.Now()
+	switch {
+	case resp.status == http.StatusNotModified:
+		rc.refresh(r, primary, e, resp.header, now)
+	case resp.status < 500:
+		rc.store.put(rc.newEntry(r, primary, resp.status, resp.header, resp.body.Bytes(), now))
+	}
+}
+
+// conditionalRequest re-sends the request upstream with the entry's validators
+func (rc *routeCache) conditionalRequest(r *http.Request, e *cacheEntry) *bufferedResponse {
+	cr := r.Clone(r.Context())
+	cr.Header.Del("If-None-Match")
+	cr.Header.Del("If-Modified-Since")
+	if etag := e.header.Get("ETag"); etag != "" {
+		cr.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.header.Get("Last-Modified"); lm != "" {
+		cr.Header.Set("If-Modified-Since", lm)
+	}
+
+	resp := newBufferedResponse()
+	rc.next.ServeHTTP(resp, cr)
+	return resp
+}
+
+// refresh applies a 304's headers to a stored entry and restarts its clock
+func (rc *routeCache) refresh(r *http.Request, primary string, e *cacheEntry, header http.Header, now time.Time) *cacheEntry {
+	merged := e.header.Clone()
+	for _, k := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified", "Vary"} {
+		if vs := header.Values(k); len(vs) > 0 {
+			merged[k] = vs
+		}
+	}
+	if ne := rc.newEntry(r, primary, e.status, merged, e.body, now); ne != nil {
+		rc.store.put(ne)
+		return ne
+	}
+	return e
+}
+
+// newEntry builds a cache entry from an upstream response, or returns nil if
+// the response must not be stored
+func (rc *routeCache) newEntry(r *http.Request, primary string, status int, header http.Header, body []byte, now time.Time) *cacheEntry {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return nil
+	}
+
+	// A response to an authenticated request is private unless the upstream says otherwise
+	authenticated := r.Header.Get("Authorization") != "" || r.Header.Get(consumerIDHeader) != ""
+	if authenticated && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return nil
+	}
+
+	lifetime, explicit := freshnessLifetime(cc, header)
+	if !explicit {
+		lifetime = time.Duration(rc.cfg.DefaultTTL)
+	}
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+	if lifetime <= 0 && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		// Never fresh and nothing to revalidate with: storing it would be pointless
+		return nil
+	}
+
+	e := &cacheEntry{
+		primary:  primary,
+		path:     r.URL.Path,
+		status:   status,
+		header:   header.Clone(),
+		body:     append([]byte(nil), body...),
+		storedAt: now,
+		lifetime: lifetime,
+		swr:      time.Duration(rc.cfg.StaleWhileRevalidate),
+		sie:      time.Duration(rc.cfg.StaleIfError),
+		vary:     make(map[string]string),
+	}
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		e.swr = d
+	}
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		e.sie = d
+	}
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		e.swr, e.sie = 0, 0
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		e.initialAge = time.Duration(age) * time.Second
+	}
+
+	// Per-request headers belong to the request that fetched the entry, not to the entry
+	for _, k := range []string{requestIDHeader, cacheStatusHeader, "Age"} {
+		e.header.Del(k)
+	}
+
+	key := primary
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			e.vary[name] = strings.Join(r.Header.Values(name), ",")
+			key += "\x00" + name + "=" + e.vary[name]
+		}
+	}
+	if _, ok := e.vary["*"]; ok {
+		return nil
+	}
+	e.key = key
+	return e
+}
+
+// freshnessLifetime reads the response's explicit freshness, preferring
+// s-maxage (the gateway is a shared cache), then max-age, then Expires
+func freshnessLifetime(cc cacheControl, h http.Header) (time.Duration, bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			// An invalid Expires means "already expired"
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// ==================== ADMIN ENDPOINT ====================
+
+// cacheHandler serves the cache admin API:
+//
+//	GET    /gateway/cache                   entry count and size
+//	DELETE /gateway/cache?prefix=/user/     purge every entry under a path prefix
+func (g *Gateway) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, bytes := g.cache.stats()
+		writeJSON(w, http.StatusOK, map[string]int64{"entries": int64(entries), "bytes": bytes})
+
+	case http.MethodDelete:
+		prefix := r.URL.Query().Get("prefix")
+		if !strings.HasPrefix(prefix, "/") {
+			http.Error(w, "prefix query parameter must start with \"/\"", http.StatusBadRequest)
+			return
+		}
+		n := g.cache.purgePrefix(prefix)
+		log.Printf("🧹 Purged %d cache entries under %s", n, prefix)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
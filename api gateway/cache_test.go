@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		cc       string
+		expires  string
+		want     time.Duration
+		explicit bool
+	}{
+		{"nothing", "", "", 0, false},
+		{"max-age", "max-age=60", "", time.Minute, true},
+		{"s-maxage wins for a shared cache", "max-age=60, s-maxage=300", "", 5 * time.Minute, true},
+		{"max-age wins over Expires", "max-age=10", date.Add(time.Hour).Format(http.TimeFormat), 10 * time.Second, true},
+		{"Expires relative to Date", "", date.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"invalid Expires is already expired", "", "0", 0, true},
+		{"malformed max-age is ignored", "max-age=soon", "", 0, false},
+		{"negative max-age is ignored", "max-age=-5", "", 0, false},
+		{"quoted and upper case", `Max-Age="30"`, "", 30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Date": {date.Format(http.TimeFormat)}}
+		if tt.cc != "" {
+			h.Set("Cache-Control", tt.cc)
+		}
+		if tt.expires != "" {
+			h.Set("Expires", tt.expires)
+		}
+		got, explicit := freshnessLifetime(parseCacheControl(h), h)
+		if got != tt.want || explicit != tt.explicit {
+			t.Errorf("%s: lifetime %v, %v, want %v, %v", tt.name, got, explicit, tt.want, tt.explicit)
+		}
+	}
+}
+
+func TestNewEntryStorable(t *testing.T) {
+	rc := &routeCache{route: "user", cfg: RouteCacheConfig{DefaultTTL: Duration(time.Minute)}}
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		auth     bool
+		stored   bool
+		lifetime time.Duration
+	}{
+		{"default TTL", 200, http.Header{}, false, true, time.Minute},
+		{"explicit max-age", 200, http.Header{"Cache-Control": {"max-age=5"}}, false, true, 5 * time.Second},
+		{"not found is cacheable", 404, http.Header{}, false, true, time.Minute},
+		{"server error", 500, http.Header{}, false, false, 0},
+		{"created", 201, http.Header{}, false, false, 0},
+		{"no-store", 200, http.Header{"Cache-Control": {"no-store"}}, false, false, 0},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false, false, 0},
+		{"sets a cookie", 200, http.Header{"Set-Cookie": {"session=1"}}, false, false, 0},
+		{"authenticated", 200, http.Header{"Cache-Control": {"max-age=60"}}, true, false, 0},
+		{"authenticated but public", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, true, true, time.Minute},
+		{"no-cache with a validator", 200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, false, true, 0},
+		{"no-cache without a validator", 200, http.Header{"Cache-Control": {"no-cache"}}, false, false, 0},
+		{"vary star", 200, http.Header{"Vary": {"*"}}, false, false, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/user/1", nil)
+		if tt.auth {
+			r.Header.Set("Authorization", "Bearer x")
+		}
+		e := rc.newEntry(r, "user /user/1", tt.status, tt.header, []byte("body"), time.Now())
+		if (e != nil) != tt.stored {
+			t.Errorf("%s: stored %v, want %v", tt.name, e != nil, tt.stored)
+			continue
+		}
+		if e != nil && e.lifetime != tt.lifetime {
+			t.Errorf("%s: lifetime %v, want %v", tt.name, e.lifetime, tt.lifetime)
+		}
+	}
+}
+
+// testOrigin is an upstream whose answers the cache tests control
+type testOrigin struct {
+	calls   int
+	status  int
+	header  http.Header
+	lastINM string
+}
+
+func (o *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.calls++
+	o.lastINM = r.Header.Get("If-None-Match")
+	for k, vs := range o.header {
+		w.Header()[k] = vs
+	}
+	if o.status == http.StatusOK && o.lastINM != "" && o.lastINM == o.header.Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(o.status)
+	fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("Accept-Language"))
+}
+
+// cachedGet sends a GET through the cache and returns the X-Cache status and body
+func cachedGet(h http.Handler, path string, header ...string) (string, string) {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Header().Get(cacheStatusHeader), w.Body.String()
+}
+
+// ageEntries makes every stored entry d older
+func ageEntries(store *responseCache, d time.Duration) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, el := range store.entries {
+		el.Value.(*cacheEntry).storedAt = el.Value.(*cacheEntry).storedAt.Add(-d)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	origin := &testOrigin{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}}
+	store := newResponseCache(CacheConfig{})
+	h := withCache("user", &RouteCacheConfig{StaleIfError: Duration(time.Hour)}, store, origin)
+
+	steps := []struct {
+		name   string
+		age    time.Duration
+		status int
+		header []string
+		want   string
+	}{
+		{"first request", 0, 200, nil, cacheMiss},
+		{"fresh", 0, 200, nil, cacheHit},
+		{"still fresh", 30 * time.Second, 200, nil, cacheHit},
+		{"client asks for a check", 0, 200, []string{"Cache-Control", "no-cache"}, cacheRevalidated},
+		{"stale, upstream has the same version", 2 * time.Minute, 200, nil, cacheRevalidated},
+		{"fresh again after revalidating", 0, 200, nil, cacheHit},
+		{"stale, upstream failing", 2 * time.Minute, 503, nil, cacheStale},
+		{"client bypasses the cache", 0, 200, []string{"Cache-Control", "no-store"}, cacheBypass},
+	}
+	for _, s := range steps {
+		ageEntries(store, s.age)
+		origin.status = s.status
+		if got, _ := cachedGet(h, "/user/1", s.header...); got != s.want {
+			t.Fatalf("%s: X-Cache %s, want %s", s.name, got, s.want)
+		}
+	}
+	if origin.lastINM != "" {
+		t.Errorf("bypassed request carried If-None-Match %q", origin.lastINM)
+	}
+
+	// A changed version replaces the stored one
+	origin.status = 200
+	origin.header.Set("ETag", `"v2"`)
+	ageEntries(store, 2*time.Minute)
+	if got, _ := cachedGet(h, "/user/1"); got != cacheMiss {
+		t.Fatalf("changed upstream: X-Cache %s, want %s", got, cacheMiss)
+	}
+	if origin.lastINM != `"v1"` {
+		t.Fatalf("revalidation sent If-None-Match %q, want the stored ETag", origin.lastINM)
+	}
+	if got, _ := cachedGet(h, "/user/1"); got != cacheHit {
+		t.Fatalf("after the change: X-Cache %s, want %s", got, cacheHit)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	origin := &testOrigin{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}}
+	h := withCache("user", &RouteCacheConfig{}, newResponseCache(CacheConfig{}), origin)
+
+	steps := []struct {
+		lang string
+		want string
+		body string
+	}{
+		{"en", cacheMiss, "/user/1 en"},
+		{"fr", cacheMiss, "/user/1 fr"},
+		{"en", cacheHit, "/user/1 en"},
+		{"fr", cacheHit, "/user/1 fr"},
+		{"", cacheMiss, "/user/1 "},
+		{"", cacheHit, "/user/1 "},
+	}
+	for i, s := range steps {
+		var header []string
+		if s.lang != "" {
+			header = []string{"Accept-Language", s.lang}
+		}
+		status, body := cachedGet(h, "/user/1", header...)
+		if status != s.want || body != s.body {
+			t.Fatalf("step %d (%q): %s %q, want %s %q", i, s.lang, status, body, s.want, s.body)
+		}
+	}
+	if origin.calls != 3 {
+		t.Fatalf("upstream called %d times, want once per variant", origin.calls)
+	}
+
+	// Vary: * can never be matched, so nothing is stored
+	origin.header.Set("Vary", "*")
+	for i := 0; i < 2; i++ {
+		if status, _ := cachedGet(h, "/user/2"); status != cacheMiss {
+			t.Fatalf("vary * request %d: X-Cache %s, want %s", i, status, cacheMiss)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	store := newResponseCache(CacheConfig{MaxBytes: 350, MaxEntryBytes: 200})
+	rc := &routeCache{route: "user", cfg: RouteCacheConfig{DefaultTTL: Duration(time.Minute)}, store: store}
+	put := func(path string, size int) {
+		r := httptest.NewRequest("GET", path, nil)
+		store.put(rc.newEntry(r, path, 200, http.Header{}, []byte(body[:size]), time.Now()))
+	}
+	has := func(path string) bool {
+		return store.get(path, httptest.NewRequest("GET", path, nil)) != nil
+	}
+
+	put("/a", 100)
+	put("/b", 100)
+	put("/c", 100)
+	has("/a") // a is now the most recently used
+	put("/d", 100)
+	if !has("/a") || has("/b") || !has("/c") || !has("/d") {
+		t.Fatal("want the least recently used entry /b evicted")
+	}
+
+	big := rc.newEntry(httptest.NewRequest("GET", "/huge", nil), "/huge", 200, http.Header{}, []byte(body+body+body), time.Now())
+	store.put(big)
+	if has("/huge") {
+		t.Fatal("entry over max_entry_bytes was stored")
+	}
+
+	if n := store.purgePrefix("/"); n == 0 {
+		t.Fatal("purge removed nothing")
+	}
+	if entries, bytes := store.stats(); entries != 0 || bytes != 0 {
+		t.Fatalf("after purge: %d entries, %d bytes", entries, bytes)
+	}
+}
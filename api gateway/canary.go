@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// servedVersionHeader tells the client which version of the service answered
+const servedVersionHeader = "X-Served-Version"
+
+// validVersionName keeps version names safe to put in headers, cookies and logs
+var validVersionName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// VersionConfig is one version of a route's service, e.g. the stable build
+// and a canary, with the share of traffic it receives
+type VersionConfig struct {
+	Name      string           `json:"name"`
+	Weight    int              `json:"weight"`
+	Upstreams []UpstreamConfig `json:"upstreams"`
+}
+
+// CanaryConfig controls how clients are assigned to versions
+type CanaryConfig struct {
+	// ForceHeader and ForceCookie name a version to use regardless of weights,
+	// for testers; a forced request fails rather than fall back to another version
+	ForceHeader string `json:"force_header,omitempty"`
+	ForceCookie string `json:"force_cookie,omitempty"`
+
+	// Sticky keeps a client on the version it was first given, through StickyCookie
+	Sticky       bool     `json:"sticky,omitempty"`
+	StickyCookie string   `json:"sticky_cookie,omitempty"`
+	StickyTTL    Duration `json:"sticky_ttl,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c CanaryConfig) withDefaults() CanaryConfig {
+	if c.ForceHeader == "" {
+		c.ForceHeader = "X-Canary-Version"
+	}
+	if c.ForceCookie == "" {
+		c.ForceCookie = "canary_version"
+	}
+	if c.StickyCookie == "" {
+		c.StickyCookie = "gw_version"
+	}
+	if c.StickyTTL == 0 {
+		c.StickyTTL = Duration(24 * time.Hour)
+	}
+	return c
+}
+
+// validateVersions checks a route's versions and returns every problem found
+func validateVersions(versions []VersionConfig) []error {
+	var errs []error
+	names := make(map[string]bool)
+	total := 0
+	for _, v := range versions {
+		if !validVersionName.MatchString(v.Name) {
+			errs = append(errs, fmt.Errorf("version name %q must be letters, digits, '.', '_' or '-'", v.Name))
+		}
+		if names[v.Name] {
+			errs = append(errs, fmt.Errorf("version %q listed twice", v.Name))
+		}
+		names[v.Name] = true
+
+		if v.Weight < 0 {
+			errs = append(errs, fmt.Errorf("version %q: weight must not be negative", v.Name))
+		}
+		total += v.Weight
+		if len(v.Upstreams) == 0 {
+			errs = append(errs, fmt.Errorf("version %q: no upstreams defined", v.Name))
+		}
+	}
+	if total <= 0 {
+		errs = append(errs, errors.New("versions need a total weight above 0"))
+	}
+	return errs
+}
+
+// ==================== TRAFFIC SPLIT ====================
+
+// versionStats counts what one version served, so versions can be compared
+type versionStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	latency  atomic.Int64 // total time to response headers, in nanoseconds
+}
+
+// trafficSplit divides a route's requests between its versions
+type trafficSplit struct {
+	route    string
+	prefix   string
+	cfg      CanaryConfig
+	versions []string
+
+	mu      sync.RWMutex
+	weights map[string]int
+
+	stats map[string]*versionStats
+}
+
+// newTrafficSplit returns the split for a route, or nil when it has no versions
+func newTrafficSplit(rc RouteConfig) *trafficSplit {
+	if len(rc.Versions) == 0 {
+		return nil
+	}
+	s := &trafficSplit{
+		route:   rc.Name,
+		prefix:  rc.PathPrefix,
+		cfg:     rc.Canary.withDefaults(),
+		weights: make(map[string]int),
+		stats:   make(map[string]*versionStats),
+	}
+	for _, v := range rc.Versions {
+		s.versions = append(s.versions, v.Name)
+		s.weights[v.Name] = v.Weight
+		s.stats[v.Name] = &versionStats{}
+	}
+	return s
+}
+
+// choose picks a version at random, in proportion to the current weights
+func (s *trafficSplit) choose() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := 0
+	for _, v := range s.versions {
+		total += s.weights[v]
+	}
+	n := rand.IntN(total)
+	for _, v := range s.versions {
+		if n -= s.weights[v]; n < 0 {
+			return v
+		}
+	}
+	return s.versions[0]
+}
+
+// weight returns a version's current weight; unknown versions weigh 0
+func (s *trafficSplit) weight(version string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.weights[version]
+}
+
+// currentWeights returns a copy of the weights
+func (s *trafficSplit) currentWeights() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]int, len(s.weights))
+	for v, w := range s.weights {
+		out[v] = w
+	}
+	return out
+}
+
+// setWeights replaces the weights; every version must be given, and at least one above 0
+func (s *trafficSplit) setWeights(weights map[string]int) error {
+	if len(weights) != len(s.versions) {
+		return fmt.Errorf("weights must be given for exactly these versions: %s", strings.Join(s.versions, ", "))
+	}
+	total := 0
+	for v, w := range weights {
+		if _, ok := s.stats[v]; !ok {
+			return fmt.Errorf("route %q has no version %q", s.route, v)
+		}
+		if w < 0 {
+			return fmt.Errorf("version %q: weight must not be negative", v)
+		}
+		total += w
+	}
+	if total <= 0 {
+		return errors.New("total weight must be above 0")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for v, w := range weights {
+		s.weights[v] = w
+	}
+	return nil
+}
+
+// record counts one response from a version
+func (s *trafficSplit) record(version string, status int, elapsed time.Duration) {
+	st, ok := s.stats[version]
+	if !ok {
+		return
+	}
+	st.requests.Add(1)
+	st.latency.Add(int64(elapsed))
+	if status >= 500 {
+		st.errors.Add(1)
+	}
+}
+
+// ==================== VERSION SELECTION ====================
+
+// versionChoice is the version picked for a request
+type versionChoice struct {
+	version string
+	forced  bool
+}
+
+type versionKey struct{}
+
+// requestVersion returns the version chosen for the request, if the route has versions
+func requestVersion(r *http.Request) (versionChoice, bool) {
+	c, ok := r.Context().Value(versionKey{}).(versionChoice)
+	return c, ok
+}
+
+// withVersion assigns each request a version of the route's service. A tester
+// can force one by header or cookie; otherwise a sticky client keeps the
+// version it was given, as long as that version still gets traffic.
+func withVersion(split *trafficSplit, next http.Handler) http.Handler {
+	if split == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		choice := versionChoice{}
+
+		if v := r.Header.Get(split.cfg.ForceHeader); v != "" {
+			choice = versionChoice{version: v, forced: true}
+		} else if c, err := r.Cookie(split.cfg.ForceCookie); err == nil && c.Value != "" {
+			choice = versionChoice{version: c.Value, forced: true}
+		}
+		if choice.forced {
+			if _, ok := split.stats[choice.version]; !ok {
+				http.Error(w, fmt.Sprintf("route %q has no version %q", split.route, choice.version), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !choice.forced && split.cfg.Sticky {
+			if c, err := r.Cookie(split.cfg.StickyCookie); err == nil && split.weight(c.Value) > 0 {
+				choice.version = c.Value
+			}
+		}
+
+		if choice.version == "" {
+			choice.version = split.choose()
+			if split.cfg.Sticky {
+				http.SetCookie(w, &http.Cookie{
+					Name:     split.cfg.StickyCookie,
+					Value:    choice.version,
+					Path:     split.prefix,
+					MaxAge:   int(time.Duration(split.cfg.StickyTTL).Seconds()),
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), versionKey{}, choice)))
+	})
+}
+
+// ==================== ADMIN ENDPOINT ====================
+
+// versionStatus is the admin view of one version
+type versionStatus struct {
+	Name         string  `json:"name"`
+	Weight       int     `json:"weight"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// splitStatus is the admin view of a route's traffic split
+type splitStatus struct {
+	Route    string          `json:"route"`
+	Versions []versionStatus `json:"versions"`
+}
+
+// status returns a snapshot of the split's weights and counters
+func (s *trafficSplit) status() splitStatus {
+	weights := s.currentWeights()
+	out := splitStatus{Route: s.route}
+	for _, v := range s.versions {
+		st := s.stats[v]
+		vs := versionStatus{Name: v, Weight: weights[v], Requests: st.requests.Load(), Errors: st.errors.Load()}
+		if vs.Requests > 0 {
+			vs.ErrorRate = float64(vs.Errors) / float64(vs.Requests)
+			vs.AvgLatencyMs = float64(st.latency.Load()) / float64(vs.Requests) / float64(time.Millisecond)
+		}
+		out.Versions = append(out.Versions, vs)
+	}
+	return out
+}
+
+// versionsHandler serves the traffic split admin API:
+//
+//	GET /gateway/versions          weights and per-version counters of every split route
+//	PUT /gateway/versions/{route}  set a route's weights, e.g. {"stable": 95, "canary": 5}
+func (g *Gateway) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	route := strings.Trim(strings.TrimPrefix(r.URL.Path, "/gateway/versions"), "/")
+	table := g.table.Load()
+
+	switch {
+	case r.Method == http.MethodGet && route == "":
+		out := []splitStatus{}
+		for _, p := range table.pools {
+			if p.split != nil {
+				out = append(out, p.split.status())
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case r.Method == http.MethodPut && route != "":
+		var split *trafficSplit
+		for _, p := range table.pools {
+			if p.Route == route && p.split != nil {
+				split = p.split
+			}
+		}
+		if split == nil {
+			http.Error(w, fmt.Sprintf("route %q has no versions", route), http.StatusNotFound)
+			return
+		}
+
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := split.setWeights(weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.rememberWeights(route, weights)
+
+		log.Printf("🎚️ Traffic split for %s set to %s", route, formatWeights(split))
+		writeJSON(w, http.StatusOK, split.status())
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rememberWeights keeps weights set at runtime so a config reload does not undo them
+func (g *Gateway) rememberWeights(route string, weights map[string]int) {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	if g.weights == nil {
+		g.weights = make(map[string]map[string]int)
+	}
+	g.weights[route] = weights
+}
+
+// restoreWeights re-applies runtime weights to a freshly built split. It
+// reports false when they no longer fit because the route's versions changed;
+// they are only forgotten once the new table is serving, so a rejected
+// reload keeps them.
+func (g *Gateway) restoreWeights(split *trafficSplit) bool {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+
+	weights, ok := g.weights[split.route]
+	if !ok {
+		return true
+	}
+	if err := split.setWeights(weights); err != nil {
+		log.Printf("⚠️ Runtime traffic split for %s no longer fits: %v", split.route, err)
+		return false
+	}
+	log.Printf("🎚️ Keeping runtime traffic split for %s: %s", split.route, formatWeights(split))
+	return true
+}
+
+// forgetWeights drops the runtime weights of routes that no longer fit them,
+// once the table without them has replaced the old one
+func (g *Gateway) forgetWeights(routes []string) {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	for _, route := range routes {
+		delete(g.weights, route)
+		log.Printf("⚠️ Dropped runtime traffic split for %s", route)
+	}
+}
+
+// formatWeights renders the weights for a log line, e.g. "canary=5 stable=95"
+func formatWeights(s *trafficSplit) string {
+	weights := s.currentWeights()
+	parts := make([]string, 0, len(weights))
+	for v, w := range weights {
+		parts = append(parts, fmt.Sprintf("%s=%d", v, w))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
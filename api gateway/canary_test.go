@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRuntimeWeightsAcrossReloads(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	dir := t.TempDir()
+	crt, key := ca.issue(t, "gateway", "localhost")
+	cert := writeCert(t, dir, "gateway", crt, key)
+
+	config := func(certFile, second string) string {
+		return fmt.Sprintf(`{
+			"tls": {"certificates": [{"cert_file": %q, "key_file": %q}]},
+			"routes": [{"name": "user", "path_prefix": "/user/", "versions": [
+				{"name": "stable", "weight": 90, "upstreams": ["http://10.0.0.1:8002"]},
+				{"name": %q, "weight": 10, "upstreams": ["http://10.0.0.2:8002"]}
+			]}]
+		}`, certFile, cert.KeyFile, second)
+	}
+	g := testGateway(t, config(cert.CertFile, "canary"))
+	g.rememberWeights("user", map[string]int{"stable": 50, "canary": 50})
+	remembered := func() bool {
+		g.overridesMu.Lock()
+		defer g.overridesMu.Unlock()
+		_, ok := g.weights["user"]
+		return ok
+	}
+
+	// A reload rejected after the table was built keeps the operator's weights
+	if err := reloadConfig(t, g, config(dir+"/missing.crt", "beta")); err == nil {
+		t.Fatal("reload with a missing certificate was accepted")
+	}
+	if !remembered() {
+		t.Fatal("rejected reload dropped the runtime weights")
+	}
+
+	// They still apply to a table with the same versions
+	if err := reloadConfig(t, g, config(cert.CertFile, "canary")); err != nil {
+		t.Fatal(err)
+	}
+	if w := g.table.Load().pool("user").split.currentWeights(); w["stable"] != 50 || w["canary"] != 50 {
+		t.Fatalf("weights after reload %v, want the runtime 50/50", w)
+	}
+
+	// Once the versions change and the reload goes through, they are dropped
+	if err := reloadConfig(t, g, config(cert.CertFile, "beta")); err != nil {
+		t.Fatal(err)
+	}
+	if remembered() {
+		t.Fatal("runtime weights kept for versions that no longer exist")
+	}
+	if w := g.table.Load().pool("user").split.currentWeights(); w["stable"] != 90 || w["beta"] != 10 {
+		t.Fatalf("weights %v, want the configured 90/10", w)
+	}
+}
@@ -0,0 +1,37 @@
+#!/bin/sh
+# Generates a throwaway CA and certificates for trying out TLS locally:
+#
+#   ca.pem / ca-key.pem           local CA that signs everything below
+#   localhost.pem / -key.pem      gateway certificate for localhost and 127.0.0.1
+#   api.local.pem / -key.pem      second gateway certificate, picked by SNI for api.local
+#   client.pem / -key.pem         client certificate (CN=client) for routes with client_cert
+#   gateway-client.pem / -key.pem the gateway's own client certificate for upstream mTLS
+#   upstream.pem / -key.pem       certificate for an https upstream on localhost
+#
+# Usage: ./gen-certs.sh [output dir]   (defaults to this directory)
+set -e
+cd "${1:-$(dirname "$0")}"
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 365 -subj "/CN=gateway-local-ca" \
+	-keyout ca-key.pem -out ca.pem 2>/dev/null
+
+# cert NAME CN EXTENSIONS
+cert() {
+	openssl req -newkey rsa:2048 -nodes -subj "/CN=$2" -keyout "$1-key.pem" -out "$1.csr" 2>/dev/null
+	printf '%s\n' "$3" > "$1.ext"
+	openssl x509 -req -in "$1.csr" -CA ca.pem -CAkey ca-key.pem -CAcreateserial -days 365 \
+		-extfile "$1.ext" -out "$1.pem" 2>/dev/null
+	rm -f "$1.csr" "$1.ext"
+}
+
+cert localhost localhost "subjectAltName=DNS:localhost,IP:127.0.0.1
+extendedKeyUsage=serverAuth"
+cert api.local api.local "subjectAltName=DNS:api.local,DNS:*.api.local
+extendedKeyUsage=serverAuth"
+cert upstream localhost "subjectAltName=DNS:localhost,IP:127.0.0.1
+extendedKeyUsage=serverAuth"
+cert client client "extendedKeyUsage=clientAuth"
+cert gateway-client gateway "extendedKeyUsage=clientAuth"
+rm -f ca.srl
+
+echo "Certificates written to $(pwd)"
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the top-level gateway configuration loaded from a JSON file
+type Config struct {
+	// Listen is the address the gateway accepts client traffic on
+	Listen string `json:"listen"`
+
+	// Server holds the timeouts of the gateway's own listener
+	Server ServerConfig `json:"server"`
+
+	// Admin configures the separate listener for the admin API
+	Admin AdminConfig `json:"admin"`
+
+	// TrustForwardedHeaders keeps Forwarded and X-Forwarded-* headers sent by
+	// the client; only enable it when the gateway sits behind a trusted proxy
+	TrustForwardedHeaders bool `json:"trust_forwarded_headers,omitempty"`
+
+	// StripResponseHeaders are removed from every upstream response; a
+	// trailing "*" matches a prefix. Defaults to Server, X-Powered-By and debug headers.
+	StripResponseHeaders []string `json:"strip_response_headers,omitempty"`
+
+	// TLS, when set, makes the gateway terminate TLS instead of serving plain HTTP
+	TLS *TLSConfig `json:"tls,omitempty"`
+
+	// JWT configures bearer token verification for routes with auth "required"
+	JWT *JWTConfig `json:"jwt,omitempty"`
+
+	// RetryBudget caps retries across all routes
+	RetryBudget RetryBudgetConfig `json:"retry_budget"`
+
+	// Cache sizes the response cache shared by routes that enable caching
+	Cache CacheConfig `json:"cache"`
+
+	// Routes is the route table, matched in the order given
+	Routes []RouteConfig `json:"routes"`
+
+	// Aggregates are composite endpoints that merge the answers of several routes
+	Aggregates []AggregateConfig `json:"aggregates,omitempty"`
+}
+
+// RouteConfig describes a single gateway route and where it is proxied to
+type RouteConfig struct {
+	// Name identifies the route in logs and error messages
+	Name string `json:"name"`
+
+	// PathPrefix is the request path prefix this route matches, e.g. "/user/"
+	PathPrefix string `json:"path_prefix"`
+
+	// Host optionally restricts the route to a Host header value
+	Host string `json:"host,omitempty"`
+
+	// Methods optionally restricts the route to the listed HTTP methods
+	Methods []string `json:"methods,omitempty"`
+
+	// Upstreams lists the upstream instances requests are forwarded to
+	Upstreams []UpstreamConfig `json:"upstreams"`
+
+	// Versions splits traffic between several versions of the service, each
+	// with its own upstreams and weight; use it instead of Upstreams
+	Versions []VersionConfig `json:"versions,omitempty"`
+
+	// Canary controls how clients are assigned to Versions
+	Canary CanaryConfig `json:"canary"`
+
+	// LoadBalancer names the strategy used to pick an instance: round_robin
+	// (the default), weighted_round_robin, least_requests, p2c or consistent_hash
+	LoadBalancer string `json:"load_balancer,omitempty"`
+
+	// Hash says what consistent_hash keys requests on
+	Hash *HashConfig `json:"hash,omitempty"`
+
+	// StickySession keeps each client on one instance by cookie, with any load balancer
+	StickySession *StickySessionConfig `json:"sticky_session,omitempty"`
+
+	// HealthCheck enables active probing of the upstream instances
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+
+	// OutlierDetection ejects instances whose proxied responses go bad
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+
+	// Bulkhead caps the requests the route may have outstanding upstream and sheds the rest
+	Bulkhead *BulkheadConfig `json:"bulkhead,omitempty"`
+
+	// CircuitBreaker enables a circuit breaker for each upstream instance
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// Retry enables automatic retries of idempotent requests
+	Retry *RetryConfig `json:"retry,omitempty"`
+
+	// Hedge sends slow read requests to a second instance and keeps the first answer
+	Hedge *HedgeConfig `json:"hedge,omitempty"`
+
+	// Timeouts bounds connecting to, and waiting on, the upstream
+	Timeouts TimeoutConfig `json:"timeouts"`
+
+	// Rewrite changes the request path before it is sent upstream
+	Rewrite *RewriteConfig `json:"rewrite,omitempty"`
+
+	// Headers edits request headers on the way in and response headers on the way out
+	Headers RouteHeaders `json:"headers"`
+
+	// Auth is "public" (the default) or "required" for a verified bearer token
+	Auth string `json:"auth,omitempty"`
+
+	// Scopes, when set, must all be present in the token; they imply auth "required"
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Shadow mirrors a sample of the route's requests to a second upstream for comparison
+	Shadow *ShadowConfig `json:"shadow,omitempty"`
+
+	// Faults inject latency, errors and connection resets for resilience testing
+	Faults []FaultConfig `json:"faults,omitempty"`
+
+	// Cache enables the response cache for the route's GET requests
+	Cache *RouteCacheConfig `json:"cache,omitempty"`
+
+	// Streams bounds WebSocket and Server-Sent Events connections
+	Streams StreamConfig `json:"streams"`
+
+	// ClientCert requires callers to present a verified TLS client certificate
+	ClientCert *ClientCertConfig `json:"client_cert,omitempty"`
+
+	// UpstreamTLS configures the CA and client certificate used for https upstreams
+	UpstreamTLS *UpstreamTLSConfig `json:"upstream_tls,omitempty"`
+
+	// APIKey requires callers to present a gateway-issued consumer API key
+	APIKey bool `json:"api_key,omitempty"`
+
+	// Options holds per-route proxy behaviour
+	Options RouteOptions `json:"options"`
+}
+
+// UpstreamConfig is one upstream instance. In the config file it can be
+// written either as a plain URL string or as {"url": ..., "weight": ...}.
+type UpstreamConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// UnmarshalJSON accepts both the string and the object form of an upstream
+func (u *UpstreamConfig) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*u = UpstreamConfig{URL: s}
+		return nil
+	}
+
+	// Decode through a second type so this method is not called recursively
+	type plain UpstreamConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(u))
+}
+
+// RouteOptions holds optional per-route proxy settings
+type RouteOptions struct {
+	// PreserveHost forwards the client's Host header instead of the upstream host
+	PreserveHost bool `json:"preserve_host,omitempty"`
+
+	// FlushInterval is how often the proxy flushes buffered response data; -1 flushes immediately
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+}
+
+// Duration is a time.Duration that reads from JSON as a string like "1.5s"
+type Duration time.Duration
+
+// UnmarshalJSON accepts either a Go duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("duration must be a string like \"5s\": %s", b)
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration back out in its string form
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// validMethods is the set of HTTP methods a route may restrict itself to
+var validMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// loadConfig reads and validates the gateway configuration at path
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	// Reject unknown fields so a typo in an option name is not silently ignored
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Validate checks the route table for mistakes that would otherwise only
+// show up as misrouted or failed requests at runtime
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		c.Listen = ":8080"
+	}
+	c.Admin = c.Admin.withDefaults()
+	if c.Admin.Listen == c.Listen {
+		return errors.New("admin listen address must differ from the gateway's")
+	}
+	if c.StripResponseHeaders == nil {
+		c.StripResponseHeaders = defaultStripResponseHeaders
+	}
+	if len(c.Routes) == 0 {
+		return errors.New("no routes defined")
+	}
+
+	var errs []error
+	names := make(map[string]bool)
+
+	if c.JWT != nil {
+		if err := c.JWT.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Cache.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i := range c.Routes {
+		rt := &c.Routes[i]
+		if rt.Name == "" {
+			rt.Name = rt.PathPrefix
+		}
+
+		if names[rt.Name] {
+			errs = append(errs, fmt.Errorf("route %q: duplicate route name", rt.Name))
+		}
+		names[rt.Name] = true
+
+		for _, err := range rt.validate() {
+			errs = append(errs, fmt.Errorf("route %q: %w", rt.Name, err))
+		}
+		if rt.Auth == AuthRequired && c.JWT == nil {
+			errs = append(errs, fmt.Errorf("route %q: auth %q needs a top-level jwt section", rt.Name, rt.Auth))
+		}
+		if rt.ClientCert != nil && (c.TLS == nil || c.TLS.ClientCAFile == "") {
+			errs = append(errs, fmt.Errorf("route %q: client_cert needs tls with a client_ca_file", rt.Name))
+		}
+	}
+
+	aggNames := make(map[string]bool)
+	for i := range c.Aggregates {
+		ag := &c.Aggregates[i]
+		if ag.Name == "" {
+			ag.Name = ag.Path
+		}
+		if aggNames[ag.Name] || names[ag.Name] {
+			errs = append(errs, fmt.Errorf("aggregate %q: name already used", ag.Name))
+		}
+		aggNames[ag.Name] = true
+
+		for _, err := range ag.validate() {
+			errs = append(errs, fmt.Errorf("aggregate %q: %w", ag.Name, err))
+		}
+	}
+
+	// Routes are registered with gorilla/mux in order, so when one prefix
+	// contains another on the same host, or a catch-all route comes before a
+	// host route, the later route may never match
+	for i := range c.Routes {
+		for j := i + 1; j < len(c.Routes); j++ {
+			a, b := &c.Routes[i], &c.Routes[j]
+			if !a.conflictsWith(b) {
+				continue
+			}
+			switch {
+			case a.Host == "" && b.Host != "":
+				errs = append(errs, fmt.Errorf("routes %q and %q: %q matches every host first, so %q on %s is shadowed; list the host route first", a.Name, b.Name, a.PathPrefix, b.PathPrefix, b.Host))
+			case a.PathPrefix == b.PathPrefix:
+				errs = append(errs, fmt.Errorf("routes %q and %q: duplicate path prefix %q", a.Name, b.Name, a.PathPrefix))
+			default:
+				errs = append(errs, fmt.Errorf("routes %q and %q: overlapping path prefixes %q and %q", a.Name, b.Name, a.PathPrefix, b.PathPrefix))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks a single route in isolation and returns every problem found
+func (rt *RouteConfig) validate() []error {
+	var errs []error
+
+	if !strings.HasPrefix(rt.PathPrefix, "/") {
+		errs = append(errs, fmt.Errorf("path_prefix %q must start with \"/\"", rt.PathPrefix))
+	}
+
+	for i, m := range rt.Methods {
+		m = strings.ToUpper(m)
+		if !validMethods[m] {
+			errs = append(errs, fmt.Errorf("unknown method %q", rt.Methods[i]))
+		}
+		rt.Methods[i] = m
+	}
+
+	switch {
+	case len(rt.Versions) > 0 && len(rt.Upstreams) > 0:
+		errs = append(errs, errors.New("use either upstreams or versions, not both"))
+	case len(rt.Versions) > 0:
+		errs = append(errs, validateVersions(rt.Versions)...)
+	case len(rt.Upstreams) == 0:
+		errs = append(errs, errors.New("no upstreams defined"))
+	}
+
+	// An instance may only appear once in the route, whichever version it belongs to
+	seen := make(map[string]bool)
+	errs = append(errs, validateUpstreams(rt.Upstreams, seen)...)
+	for i := range rt.Versions {
+		errs = append(errs, validateUpstreams(rt.Versions[i].Upstreams, seen)...)
+	}
+
+	if rt.Hash != nil {
+		if rt.LoadBalancer != ConsistentHash {
+			errs = append(errs, errors.New("hash is only used with load_balancer consistent_hash"))
+		}
+		if err := rt.Hash.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.StickySession != nil {
+		if err := rt.StickySession.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := newBalancer(rt.LoadBalancer, rt.Hash); err != nil {
+		errs = append(errs, err)
+	}
+
+	if rt.HealthCheck != nil {
+		if err := rt.HealthCheck.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.OutlierDetection != nil {
+		if err := rt.OutlierDetection.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.Bulkhead != nil {
+		if err := rt.Bulkhead.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.CircuitBreaker != nil {
+		if err := rt.CircuitBreaker.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.Retry != nil {
+		if err := rt.Retry.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.Hedge != nil {
+		if err := rt.Hedge.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.Cache != nil {
+		if err := rt.Cache.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rt.Shadow != nil {
+		if err := rt.Shadow.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	faults := make(map[string]bool)
+	for i := range rt.Faults {
+		f := &rt.Faults[i]
+		if faults[f.Name] {
+			errs = append(errs, fmt.Errorf("fault %q listed twice", f.Name))
+		}
+		faults[f.Name] = true
+		for _, err := range f.validate() {
+			errs = append(errs, fmt.Errorf("fault %q: %w", f.Name, err))
+		}
+	}
+	if rt.UpstreamTLS != nil {
+		if err := rt.UpstreamTLS.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := rt.Streams.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newPathRewriter(rt.Rewrite); err != nil {
+		errs = append(errs, err)
+	}
+
+	if rt.Auth == "" {
+		rt.Auth = AuthPublic
+		if len(rt.Scopes) > 0 {
+			rt.Auth = AuthRequired
+		}
+	}
+	switch {
+	case rt.Auth != AuthPublic && rt.Auth != AuthRequired:
+		errs = append(errs, fmt.Errorf("auth must be %q or %q, not %q", AuthPublic, AuthRequired, rt.Auth))
+	case rt.Auth == AuthPublic && len(rt.Scopes) > 0:
+		errs = append(errs, errors.New("a public route cannot require scopes"))
+	}
+
+	return errs
+}
+
+// validateUpstreams checks a list of upstreams and defaults their weights;
+// seen collects URLs across lists so duplicates are caught route-wide
+func validateUpstreams(upstreams []UpstreamConfig, seen map[string]bool) []error {
+	var errs []error
+	for i := range upstreams {
+		uc := &upstreams[i]
+		if _, err := parseUpstream(uc.URL); err != nil {
+			errs = append(errs, err)
+		}
+		if seen[uc.URL] {
+			errs = append(errs, fmt.Errorf("upstream %q listed twice", uc.URL))
+		}
+		seen[uc.URL] = true
+
+		if uc.Weight < 0 {
+			errs = append(errs, fmt.Errorf("upstream %q: weight must not be negative", uc.URL))
+		}
+		if uc.Weight == 0 {
+			uc.Weight = 1
+		}
+	}
+	return errs
+}
+
+// conflictsWith reports whether rt and other, listed after it, could both
+// match the same request. Routes are matched in order, so a host-specific
+// route before a catch-all one is a deliberate override, while one after it
+// would never see the requests the catch-all takes first.
+func (rt *RouteConfig) conflictsWith(other *RouteConfig) bool {
+	if rt.Host != "" && !strings.EqualFold(rt.Host, other.Host) {
+		return false
+	}
+	if len(rt.Methods) > 0 && len(other.Methods) > 0 && !sharesMethod(rt.Methods, other.Methods) {
+		return false
+	}
+	return strings.HasPrefix(rt.PathPrefix, other.PathPrefix) ||
+		strings.HasPrefix(other.PathPrefix, rt.PathPrefix)
+}
+
+// sharesMethod reports whether the two method lists have any entry in common
+func sharesMethod(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseUpstream parses an upstream base URL and rejects anything the
+// reverse proxy could not actually dial
+func parseUpstream(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream %q: missing host", raw)
+	}
+	return u, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// route returns a minimal valid route for prefix, optionally bound to a host
+func route(name, prefix, host string, methods ...string) RouteConfig {
+	return RouteConfig{
+		Name:       name,
+		PathPrefix: prefix,
+		Host:       host,
+		Methods:    methods,
+		Upstreams:  []UpstreamConfig{{URL: "http://localhost:8001"}},
+	}
+}
+
+func TestValidateRouteConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []RouteConfig
+		want   string // substring of the error, or "" for a valid table
+	}{
+		{
+			name:   "distinct prefixes",
+			routes: []RouteConfig{route("auth", "/auth/", ""), route("user", "/user/", "")},
+		},
+		{
+			name:   "duplicate prefix",
+			routes: []RouteConfig{route("a", "/user/", ""), route("b", "/user/", "")},
+			want:   `routes "a" and "b": duplicate path prefix "/user/"`,
+		},
+		{
+			name:   "overlapping prefixes",
+			routes: []RouteConfig{route("user", "/user/", ""), route("profile", "/user/profile/", "")},
+			want:   `routes "user" and "profile": overlapping path prefixes "/user/" and "/user/profile/"`,
+		},
+		{
+			name:   "overlap caught whichever comes first",
+			routes: []RouteConfig{route("profile", "/user/profile/", ""), route("user", "/user/", "")},
+			want:   "overlapping path prefixes",
+		},
+		{
+			name:   "catch-all root overlaps everything",
+			routes: []RouteConfig{route("user", "/user/", ""), route("root", "/", "")},
+			want:   "overlapping path prefixes",
+		},
+		{
+			name:   "host route before a catch-all",
+			routes: []RouteConfig{route("api", "/user/", "api.example.com"), route("user", "/user/", "")},
+		},
+		{
+			name:   "catch-all before a host route",
+			routes: []RouteConfig{route("user", "/user/", ""), route("api", "/user/", "api.example.com")},
+			want:   "list the host route first",
+		},
+		{
+			name:   "catch-all before a narrower host route",
+			routes: []RouteConfig{route("user", "/user/", ""), route("api", "/user/admin/", "api.example.com")},
+			want:   "list the host route first",
+		},
+		{
+			name:   "catch-all before a host route on another prefix",
+			routes: []RouteConfig{route("user", "/user/", ""), route("api", "/payment/", "api.example.com")},
+		},
+		{
+			name:   "two hosts on the same prefix",
+			routes: []RouteConfig{route("a", "/user/", "a.example.com"), route("b", "/user/", "b.example.com")},
+		},
+		{
+			name:   "same host compared case-insensitively",
+			routes: []RouteConfig{route("a", "/user/", "API.example.com"), route("b", "/user/", "api.example.com")},
+			want:   "duplicate path prefix",
+		},
+		{
+			name:   "disjoint methods",
+			routes: []RouteConfig{route("read", "/user/", "", "GET"), route("write", "/user/", "", "POST", "PUT")},
+		},
+		{
+			name:   "shared method after normalising case",
+			routes: []RouteConfig{route("read", "/user/", "", "get"), route("all", "/user/", "", "GET", "POST")},
+			want:   "duplicate path prefix",
+		},
+		{
+			name:   "method-restricted route next to an unrestricted one",
+			routes: []RouteConfig{route("read", "/user/", "", "GET"), route("all", "/user/", "")},
+			want:   "duplicate path prefix",
+		},
+		{
+			name:   "duplicate name",
+			routes: []RouteConfig{route("user", "/user/", ""), route("user", "/payment/", "")},
+			want:   `route "user": duplicate route name`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Routes: tt.routes}
+			err := cfg.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []UpstreamConfig
+		want      string
+	}{
+		{name: "http", upstreams: []UpstreamConfig{{URL: "http://localhost:8001"}}},
+		{name: "https with path", upstreams: []UpstreamConfig{{URL: "https://user.internal/api"}}},
+		{name: "no upstreams", want: "no upstreams defined"},
+		{name: "no scheme", upstreams: []UpstreamConfig{{URL: "localhost:8001"}}, want: "scheme must be http or https"},
+		{name: "other scheme", upstreams: []UpstreamConfig{{URL: "ftp://localhost:8001"}}, want: "scheme must be http or https"},
+		{name: "missing host", upstreams: []UpstreamConfig{{URL: "http:///user"}}, want: "missing host"},
+		{name: "unparseable", upstreams: []UpstreamConfig{{URL: "http://local host:8001"}}, want: `upstream "http://local host:8001"`},
+		{name: "empty", upstreams: []UpstreamConfig{{URL: ""}}, want: "scheme must be http or https"},
+		{
+			name:      "listed twice",
+			upstreams: []UpstreamConfig{{URL: "http://localhost:8001"}, {URL: "http://localhost:8001"}},
+			want:      `upstream "http://localhost:8001" listed twice`,
+		},
+		{name: "negative weight", upstreams: []UpstreamConfig{{URL: "http://localhost:8001", Weight: -1}}, want: "weight must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := route("user", "/user/", "")
+			rt.Upstreams = tt.upstreams
+			cfg := Config{Routes: []RouteConfig{rt}}
+			err := cfg.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	rt := route("", "/user/", "", "get")
+	rt.Upstreams = []UpstreamConfig{{URL: "http://localhost:8002"}, {URL: "http://localhost:8003", Weight: 3}}
+	cfg := Config{Routes: []RouteConfig{rt}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := cfg.Routes[0]
+	if cfg.Listen != ":8080" {
+		t.Errorf("listen %q, want :8080", cfg.Listen)
+	}
+	if got.Name != "/user/" {
+		t.Errorf("name %q, want the path prefix", got.Name)
+	}
+	if got.Methods[0] != "GET" {
+		t.Errorf("method %q, want GET", got.Methods[0])
+	}
+	if got.Upstreams[0].Weight != 1 || got.Upstreams[1].Weight != 3 {
+		t.Errorf("weights %d and %d, want 1 and 3", got.Upstreams[0].Weight, got.Upstreams[1].Weight)
+	}
+	if got.Auth != AuthPublic {
+		t.Errorf("auth %q, want %q", got.Auth, AuthPublic)
+	}
+
+	if err := (&Config{}).Validate(); err == nil || !strings.Contains(err.Error(), "no routes defined") {
+		t.Errorf("empty config: error %v, want no routes defined", err)
+	}
+	clash := Config{Listen: ":9000", Admin: AdminConfig{Listen: ":9000"}, Routes: []RouteConfig{route("user", "/user/", "")}}
+	if err := clash.Validate(); err == nil {
+		t.Error("admin on the gateway's address: want an error")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(body string) string {
+		path := filepath.Join(dir, "gateway.json")
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Upstreams may be plain URLs or objects with a weight
+	cfg, err := loadConfig(write(`{"routes": [{"path_prefix": "/user/", "upstreams": [
+		"http://localhost:8002", {"url": "http://localhost:8012", "weight": 2}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ups := cfg.Routes[0].Upstreams
+	if len(ups) != 2 || ups[0].URL != "http://localhost:8002" || ups[1].Weight != 2 {
+		t.Fatalf("upstreams %+v", ups)
+	}
+
+	// A misspelled option is an error rather than silently ignored
+	for _, body := range []string{
+		`{"routes": [{"path_prefix": "/user/", "upstream": ["http://localhost:8002"]}]}`,
+		`{"routes": [{"path_prefix": "/user/", "upstreams": [{"url": "http://localhost:8002", "wieght": 2}]}]}`,
+	} {
+		if _, err := loadConfig(write(body)); err == nil {
+			t.Errorf("config %s: want an unknown field error", body)
+		}
+	}
+
+	// The shipped example config must stay valid
+	if _, err := loadConfig("gateway.json"); err != nil {
+		t.Errorf("gateway.json: %v", err)
+	}
+}
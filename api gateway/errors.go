@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Error classes reported to clients when a request could not be proxied
+const (
+	errClassConnRefused    = "connection_refused"
+	errClassDNS            = "dns_failure"
+	errClassTimeout        = "upstream_timeout"
+	errClassTLS            = "tls_error"
+	errClassClientCanceled = "client_canceled"
+	errClassCircuitOpen    = "circuit_open"
+	errClassNoUpstream     = "no_upstream"
+	errClassUpstream       = "upstream_error"
+)
+
+// errorDocument is the JSON body the gateway sends when it cannot proxy a request
+type errorDocument struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	Status    int    `json:"status"`
+	Route     string `json:"route"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// classifyError maps a proxy failure to an error class and the status code sent to the client
+func classifyError(r *http.Request, err error) (class string, status int) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var open *errCircuitOpen
+
+	switch {
+	case errors.Is(err, context.Canceled) && r.Context().Err() == context.Canceled:
+		// Nobody will read this response, but the access log still gets a sensible status
+		return errClassClientCanceled, http.StatusBadGateway
+	case errors.As(err, &open):
+		return errClassCircuitOpen, http.StatusServiceUnavailable
+	case errors.Is(err, errNoUpstream):
+		return errClassNoUpstream, http.StatusServiceUnavailable
+	case errors.As(err, &dnsErr):
+		return errClassDNS, http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errClassTimeout, http.StatusGatewayTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errClassConnRefused, http.StatusServiceUnavailable
+	case isTLSError(err):
+		return errClassTLS, http.StatusBadGateway
+	}
+	return errClassUpstream, http.StatusBadGateway
+}
+
+// isTLSError reports whether err came from the TLS handshake with the upstream
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &recordErr),
+		errors.As(err, &verifyErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr):
+		return true
+	}
+	// Handshake alerts are not exported as types, only as "tls: ..." messages
+	return strings.Contains(err.Error(), "tls: ")
+}
+
+// newErrorHandler returns the ReverseProxy ErrorHandler for a route. It
+// answers with a JSON errorDocument instead of the proxy's bare 502.
+func newErrorHandler(route string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		class, status := classifyError(r, err)
+		id := requestID(r)
+
+		log.Printf("❌ Proxy error on %s [%s] %s %s: %s: %v", route, id, r.Method, r.URL.Path, class, err)
+
+		// An open circuit fails fast and tells the client when to come back
+		if secs, ok := retryAfterSeconds(err); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+		}
+
+		writeJSON(w, status, errorDocument{
+			Error:     class,
+			Message:   err.Error(),
+			Status:    status,
+			Route:     route,
+			RequestID: id,
+		})
+	}
+}
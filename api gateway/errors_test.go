@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	// A real refused connection, from a port nothing listens on any more
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, refused := net.Dial("tcp", l.Addr().String())
+	if refused == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	wrap := func(err error) error { return &url.Error{Op: "Get", URL: "http://10.0.0.1:8001/user/1", Err: err} }
+
+	tests := []struct {
+		name       string
+		err        error
+		ctx        context.Context
+		wantClass  string
+		wantStatus int
+	}{
+		{"connection refused", wrap(refused), nil, errClassConnRefused, http.StatusServiceUnavailable},
+		{"unknown host", wrap(&net.DNSError{Err: "no such host", Name: "user-svc", IsNotFound: true}), nil, errClassDNS, http.StatusBadGateway},
+		{"deadline", wrap(context.DeadlineExceeded), nil, errClassTimeout, http.StatusGatewayTimeout},
+		{"read timeout", wrap(&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), nil, errClassTimeout, http.StatusGatewayTimeout},
+		{"unknown certificate authority", wrap(x509.UnknownAuthorityError{}), nil, errClassTLS, http.StatusBadGateway},
+		{"handshake alert", wrap(errors.New("remote error: tls: bad certificate")), nil, errClassTLS, http.StatusBadGateway},
+		{"circuit open", fmt.Errorf("picking an instance: %w", &errCircuitOpen{retryAfter: time.Second}), nil, errClassCircuitOpen, http.StatusServiceUnavailable},
+		{"no instance left", errNoUpstream, nil, errClassNoUpstream, http.StatusServiceUnavailable},
+		{"client went away", wrap(context.Canceled), cancelled, errClassClientCanceled, http.StatusBadGateway},
+		{"cancelled by the gateway", wrap(context.Canceled), nil, errClassUpstream, http.StatusBadGateway},
+		{"anything else", errors.New("unexpected EOF"), nil, errClassUpstream, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/user/1", nil)
+		if tt.ctx != nil {
+			r = r.WithContext(tt.ctx)
+		}
+		if class, status := classifyError(r, tt.err); class != tt.wantClass || status != tt.wantStatus {
+			t.Errorf("%s: %s %d, want %s %d", tt.name, class, status, tt.wantClass, tt.wantStatus)
+		}
+	}
+}
+
+// timeoutError is a net.Error that reports a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorHandler(t *testing.T) {
+	h := newErrorHandler("user")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/user/1", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	h(w, r, &errCircuitOpen{retryAfter: 2500 * time.Millisecond})
+
+	var doc errorDocument
+	json.NewDecoder(w.Body).Decode(&doc)
+	want := errorDocument{Error: errClassCircuitOpen, Message: "circuit open, retry after 2.5s", Status: 503, Route: "user", RequestID: "req-1"}
+	if w.Code != http.StatusServiceUnavailable || doc != want {
+		t.Errorf("%d %+v, want 503 %+v", w.Code, doc, want)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Retry-After %q, want 3", got)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	// Only an open circuit says when to come back
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/user/1", nil), errNoUpstream)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "" {
+		t.Errorf("no upstream: %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		name       string
+		upstream   string
+		extra      string
+		wantClass  string
+		wantStatus int
+	}{
+		{"nothing listening", "http://" + l.Addr().String(), "", errClassConnRefused, http.StatusServiceUnavailable},
+		{"upstream too slow", slow.URL, `, "timeouts": {"request": "50ms"}`, errClassTimeout, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		g := testGateway(t, upstreamsConfig(tt.extra, tt.upstream))
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil))
+
+		var doc errorDocument
+		json.NewDecoder(w.Body).Decode(&doc)
+		if w.Code != tt.wantStatus || doc.Error != tt.wantClass || doc.Route != "user" {
+			t.Errorf("%s: %d %+v, want %d %s", tt.name, w.Code, doc, tt.wantStatus, tt.wantClass)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errClassFault marks an error the gateway returned on purpose, for resilience testing
+const errClassFault = "injected_fault"
+
+// FaultConfig is a fault injection rule: a share of the route's requests are
+// delayed, aborted or have their connection reset, to see how clients and
+// services cope with a degraded dependency
+type FaultConfig struct {
+	// Name identifies the rule in logs and the admin API
+	Name string `json:"name"`
+
+	// Percentage of matching requests the rule applies to, above 0 and up to 100
+	Percentage float64 `json:"percentage"`
+
+	// Headers optionally limits the rule to requests carrying all of these
+	// headers; an empty value only requires the header to be present
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Delay holds the request before it is passed on, or before it is aborted or reset
+	Delay *DelayFault `json:"delay,omitempty"`
+
+	// AbortStatus answers the request with this status instead of proxying it
+	AbortStatus int `json:"abort_status,omitempty"`
+
+	// Reset drops the client connection without a response
+	Reset bool `json:"reset,omitempty"`
+
+	// Disabled rules are loaded but not applied until switched on through the admin API
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// DelayFault is the latency a rule adds: a Fixed amount, a uniform spread
+// between Min and Max, or a normal distribution around Mean
+type DelayFault struct {
+	Fixed Duration `json:"fixed,omitempty"`
+
+	Min Duration `json:"min,omitempty"`
+	Max Duration `json:"max,omitempty"`
+
+	Mean   Duration `json:"mean,omitempty"`
+	StdDev Duration `json:"stddev,omitempty"`
+}
+
+// validate checks a rule and returns every problem found
+func (f *FaultConfig) validate() []error {
+	var errs []error
+	if !validVersionName.MatchString(f.Name) {
+		errs = append(errs, fmt.Errorf("name %q must be letters, digits, '.', '_' or '-'", f.Name))
+	}
+	if f.Percentage <= 0 || f.Percentage > 100 {
+		errs = append(errs, errors.New("percentage must be above 0 and at most 100"))
+	}
+	if f.Delay == nil && f.AbortStatus == 0 && !f.Reset {
+		errs = append(errs, errors.New("needs a delay, abort_status or reset"))
+	}
+	if f.AbortStatus != 0 && f.Reset {
+		errs = append(errs, errors.New("abort_status and reset cannot be combined"))
+	}
+	if f.AbortStatus != 0 && (f.AbortStatus < 400 || f.AbortStatus > 599) {
+		errs = append(errs, fmt.Errorf("abort_status %d must be a 4xx or 5xx code", f.AbortStatus))
+	}
+	if f.Delay != nil {
+		if err := f.Delay.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validate checks that exactly one kind of delay is given
+func (d *DelayFault) validate() error {
+	forms := 0
+	if d.Fixed != 0 {
+		forms++
+	}
+	if d.Min != 0 || d.Max != 0 {
+		forms++
+		if d.Max <= d.Min {
+			return errors.New("delay max must be above min")
+		}
+	}
+	if d.Mean != 0 || d.StdDev != 0 {
+		forms++
+		if d.Mean <= 0 {
+			return errors.New("delay mean must be above 0")
+		}
+	}
+	if forms != 1 {
+		return errors.New("delay needs exactly one of fixed, min/max or mean/stddev")
+	}
+	if d.Fixed < 0 || d.Min < 0 || d.StdDev < 0 {
+		return errors.New("delay must not be negative")
+	}
+	return nil
+}
+
+// sample draws one delay; a normal distribution is cut off at zero
+func (d *DelayFault) sample() time.Duration {
+	switch {
+	case d.Fixed > 0:
+		return time.Duration(d.Fixed)
+	case d.Max > 0:
+		return time.Duration(d.Min) + rand.N(time.Duration(d.Max-d.Min))
+	default:
+		return max(0, time.Duration(float64(d.Mean)+rand.NormFloat64()*float64(d.StdDev)))
+	}
+}
+
+// ==================== INJECTION ====================
+
+// faultRule is a rule as applied at runtime, with its switch and counter
+type faultRule struct {
+	FaultConfig
+	enabled  atomic.Bool
+	injected atomic.Int64
+}
+
+// matches reports whether the request carries the headers the rule asks for
+func (f *faultRule) matches(r *http.Request) bool {
+	for name, want := range f.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "" && !containsString(got, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newFaultRules returns a route's rules, or nil when it has none
+func newFaultRules(rc RouteConfig) []*faultRule {
+	var rules []*faultRule
+	for _, fc := range rc.Faults {
+		f := &faultRule{FaultConfig: fc}
+		f.enabled.Store(!fc.Disabled)
+		rules = append(rules, f)
+	}
+	return rules
+}
+
+// withFaults applies the first enabled rule that matches and wins its
+// percentage roll. Every injected fault is logged so test traffic can be
+// told apart from real failures.
+func withFaults(route string, rules []*faultRule, next http.Handler) http.Handler {
+	if len(rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rule *faultRule
+		for _, f := range rules {
+			if f.enabled.Load() && f.matches(r) && rand.Float64()*100 < f.Percentage {
+				rule = f
+				break
+			}
+		}
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule.injected.Add(1)
+
+		var effects []string
+		if rule.Delay != nil {
+			delay := rule.Delay.sample()
+			effects = append(effects, fmt.Sprintf("delay %v", delay.Round(time.Millisecond)))
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+			}
+		}
+		switch {
+		case rule.AbortStatus != 0:
+			effects = append(effects, fmt.Sprintf("abort %d", rule.AbortStatus))
+		case rule.Reset:
+			effects = append(effects, "reset")
+		}
+		log.Printf("💥 Fault %s on %s [%s] %s %s: %s", rule.Name, route, requestID(r), r.Method, r.URL.Path, strings.Join(effects, ", "))
+
+		if r.Context().Err() != nil {
+			return
+		}
+		switch {
+		case rule.AbortStatus != 0:
+			writeJSON(w, rule.AbortStatus, errorDocument{
+				Error:     errClassFault,
+				Message:   fmt.Sprintf("fault %q injected by the gateway", rule.Name),
+				Status:    rule.AbortStatus,
+				Route:     route,
+				RequestID: requestID(r),
+			})
+		case rule.Reset && r.Context().Value(aggregateCallKey{}) != nil:
+			// An aggregate call has no connection of its own to drop; it fails
+			// the way a dropped upstream connection would
+			writeJSON(w, http.StatusBadGateway, errorDocument{
+				Error:     errClassFault,
+				Message:   fmt.Sprintf("fault %q injected by the gateway", rule.Name),
+				Status:    http.StatusBadGateway,
+				Route:     route,
+				RequestID: requestID(r),
+			})
+		case rule.Reset:
+			resetConnection(w)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// resetConnection drops the client connection with a TCP reset. HTTP/2
+// connections cannot be taken over, so there only the stream is reset.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// ==================== ADMIN ENDPOINT ====================
+
+// faultStatus is the admin view of one rule
+type faultStatus struct {
+	Route string `json:"route"`
+	FaultConfig
+	Enabled  bool  `json:"enabled"`
+	Injected int64 `json:"injected"`
+}
+
+// faultsHandler serves the fault injection admin API:
+//
+//	GET  /gateway/faults                          every rule with its state and count
+//	POST /gateway/faults/{route}/{rule}/enable    start injecting the rule's fault
+//	POST /gateway/faults/{route}/{rule}/disable   stop injecting it
+func (g *Gateway) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/gateway/faults"), "/")
+	table := g.table.Load()
+
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out := []faultStatus{}
+		for _, p := range table.pools {
+			for _, f := range p.faults {
+				out = append(out, f.status(p.Route))
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || (parts[2] != "enable" && parts[2] != "disable") {
+		http.Error(w, "expected /gateway/faults/{route}/{rule}/enable or /disable", http.StatusNotFound)
+		return
+	}
+	route, name, enable := parts[0], parts[1], parts[2] == "enable"
+
+	for _, p := range table.pools {
+		if p.Route != route {
+			continue
+		}
+		for _, f := range p.faults {
+			if f.Name != name {
+				continue
+			}
+			f.enabled.Store(enable)
+			g.rememberFault(route, name, enable)
+			if enable {
+				log.Printf("💥 Fault %s on %s enabled: %.4g%% of matching requests", name, route, f.Percentage)
+			} else {
+				log.Printf("✅ Fault %s on %s disabled", name, route)
+			}
+			writeJSON(w, http.StatusOK, f.status(route))
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("route %q has no fault rule %q", route, name), http.StatusNotFound)
+}
+
+// status returns a snapshot of the rule
+func (f *faultRule) status(route string) faultStatus {
+	// Enabled reports the live state, so the configured starting state is left out
+	cfg := f.FaultConfig
+	cfg.Disabled = false
+	return faultStatus{Route: route, FaultConfig: cfg, Enabled: f.enabled.Load(), Injected: f.injected.Load()}
+}
+
+// rememberFault keeps a rule switched on or off through the admin API across reloads
+func (g *Gateway) rememberFault(route, name string, enabled bool) {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	if g.faults == nil {
+		g.faults = make(map[string]bool)
+	}
+	g.faults[route+"/"+name] = enabled
+}
+
+// restoreFaults re-applies admin switches to a freshly built pool's rules
+func (g *Gateway) restoreFaults(p *Pool) {
+	g.overridesMu.Lock()
+	defer g.overridesMu.Unlock()
+	for _, f := range p.faults {
+		if enabled, ok := g.faults[p.Route+"/"+f.Name]; ok {
+			f.enabled.Store(enabled)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// faultHandler returns the route's handler with the given rules in front of
+// an upstream that counts the requests reaching it
+func faultHandler(rules ...FaultConfig) (http.Handler, []*faultRule, *atomic.Int64) {
+	var reached atomic.Int64
+	faults := newFaultRules(RouteConfig{Faults: rules})
+	h := withFaults("user", faults, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+	}))
+	return h, faults, &reached
+}
+
+func TestFaultPercentage(t *testing.T) {
+	abort := func(pct float64, headers map[string]string, disabled bool) FaultConfig {
+		return FaultConfig{Name: "flaky", Percentage: pct, AbortStatus: 503, Headers: headers, Disabled: disabled}
+	}
+	tests := []struct {
+		name     string
+		rule     FaultConfig
+		header   string
+		min, max int
+	}{
+		{"every request", abort(100, nil, false), "", 1000, 1000},
+		{"a fifth of requests", abort(20, nil, false), "", 150, 250},
+		{"disabled", abort(100, nil, true), "", 0, 0},
+		{"only requests with the header", abort(100, map[string]string{"X-Chaos": ""}, false), "", 0, 0},
+		{"requests with the header", abort(100, map[string]string{"X-Chaos": ""}, false), "on", 1000, 1000},
+		{"header with the wrong value", abort(100, map[string]string{"X-Chaos": "on"}, false), "off", 0, 0},
+	}
+	for _, tt := range tests {
+		h, rules, reached := faultHandler(tt.rule)
+		aborted := 0
+		for i := 0; i < 1000; i++ {
+			r := httptest.NewRequest("GET", "/user/1", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Chaos", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code == http.StatusServiceUnavailable {
+				aborted++
+			}
+		}
+		if aborted < tt.min || aborted > tt.max {
+			t.Errorf("%s: %d of 1000 aborted, want %d to %d", tt.name, aborted, tt.min, tt.max)
+		}
+		if int(reached.Load()) != 1000-aborted || int(rules[0].injected.Load()) != aborted {
+			t.Errorf("%s: %d reached the upstream, %d counted as injected, for %d aborted",
+				tt.name, reached.Load(), rules[0].injected.Load(), aborted)
+		}
+	}
+}
+
+func TestFaultAbortAndDelay(t *testing.T) {
+	delay := &DelayFault{Fixed: Duration(50 * time.Millisecond)}
+	tests := []struct {
+		name        string
+		rule        FaultConfig
+		cancel      bool
+		wantStatus  int
+		wantReached int64
+		wantDelay   bool
+	}{
+		{"abort", FaultConfig{AbortStatus: 418}, false, 418, 0, false},
+		{"delay", FaultConfig{Delay: delay}, false, 200, 1, true},
+		{"delay then abort", FaultConfig{Delay: delay, AbortStatus: 503}, false, 503, 0, true},
+		{"client leaves during the delay", FaultConfig{Delay: &DelayFault{Fixed: Duration(time.Minute)}}, true, 200, 0, false},
+	}
+	for _, tt := range tests {
+		tt.rule.Name, tt.rule.Percentage = "test", 100
+		h, _, reached := faultHandler(tt.rule)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancel {
+			time.AfterFunc(20*time.Millisecond, cancel)
+		}
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil).WithContext(ctx))
+		elapsed := time.Since(start)
+		cancel()
+
+		if w.Code != tt.wantStatus || reached.Load() != tt.wantReached {
+			t.Errorf("%s: %d with %d upstream requests, want %d with %d", tt.name, w.Code, reached.Load(), tt.wantStatus, tt.wantReached)
+		}
+		if tt.wantDelay && elapsed < 50*time.Millisecond {
+			t.Errorf("%s: answered after %v, want at least the 50ms delay", tt.name, elapsed)
+		}
+		if elapsed > time.Second {
+			t.Errorf("%s: answered after %v", tt.name, elapsed)
+		}
+		if tt.cancel && w.Body.Len() != 0 {
+			t.Errorf("%s: answered %q to a client that left", tt.name, w.Body)
+		}
+		if tt.rule.AbortStatus != 0 {
+			var doc errorDocument
+			json.NewDecoder(w.Body).Decode(&doc)
+			if doc.Error != errClassFault || doc.Status != tt.wantStatus {
+				t.Errorf("%s: error document %+v", tt.name, doc)
+			}
+		}
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	h, _, reached := faultHandler(FaultConfig{Name: "drop", Percentage: 100, Reset: true})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/user/1")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("reset connection answered %d", resp.StatusCode)
+	}
+	if reached.Load() != 0 {
+		t.Error("reset request reached the upstream")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HeaderPolicy edits a set of headers. The steps run in the order remove,
+// rename, set, add, so a header can be renamed and then given a fresh value.
+type HeaderPolicy struct {
+	// Remove deletes headers; a trailing "*" removes every header with that prefix
+	Remove []string `json:"remove,omitempty"`
+
+	// Rename moves a header's values to a new name
+	Rename map[string]string `json:"rename,omitempty"`
+
+	// Set replaces any existing value
+	Set map[string]string `json:"set,omitempty"`
+
+	// Add appends a value, keeping existing ones
+	Add map[string]string `json:"add,omitempty"`
+}
+
+// RouteHeaders holds a route's request and response header policies
+type RouteHeaders struct {
+	Request  HeaderPolicy `json:"request"`
+	Response HeaderPolicy `json:"response"`
+}
+
+// defaultStripResponseHeaders are upstream headers that only leak internals to clients
+var defaultStripResponseHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-Debug-*", "X-Internal-*"}
+
+// apply edits h according to the policy
+func (p HeaderPolicy) apply(h http.Header) {
+	removeHeaders(h, p.Remove)
+
+	for from, to := range p.Rename {
+		if values := h.Values(from); len(values) > 0 {
+			h.Del(from)
+			for _, v := range values {
+				h.Add(to, v)
+			}
+		}
+	}
+	for k, v := range p.Set {
+		h.Set(k, v)
+	}
+	for k, v := range p.Add {
+		h.Add(k, v)
+	}
+}
+
+// removeHeaders deletes the named headers; names ending in "*" are prefixes
+func removeHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		prefix, ok := strings.CutSuffix(name, "*")
+		if !ok {
+			h.Del(name)
+			continue
+		}
+		prefix = http.CanonicalHeaderKey(prefix)
+		for k := range h {
+			if strings.HasPrefix(k, prefix) {
+				delete(h, k)
+			}
+		}
+	}
+}
+
+// setForwardedHeaders tells the upstream who the original client was and how
+// it reached the gateway. Unless the gateway sits behind a trusted proxy, any
+// forwarding headers the client sent are discarded first, since a client could
+// otherwise claim to be anyone. X-Forwarded-For itself is appended afterwards
+// by httputil.ReverseProxy.
+func setForwardedHeaders(req *http.Request, trust bool) {
+	if !trust {
+		for _, h := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+			req.Header.Del(h)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if !trust || req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !trust || req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	// RFC 7239: one element per hop, IPv6 addresses quoted and bracketed
+	elem := "proto=" + proto + ";host=" + quoteForwarded(req.Host)
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			ip = `"[` + ip + `]"`
+		}
+		elem = "for=" + ip + ";" + elem
+	}
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		elem = prior + ", " + elem
+	}
+	req.Header.Set("Forwarded", elem)
+}
+
+// quoteForwarded quotes a Forwarded parameter value when it is not a plain token
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
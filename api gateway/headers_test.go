@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      bool
+		remoteAddr string
+		tls        bool
+		sent       http.Header
+		want       http.Header
+	}{
+		{
+			name:       "plain request",
+			remoteAddr: "192.0.2.1:1234",
+			want: http.Header{
+				"Forwarded":         {"for=192.0.2.1;proto=http;host=example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			name:       "IPv6 client over TLS",
+			remoteAddr: "[2001:db8::1]:1234",
+			tls:        true,
+			want: http.Header{
+				"Forwarded":         {`for="[2001:db8::1]";proto=https;host=example.com`},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			name:       "spoofed headers from an untrusted client",
+			remoteAddr: "192.0.2.1:1234",
+			sent: http.Header{
+				"Forwarded":         {"for=10.0.0.1"},
+				"X-Forwarded-For":   {"10.0.0.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"admin.internal"},
+			},
+			want: http.Header{
+				"Forwarded":         {"for=192.0.2.1;proto=http;host=example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			name:       "headers from a trusted proxy",
+			trust:      true,
+			remoteAddr: "192.0.2.1:1234",
+			sent: http.Header{
+				"Forwarded":         {"for=198.51.100.7;proto=https"},
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"shop.example.com"},
+			},
+			want: http.Header{
+				"Forwarded":         {"for=198.51.100.7;proto=https, for=192.0.2.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"shop.example.com"},
+			},
+		},
+		{
+			name:       "trusted proxy that sent nothing",
+			trust:      true,
+			remoteAddr: "192.0.2.1:1234",
+			want: http.Header{
+				"Forwarded":         {"for=192.0.2.1;proto=http;host=example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/user/1", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		r.Header = tt.sent.Clone()
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		setForwardedHeaders(r, tt.trust)
+		if !reflect.DeepEqual(r.Header, tt.want) {
+			t.Errorf("%s: headers %v, want %v", tt.name, r.Header, tt.want)
+		}
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	p := HeaderPolicy{
+		Remove: []string{"Cookie", "x-debug-*"},
+		Rename: map[string]string{"X-User": "X-Auth-User"},
+		Set:    map[string]string{"X-Auth-User": "anonymous", "X-Gateway": "gw"},
+		Add:    map[string]string{"Via": "1.1 gateway"},
+	}
+	h := http.Header{
+		"Cookie":        {"session=1"},
+		"X-Debug-Trace": {"on"},
+		"X-Debug-Level": {"3"},
+		"X-Debugger":    {"kept"},
+		"X-User":        {"alice"},
+		"Via":           {"1.1 cdn"},
+	}
+	p.apply(h)
+
+	want := http.Header{
+		"X-Debugger":  {"kept"},
+		"X-Auth-User": {"anonymous"},
+		"X-Gateway":   {"gw"},
+		"Via":         {"1.1 cdn", "1.1 gateway"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers %v, want %v", h, want)
+	}
+}
+
+func TestGatewayHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Server", "nginx/1.25")
+		w.Header().Set("X-Powered-By", "PHP/8")
+		w.Header().Set("X-Internal-Node", "user-2")
+		w.Header().Set("X-Request-Cost", "3")
+	}))
+	defer backend.Close()
+
+	for _, trust := range []bool{false, true} {
+		g := testGateway(t, fmt.Sprintf(`{"trust_forwarded_headers": %v, "routes": [{"name": "user", "path_prefix": "/user/", "upstreams": [%q],
+			"headers": {"request": {"set": {"X-Gateway": "gw"}}, "response": {"remove": ["X-Request-Cost"]}}}]}`, trust, backend.URL))
+
+		r := httptest.NewRequest("GET", "http://example.com/user/1", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-For", "10.0.0.1")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("trust %v: %d %s", trust, w.Code, w.Body)
+		}
+
+		wantFor := "192.0.2.1"
+		if trust {
+			wantFor = "10.0.0.1, 192.0.2.1"
+		}
+		if xff := got.Get("X-Forwarded-For"); xff != wantFor {
+			t.Errorf("trust %v: upstream saw X-Forwarded-For %q, want %q", trust, xff, wantFor)
+		}
+		if got.Get("X-Gateway") != "gw" || got.Get("Forwarded") != "for=192.0.2.1;proto=http;host=example.com" {
+			t.Errorf("trust %v: upstream saw %v", trust, got)
+		}
+
+		// Internals are stripped by default, the route's policy strips the rest
+		for _, h := range []string{"Server", "X-Powered-By", "X-Internal-Node", "X-Request-Cost"} {
+			if v := w.Header().Get(h); v != "" {
+				t.Errorf("trust %v: client got %s: %s", trust, h, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig configures active probing of a route's upstream instances
+type HealthCheckConfig struct {
+	// Path is requested on every instance, e.g. "/user/health"
+	Path string `json:"path"`
+
+	// Interval is the time between probes of one instance
+	Interval Duration `json:"interval,omitempty"`
+
+	// Timeout bounds a single probe
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// HealthyThreshold is how many consecutive passing probes bring an instance back
+	HealthyThreshold int `json:"healthy_threshold,omitempty"`
+
+	// UnhealthyThreshold is how many consecutive failing probes take an instance out
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (hc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = Duration(10 * time.Second)
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = Duration(2 * time.Second)
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	return hc
+}
+
+// validate rejects settings that would make the checker misbehave
+func (hc HealthCheckConfig) validate() error {
+	if hc.Path != "" && hc.Path[0] != '/' {
+		return fmt.Errorf("health_check path %q must start with \"/\"", hc.Path)
+	}
+	if hc.Timeout > 0 && hc.Interval > 0 && hc.Timeout > hc.Interval {
+		return fmt.Errorf("health_check timeout %v is longer than interval %v", hc.Timeout, hc.Interval)
+	}
+	return nil
+}
+
+// healthState is the probe history of one upstream instance
+type healthState struct {
+	mu          sync.Mutex
+	successes   int
+	failures    int
+	lastChecked time.Time
+	lastError   string
+}
+
+// healthChecker probes every instance of one pool until its context is cancelled
+type healthChecker struct {
+	pool   *Pool
+	cfg    HealthCheckConfig
+	client *http.Client
+}
+
+// newHealthChecker returns a checker for the pool, or nil when checks are not configured
+func newHealthChecker(pool *Pool, cfg *HealthCheckConfig) *healthChecker {
+	if cfg == nil {
+		return nil
+	}
+	hc := cfg.withDefaults()
+	return &healthChecker{
+		pool:   pool,
+		cfg:    hc,
+		client: &http.Client{Timeout: time.Duration(hc.Timeout), Transport: newBaseTransport(TimeoutConfig{}, pool.tlsConfig)},
+	}
+}
+
+// run starts one probe loop per instance
+func (c *healthChecker) run(ctx context.Context) {
+	for _, u := range c.pool.Upstreams {
+		go c.probeLoop(ctx, u)
+	}
+}
+
+// probeLoop probes a single instance on every tick
+func (c *healthChecker) probeLoop(ctx context.Context, u *Upstream) {
+	ticker := time.NewTicker(time.Duration(c.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		c.probe(ctx, u)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends one health request and moves the instance in or out of rotation
+// once the configured number of consecutive results has been seen
+func (c *healthChecker) probe(ctx context.Context, u *Upstream) {
+	err := c.check(ctx, u)
+	if ctx.Err() != nil {
+		// The route table was replaced mid-probe; the result no longer matters
+		return
+	}
+
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastChecked = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		h.successes = 0
+		h.failures++
+		if u.Healthy() && h.failures >= c.cfg.UnhealthyThreshold {
+			u.healthy.Store(false)
+			log.Printf("💔 %s: upstream %s is unhealthy: %v", c.pool.Route, u.URL.Host, err)
+		}
+		return
+	}
+
+	h.lastError = ""
+	h.failures = 0
+	h.successes++
+	if !u.Healthy() && h.successes >= c.cfg.HealthyThreshold {
+		u.healthy.Store(true)
+		log.Printf("💚 %s: upstream %s is healthy again", c.pool.Route, u.URL.Host)
+	}
+}
+
+// inheritHealth takes over the probe history of the same instance in the previous table
+func (u *Upstream) inheritHealth(old *Upstream) {
+	old.health.mu.Lock()
+	successes, failures := old.health.successes, old.health.failures
+	checked, lastError := old.health.lastChecked, old.health.lastError
+	old.health.mu.Unlock()
+
+	u.health.mu.Lock()
+	u.health.successes, u.health.failures = successes, failures
+	u.health.lastChecked, u.health.lastError = checked, lastError
+	u.health.mu.Unlock()
+	u.healthy.Store(old.Healthy())
+}
+
+// check performs the HTTP probe; any 2xx or 3xx answer counts as healthy
+func (c *healthChecker) check(ctx context.Context, u *Upstream) error {
+	target := *u.URL
+	target.Path = singleJoiningSlash(u.URL.Path, c.cfg.Path)
+	target.RawPath = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "api-gateway-health-check")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ==================== AGGREGATE HEALTH ENDPOINT ====================
+
+// upstreamHealth is the health of one instance as reported by /gateway/health
+type upstreamHealth struct {
+	URL         string     `json:"url"`
+	Healthy     bool       `json:"healthy"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// routeHealth is the health of one route as reported by /gateway/health
+type routeHealth struct {
+	Route     string           `json:"route"`
+	Checked   bool             `json:"checked"`
+	Healthy   int              `json:"healthy"`
+	Total     int              `json:"total"`
+	Upstreams []upstreamHealth `json:"upstreams"`
+}
+
+// healthHandler serves the admin API's GET /gateway/health: the overall
+// status with every route and instance, including upstream addresses and
+// probe errors
+func (g *Gateway) healthHandler(w http.ResponseWriter, r *http.Request) {
+	code, status, routes := g.health()
+	doc := map[string]interface{}{"status": status}
+	if routes != nil {
+		doc["routes"] = routes
+	}
+	writeJSON(w, code, doc)
+}
+
+// publicHealthHandler serves GET /gateway/health on the client listener, for
+// load balancer probes. Clients only learn the overall status; the details
+// name internal hosts and errors and stay on the admin listener.
+func (g *Gateway) publicHealthHandler(w http.ResponseWriter, r *http.Request) {
+	code, status, _ := g.health()
+	writeJSON(w, code, map[string]interface{}{"status": status})
+}
+
+// health checks every route. The code is 200 when every route has at least
+// one healthy instance, and 503 otherwise or once the gateway is shutting down.
+func (g *Gateway) health() (code int, status string, routes []routeHealth) {
+	// A gateway on its way out is not ready, whatever its upstreams say
+	if g.stopping.Load() {
+		return http.StatusServiceUnavailable, "shutting_down", nil
+	}
+
+	status = "ok"
+	code = http.StatusOK
+
+	for _, p := range g.table.Load().pools {
+		rh := routeHealth{Route: p.Route, Checked: p.checker != nil, Total: len(p.Upstreams)}
+		for _, u := range p.Upstreams {
+			uh := upstreamHealth{URL: u.URL.String(), Healthy: u.Healthy()}
+
+			u.health.mu.Lock()
+			if !u.health.lastChecked.IsZero() {
+				checked := u.health.lastChecked
+				uh.LastChecked = &checked
+			}
+			uh.LastError = u.health.lastError
+			u.health.mu.Unlock()
+
+			if uh.Healthy {
+				rh.Healthy++
+			}
+			rh.Upstreams = append(rh.Upstreams, uh)
+		}
+
+		switch {
+		case rh.Healthy == 0:
+			status = "down"
+			code = http.StatusServiceUnavailable
+		case rh.Healthy < rh.Total && status == "ok":
+			status = "degraded"
+		}
+		routes = append(routes, rh)
+	}
+	return code, status, routes
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthTransitions(t *testing.T) {
+	var status atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			t.Errorf("probe sent to %s", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+
+	pool := &Pool{Route: "user", Upstreams: testUpstreams(1)}
+	u := pool.Upstreams[0]
+	u.URL, _ = url.Parse(backend.URL)
+	c := newHealthChecker(pool, &HealthCheckConfig{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 3})
+
+	steps := []struct {
+		status  int32
+		healthy bool
+	}{
+		{503, true},
+		{503, true},
+		{200, true}, // a pass resets the failure count
+		{503, true},
+		{404, true},
+		{500, false}, // third failure in a row
+		{200, false},
+		{503, false}, // a failure resets the pass count
+		{200, false},
+		{204, true}, // second pass in a row
+	}
+	for i, step := range steps {
+		status.Store(step.status)
+		c.probe(context.Background(), u)
+		if u.Healthy() != step.healthy {
+			t.Fatalf("probe %d (%d): healthy %v, want %v", i+1, step.status, u.Healthy(), step.healthy)
+		}
+	}
+	if u.health.lastError != "" || u.health.lastChecked.IsZero() {
+		t.Errorf("after a pass: last error %q, last checked %v", u.health.lastError, u.health.lastChecked)
+	}
+
+	// A probe cut short by a reload does not count
+	status.Store(503)
+	for i := 0; i < 3; i++ {
+		c.probe(context.Background(), u)
+	}
+	if u.Healthy() || u.health.lastError != "health check returned 503 Service Unavailable" {
+		t.Fatalf("after failures: healthy %v, last error %q", u.Healthy(), u.health.lastError)
+	}
+	status.Store(200)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		c.probe(cancelled, u)
+	}
+	if u.Healthy() || u.health.successes != 0 {
+		t.Errorf("cancelled probes counted: healthy %v, %d passes", u.Healthy(), u.health.successes)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	g := testGateway(t, `{"routes": [
+		{"name": "user", "path_prefix": "/user/", "upstreams": ["http://10.0.0.1:8001", "http://10.0.0.2:8001"]},
+		{"name": "payment", "path_prefix": "/payment/", "upstreams": ["http://10.0.0.3:8002"]}]}`)
+	pools := g.table.Load().pools
+	user, payment := pools[0].Upstreams, pools[1].Upstreams
+
+	tests := []struct {
+		name       string
+		down       []*Upstream
+		stopping   bool
+		wantCode   int
+		wantStatus string
+	}{
+		{"every instance up", nil, false, http.StatusOK, "ok"},
+		{"one instance of a route down", []*Upstream{user[0]}, false, http.StatusOK, "degraded"},
+		{"every instance of a route down", []*Upstream{payment[0]}, false, http.StatusServiceUnavailable, "down"},
+		{"shutting down", nil, true, http.StatusServiceUnavailable, "shutting_down"},
+	}
+	for _, tt := range tests {
+		for _, u := range append(user, payment...) {
+			u.healthy.Store(true)
+		}
+		for _, u := range tt.down {
+			u.healthy.Store(false)
+		}
+		g.stopping.Store(tt.stopping)
+
+		handlers := []struct {
+			name       string
+			h          http.HandlerFunc
+			wantRoutes int
+		}{
+			{"admin", g.healthHandler, 2},
+			{"public", g.publicHealthHandler, 0},
+		}
+		for _, hh := range handlers {
+			w := httptest.NewRecorder()
+			hh.h(w, httptest.NewRequest("GET", "/gateway/health", nil))
+			var doc struct {
+				Status string
+				Routes []routeHealth
+			}
+			json.NewDecoder(w.Body).Decode(&doc)
+			if w.Code != tt.wantCode || doc.Status != tt.wantStatus {
+				t.Errorf("%s, %s: %d %q, want %d %q", tt.name, hh.name, w.Code, doc.Status, tt.wantCode, tt.wantStatus)
+			}
+
+			// Instance details stay on the admin listener
+			if tt.stopping {
+				continue
+			}
+			if len(doc.Routes) != hh.wantRoutes {
+				t.Errorf("%s, %s: routes %+v", tt.name, hh.name, doc.Routes)
+			} else if hh.wantRoutes > 0 && doc.Routes[0].Healthy+doc.Routes[1].Healthy != 3-len(tt.down) {
+				t.Errorf("%s, %s: routes %+v", tt.name, hh.name, doc.Routes)
+			}
+		}
+	}
+}
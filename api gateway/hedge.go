@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sizes of the latency history a hedge percentile is computed from
+const (
+	hedgeSamples    = 256 // the percentile comes from the route's most recent answers
+	hedgeMinSamples = 20  // below this, only the fixed delay applies
+)
+
+// HedgeConfig sends a second copy of a slow read request to another instance
+// and uses whichever answer comes back first, cutting the tail latency a
+// single slow instance causes. Only idempotent requests without a body are
+// hedged, and hedges draw on a budget so the extra load stays bounded.
+type HedgeConfig struct {
+	// Delay is how long the first attempt gets before the hedge is sent. With
+	// Percentile set it is the least the first attempt is given.
+	Delay Duration `json:"delay,omitempty"`
+
+	// Percentile sends the hedge once the first attempt has taken longer than
+	// this percentile of the route's recent answers, e.g. 95
+	Percentile float64 `json:"percentile,omitempty"`
+
+	// Budget bounds the hedges sent: every hedgeable request earns Ratio of a
+	// hedge (default 0.1), on top of MinPerSecond always allowed (default 1)
+	Budget RetryBudgetConfig `json:"budget"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c HedgeConfig) withDefaults() HedgeConfig {
+	if c.Budget.Ratio == 0 {
+		c.Budget.Ratio = 0.1
+	}
+	if c.Budget.MinPerSecond == 0 {
+		c.Budget.MinPerSecond = 1
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c HedgeConfig) validate() error {
+	if c.Delay < 0 {
+		return errors.New("hedge delay must not be negative")
+	}
+	if c.Percentile < 0 || c.Percentile >= 100 {
+		return errors.New("hedge percentile must be above 0 and below 100")
+	}
+	if c.Delay == 0 && c.Percentile == 0 {
+		return errors.New("hedge needs a delay or a percentile")
+	}
+	if c.Budget.Ratio < 0 || c.Budget.MinPerSecond < 0 {
+		return errors.New("hedge budget must not be negative")
+	}
+	return nil
+}
+
+// hedger is a route's HedgeConfig prepared for use on the request path, with
+// the latency history its percentile is taken from
+type hedger struct {
+	cfg    HedgeConfig
+	budget *retryBudget
+
+	mu        sync.Mutex
+	latencies [hedgeSamples]time.Duration
+	samples   int
+	threshold time.Duration
+	computed  time.Time
+
+	sent      atomic.Int64
+	won       atomic.Int64
+	exhausted atomic.Int64
+}
+
+// newHedger returns the route's hedger, or nil when hedging is not configured
+func newHedger(cfg *HedgeConfig) *hedger {
+	if cfg == nil {
+		return nil
+	}
+	c := cfg.withDefaults()
+	return &hedger{cfg: c, budget: newRetryBudget(c.Budget)}
+}
+
+// applies reports whether the request may be hedged: it must be safe to send
+// twice, have no body to replay, and not open a stream
+func (h *hedger) applies(req *http.Request) bool {
+	if h == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return streamKind(req) == ""
+}
+
+// delay returns how long the first attempt gets before the hedge is sent;
+// ok is false while a percentile-only route has too few answers to go on
+func (h *hedger) delay() (d time.Duration, ok bool) {
+	d = time.Duration(h.cfg.Delay)
+	if h.cfg.Percentile == 0 {
+		return d, true
+	}
+	p, ok := h.percentile()
+	if !ok {
+		return d, d > 0
+	}
+	return max(d, p), true
+}
+
+// percentile returns the configured percentile of recent answer times. It is
+// recomputed at most once a second so hot routes do not sort on every request.
+func (h *hedger) percentile() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := min(h.samples, hedgeSamples)
+	if n < hedgeMinSamples {
+		return 0, false
+	}
+	if now := time.Now(); now.Sub(h.computed) >= time.Second {
+		recent := make([]time.Duration, n)
+		copy(recent, h.latencies[:n])
+		sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+		h.threshold = recent[int(h.cfg.Percentile/100*float64(n-1))]
+		h.computed = now
+	}
+	return h.threshold, true
+}
+
+// record adds the time an attempt took to answer to the latency history
+func (h *hedger) record(elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latencies[h.samples%hedgeSamples] = elapsed
+	h.samples++
+}
+
+// inherit carries the latency history, counters and budget of the route's
+// previous hedger over a reload
+func (h *hedger) inherit(old *hedger) {
+	if h == nil || old == nil {
+		return
+	}
+	h.sent.Store(old.sent.Load())
+	h.won.Store(old.won.Load())
+	h.exhausted.Store(old.exhausted.Load())
+	h.budget.inherit(old.budget)
+
+	old.mu.Lock()
+	latencies, samples := old.latencies, old.samples
+	old.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latencies, h.samples = latencies, samples
+}
+
+// hedgeStatus is the admin view of a route's hedging
+type hedgeStatus struct {
+	DelayMs         float64 `json:"delay_ms"`
+	Sent            int64   `json:"sent"`
+	Won             int64   `json:"won"`
+	BudgetExhausted int64   `json:"budget_exhausted"`
+}
+
+// status returns the current hedge delay and the counters
+func (h *hedger) status() *hedgeStatus {
+	if h == nil {
+		return nil
+	}
+	out := &hedgeStatus{Sent: h.sent.Load(), Won: h.won.Load(), BudgetExhausted: h.exhausted.Load()}
+	if d, ok := h.delay(); ok {
+		out.DelayMs = float64(d) / float64(time.Millisecond)
+	}
+	return out
+}
+
+// ==================== HEDGED ATTEMPTS ====================
+
+// hedgeResult is the outcome of one of a hedged request's attempts
+type hedgeResult struct {
+	n       int
+	resp    *http.Response
+	err     error
+	elapsed time.Duration
+}
+
+// usable reports whether the attempt got an answer worth handing to the client
+func (r hedgeResult) usable() bool {
+	return r.err == nil && r.resp.StatusCode < 500
+}
+
+// hedged sends the request to one instance and, when no answer has come back
+// by the hedge delay and the budget allows, to a second one as well. The
+// first usable answer wins and the other attempt is cancelled; when both
+// fail, the last failure is returned so the retry policy can judge it.
+func (t *upstreamTransport) hedged(req *http.Request, tried map[*Upstream]bool) (*http.Response, error) {
+	h := t.pool.hedge
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	first, err := t.pool.Pick(req, tried)
+	if err != nil {
+		return nil, err
+	}
+	if tried == nil {
+		tried = make(map[*Upstream]bool)
+	}
+	tried[first] = true
+	h.budget.deposit()
+
+	// Every attempt gets its own context, so the loser can be cancelled alone
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func(up *Upstream) {
+		ctx, cancel := context.WithCancel(req.Context())
+		n := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			resp, err := t.sendTo(req.WithContext(ctx), up)
+			results <- hedgeResult{n: n, resp: resp, err: err, elapsed: time.Since(start)}
+		}()
+	}
+	launch(first)
+	start := time.Now()
+
+	var timeout <-chan time.Time
+	if d, ok := h.delay(); ok {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	pending := 1
+	for {
+		select {
+		case <-timeout:
+			timeout = nil
+			second, err := t.pool.Pick(req, tried)
+			if err != nil || tried[second] {
+				// No other instance can take the request; the first attempt carries on alone
+				continue
+			}
+			if !h.budget.withdraw() {
+				h.exhausted.Add(1)
+				log.Printf("🏁 Hedge budget exhausted, not hedging %s %s", req.Method, req.URL.Path)
+				continue
+			}
+			tried[second] = true
+			h.sent.Add(1)
+			log.Printf("🏁 Hedging %s %s: no answer from %s after %v, also sending to %s", req.Method, req.URL.Path, first.URL.Host, time.Since(start).Round(time.Millisecond), second.URL.Host)
+			launch(second)
+			pending++
+
+		case res := <-results:
+			pending--
+			if !res.usable() && pending > 0 {
+				// The other attempt may still do better
+				cancels[res.n]()
+				if res.resp != nil {
+					res.resp.Body.Close()
+				}
+				continue
+			}
+
+			// Cancel the attempt still running and throw away its answer when it comes
+			for n, cancel := range cancels {
+				if n != res.n {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if lost := <-results; lost.resp != nil {
+						lost.resp.Body.Close()
+					}
+				}
+			}(pending)
+
+			if res.err != nil {
+				cancels[res.n]()
+				return nil, res.err
+			}
+			if res.usable() {
+				h.record(res.elapsed)
+				if res.n > 0 {
+					h.won.Add(1)
+				}
+			}
+
+			// The winner's context lives until the proxy has finished copying its body
+			res.resp.Body = trackBody(res.resp.Body, cancels[res.n])
+			return res.resp, nil
+		}
+	}
+}
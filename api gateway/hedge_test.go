@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend is an upstream instance that answers after a delay
+type testBackend struct {
+	name      string
+	delay     time.Duration
+	status    int
+	cancelled atomic.Int64
+}
+
+func (b *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(b.delay):
+	case <-r.Context().Done():
+		b.cancelled.Add(1)
+		return
+	}
+	w.WriteHeader(b.status)
+	io.WriteString(w, b.name)
+}
+
+func TestHedgedWinner(t *testing.T) {
+	const fast, slow = 0, 500 * time.Millisecond
+	tests := []struct {
+		name            string
+		method          string
+		first, second   *testBackend
+		budget          RetryBudgetConfig
+		wantStatus      int
+		wantBody        string
+		wantSent        int64
+		wantWon         int64
+		wantExhausted   int64
+		wantFirstCancel bool
+	}{
+		{
+			name:       "first answers before the hedge delay",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: fast, status: 200},
+			second:     &testBackend{name: "second", delay: fast, status: 200},
+			wantStatus: 200, wantBody: "first",
+		},
+		{
+			name:       "hedge beats a slow first attempt",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: slow, status: 200},
+			second:     &testBackend{name: "second", delay: fast, status: 200},
+			wantStatus: 200, wantBody: "second", wantSent: 1, wantWon: 1, wantFirstCancel: true,
+		},
+		{
+			name:       "first attempt still wins when the hedge is slower",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: 100 * time.Millisecond, status: 200},
+			second:     &testBackend{name: "second", delay: slow, status: 200},
+			wantStatus: 200, wantBody: "first", wantSent: 1,
+		},
+		{
+			name:       "a failed answer waits for the other attempt",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: 100 * time.Millisecond, status: 503},
+			second:     &testBackend{name: "second", delay: 200 * time.Millisecond, status: 200},
+			wantStatus: 200, wantBody: "second", wantSent: 1, wantWon: 1,
+		},
+		{
+			name:       "both failing returns the last failure",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: 100 * time.Millisecond, status: 503},
+			second:     &testBackend{name: "second", delay: 200 * time.Millisecond, status: 502},
+			wantStatus: 502, wantBody: "second", wantSent: 1,
+		},
+		{
+			name:       "a quick failure is not hedged",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: fast, status: 503},
+			second:     &testBackend{name: "second", delay: fast, status: 200},
+			wantStatus: 503, wantBody: "first",
+		},
+		{
+			name:       "no hedge once the budget is spent",
+			method:     http.MethodGet,
+			first:      &testBackend{name: "first", delay: 100 * time.Millisecond, status: 200},
+			second:     &testBackend{name: "second", delay: fast, status: 200},
+			budget:     RetryBudgetConfig{Ratio: 0.01, MinPerSecond: 0.5},
+			wantStatus: 200, wantBody: "first", wantExhausted: 1,
+		},
+		{
+			name:       "requests that are not safe to repeat are never hedged",
+			method:     http.MethodPost,
+			first:      &testBackend{name: "first", delay: 100 * time.Millisecond, status: 200},
+			second:     &testBackend{name: "second", delay: fast, status: 200},
+			wantStatus: 200, wantBody: "first",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := httptest.NewServer(tt.first)
+			defer first.Close()
+			second := httptest.NewServer(tt.second)
+			defer second.Close()
+
+			p, err := newPool(RouteConfig{
+				Name:      "user",
+				Upstreams: []UpstreamConfig{{URL: first.URL, Weight: 1}, {URL: second.URL, Weight: 1}},
+				Hedge:     &HedgeConfig{Delay: Duration(30 * time.Millisecond), Budget: tt.budget},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := &upstreamTransport{pool: p, base: http.DefaultTransport}
+
+			req := httptest.NewRequest(tt.method, "/user/1", nil)
+			req.RequestURI = ""
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+				t.Errorf("answer %d %q, want %d %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			st := p.hedge.status()
+			if st.Sent != tt.wantSent || st.Won != tt.wantWon || st.BudgetExhausted != tt.wantExhausted {
+				t.Errorf("sent %d, won %d, exhausted %d, want %d, %d, %d",
+					st.Sent, st.Won, st.BudgetExhausted, tt.wantSent, tt.wantWon, tt.wantExhausted)
+			}
+
+			// The losing attempt is cancelled rather than left running
+			if tt.wantFirstCancel {
+				deadline := time.Now().Add(time.Second)
+				for tt.first.cancelled.Load() == 0 && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				if tt.first.cancelled.Load() == 0 {
+					t.Error("losing attempt was not cancelled")
+				}
+			}
+			for _, up := range p.Upstreams {
+				deadline := time.Now().Add(time.Second)
+				for up.InFlight() != 0 && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				if n := up.InFlight(); n != 0 {
+					t.Errorf("%s still has %d requests in flight", up.URL.Host, n)
+				}
+			}
+		})
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HedgeConfig
+		samples int
+		want    time.Duration
+		ok      bool
+	}{
+		{"fixed delay", HedgeConfig{Delay: Duration(50 * time.Millisecond)}, 0, 50 * time.Millisecond, true},
+		{"percentile without enough samples", HedgeConfig{Percentile: 95}, hedgeMinSamples - 1, 0, false},
+		{"fixed delay until there are samples", HedgeConfig{Delay: Duration(20 * time.Millisecond), Percentile: 95}, 5, 20 * time.Millisecond, true},
+		{"percentile of recent answers", HedgeConfig{Percentile: 95}, 100, 95 * time.Millisecond, true},
+		{"percentile above the floor", HedgeConfig{Delay: Duration(20 * time.Millisecond), Percentile: 50}, 100, 50 * time.Millisecond, true},
+		{"floor above the percentile", HedgeConfig{Delay: Duration(80 * time.Millisecond), Percentile: 50}, 100, 80 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		h := newHedger(&tt.cfg)
+		for i := 1; i <= tt.samples; i++ {
+			h.record(time.Duration(i) * time.Millisecond)
+		}
+		d, ok := h.delay()
+		if ok != tt.ok || (ok && d != tt.want) {
+			t.Errorf("%s: delay %v, %v, want %v, %v", tt.name, d, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHedgeConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg   HedgeConfig
+		valid bool
+	}{
+		{HedgeConfig{Delay: Duration(time.Millisecond)}, true},
+		{HedgeConfig{Percentile: 99}, true},
+		{HedgeConfig{}, false},
+		{HedgeConfig{Delay: Duration(-time.Millisecond)}, false},
+		{HedgeConfig{Percentile: 100}, false},
+		{HedgeConfig{Delay: Duration(time.Millisecond), Budget: RetryBudgetConfig{Ratio: -1}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: error %v, want valid %v", tt.cfg, err, tt.valid)
+		}
+	}
+}
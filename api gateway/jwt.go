@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity headers the gateway forwards upstream after verifying a token.
+// Clients can never set these themselves; they are stripped on every route.
+const (
+	userIDHeader    = "X-User-ID"
+	userRolesHeader = "X-User-Roles"
+	userScopeHeader = "X-User-Scopes"
+)
+
+// Route auth modes
+const (
+	AuthPublic   = "public"
+	AuthRequired = "required"
+)
+
+// JWTConfig tells the gateway how to verify bearer tokens
+type JWTConfig struct {
+	// JWKSURL is where the auth service publishes its signing keys
+	JWKSURL string `json:"jwks_url"`
+
+	// Issuer and Audience, when set, must match the token's iss and aud claims
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+
+	// RefreshInterval is how often the key set is fetched again
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+
+	// Leeway tolerates small clock differences when checking exp and nbf
+	Leeway Duration `json:"leeway,omitempty"`
+}
+
+// validate rejects a JWT config the verifier could not use
+func (c *JWTConfig) validate() error {
+	if c.JWKSURL == "" {
+		return errors.New("jwt jwks_url is required")
+	}
+	if _, err := parseUpstream(c.JWKSURL); err != nil {
+		return fmt.Errorf("jwt jwks_url: %w", err)
+	}
+	return nil
+}
+
+// Claims are the parts of a verified token the gateway cares about
+type Claims struct {
+	Subject string
+	Roles   []string
+	Scopes  []string
+}
+
+// ==================== KEY SET ====================
+
+// jwk is one key of a JSON Web Key Set (RFC 7517); only RSA and EC keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key material
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// keySet caches the auth service's published keys and refreshes them in the background
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+
+	// lastRefresh is when the last fetch started, successful or not
+	lastRefresh time.Time
+
+	// forcing lets one refresh for an unknown kid run at a time; requests
+	// that waited behind it look at the keys it fetched instead of fetching again
+	forcing sync.Mutex
+}
+
+// minForcedRefresh limits how often an unknown kid can trigger a refetch,
+// so junk tokens cannot be used to hammer the auth service
+const minForcedRefresh = 30 * time.Second
+
+// refresh fetches the key set and replaces the cached keys
+func (ks *keySet) refresh(ctx context.Context) error {
+	// Stamped before fetching so a slow or failing auth service is not asked again straight away
+	ks.mu.Lock()
+	ks.lastRefresh = time.Now()
+	ks.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", ks.url, resp.Status)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("decoding %s: %w", ks.url, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("⚠️ Skipping key %q from %s: %v", k.Kid, ks.url, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+
+	log.Printf("🔑 Loaded %d signing keys from %s", len(keys), ks.url)
+	return nil
+}
+
+// key returns the key with the given ID, refetching the set once if it is
+// unknown, which is how a rotated-in key gets picked up early
+func (ks *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if k, ok, _ := ks.lookup(kid); ok {
+		return k, nil
+	}
+
+	// A burst of tokens with the same unknown kid shares a single fetch
+	ks.forcing.Lock()
+	defer ks.forcing.Unlock()
+
+	k, ok, stale := ks.lookup(kid)
+	if ok {
+		return k, nil
+	}
+	if stale {
+		if err := ks.refresh(ctx); err != nil {
+			log.Printf("❌ Refreshing signing keys: %v", err)
+		}
+		if k, ok, _ = ks.lookup(kid); ok {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup returns the cached key with the given ID, and whether the set is
+// old enough that an unknown kid may force a refresh
+func (ks *keySet) lookup(kid string) (k crypto.PublicKey, ok, stale bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k, ok = ks.keys[kid]
+	return k, ok, time.Since(ks.lastRefresh) > minForcedRefresh
+}
+
+// inherit starts the key set off with the keys the previous table fetched
+// from the same URL, so tokens keep verifying while the first fetch runs
+func (ks *keySet) inherit(old *keySet) {
+	if old.url != ks.url {
+		return
+	}
+	old.mu.RLock()
+	keys, lastRefresh := old.keys, old.lastRefresh
+	old.mu.RUnlock()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys, ks.lastRefresh = keys, lastRefresh
+}
+
+// run refreshes the key set on an interval until ctx is cancelled
+func (ks *keySet) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := ks.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("❌ Refreshing signing keys: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ==================== VERIFIER ====================
+
+// jwtVerifier checks bearer tokens against the cached key set
+type jwtVerifier struct {
+	cfg      JWTConfig
+	keys     *keySet
+	interval time.Duration
+}
+
+// newJWTVerifier returns a verifier, or nil when the config has no jwt section
+func newJWTVerifier(cfg *JWTConfig) *jwtVerifier {
+	if cfg == nil {
+		return nil
+	}
+
+	interval := time.Duration(cfg.RefreshInterval)
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	return &jwtVerifier{
+		cfg:      *cfg,
+		interval: interval,
+		keys: &keySet{
+			url:    cfg.JWKSURL,
+			client: &http.Client{Timeout: 5 * time.Second},
+			keys:   make(map[string]crypto.PublicKey),
+		},
+	}
+}
+
+// verify checks the token's signature and registered claims and returns its identity
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// The algorithm must agree with the key type; never trust alg on its own
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("algorithm %q does not match RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("algorithm %q does not match EC key", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+
+	var claims struct {
+		Sub   string          `json:"sub"`
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   *int64          `json:"exp"`
+		Nbf   *int64          `json:"nbf"`
+		Roles []string        `json:"roles"`
+		Scope string          `json:"scope"`
+		Scp   []string        `json:"scp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+
+	now := time.Now()
+	leeway := time.Duration(v.cfg.Leeway)
+	switch {
+	case claims.Exp == nil:
+		return nil, errors.New("token has no expiry")
+	case now.After(time.Unix(*claims.Exp, 0).Add(leeway)):
+		return nil, errors.New("token expired")
+	case claims.Nbf != nil && now.Add(leeway).Before(time.Unix(*claims.Nbf, 0)):
+		return nil, errors.New("token not valid yet")
+	case v.cfg.Issuer != "" && claims.Iss != v.cfg.Issuer:
+		return nil, errors.New("wrong issuer")
+	case v.cfg.Audience != "" && !hasAudience(claims.Aud, v.cfg.Audience):
+		return nil, errors.New("wrong audience")
+	case claims.Sub == "":
+		return nil, errors.New("token has no subject")
+	}
+
+	scopes := claims.Scp
+	if claims.Scope != "" {
+		scopes = strings.Fields(claims.Scope)
+	}
+	return &Claims{Subject: claims.Sub, Roles: claims.Roles, Scopes: scopes}, nil
+}
+
+// decodeSegment base64url-decodes one token segment into v
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hasAudience checks an aud claim, which may be a single string or a list
+func hasAudience(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, a := range many {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ==================== ROUTE MIDDLEWARE ====================
+
+// withAuth enforces a route's auth mode. Identity headers from the client are
+// always removed; on protected routes they are replaced with the verified claims.
+func withAuth(route string, mode string, scopes []string, v *jwtVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{userIDHeader, userRolesHeader, userScopeHeader} {
+			r.Header.Del(h)
+		}
+
+		if mode != AuthRequired {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			authError(w, r, route, http.StatusUnauthorized, `Bearer`, "missing bearer token")
+			return
+		}
+
+		claims, err := v.verify(r.Context(), token)
+		if err != nil {
+			authError(w, r, route, http.StatusUnauthorized, `Bearer error="invalid_token"`, err.Error())
+			return
+		}
+
+		if missing := missingScopes(claims.Scopes, scopes); len(missing) > 0 {
+			challenge := fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " "))
+			authError(w, r, route, http.StatusForbidden, challenge, "missing scope: "+strings.Join(missing, " "))
+			return
+		}
+
+		r.Header.Set(userIDHeader, claims.Subject)
+		if len(claims.Roles) > 0 {
+			r.Header.Set(userRolesHeader, strings.Join(claims.Roles, ","))
+		}
+		if len(claims.Scopes) > 0 {
+			r.Header.Set(userScopeHeader, strings.Join(claims.Scopes, " "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// missingScopes returns the required scopes the token does not carry
+func missingScopes(have, want []string) []string {
+	var missing []string
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, w)
+		}
+	}
+	return missing
+}
+
+// bearerToken returns the credentials of a Bearer Authorization header. The
+// scheme name is case-insensitive (RFC 7235), so "bearer x" is accepted too.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	return token, strings.EqualFold(scheme, "Bearer") && token != ""
+}
+
+// authError rejects a request at the edge with the gateway's JSON error document
+func authError(w http.ResponseWriter, r *http.Request, route string, status int, challenge, msg string) {
+	class := "unauthorized"
+	if status == http.StatusForbidden {
+		class = "forbidden"
+	}
+	log.Printf("🚫 %s [%s] %s %s: %s", route, requestID(r), r.Method, r.URL.Path, msg)
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeJSON(w, status, errorDocument{
+		Error:     class,
+		Message:   msg,
+		Status:    status,
+		Route:     route,
+		RequestID: requestID(r),
+	})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer signs tokens and publishes its keys the way the auth service does
+type testIssuer struct {
+	mu      sync.Mutex
+	rsa     map[string]*rsa.PrivateKey
+	ec      map[string]*ecdsa.PrivateKey
+	fetches atomic.Int64
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{rsa: make(map[string]*rsa.PrivateKey), ec: make(map[string]*ecdsa.PrivateKey)}
+	iss.addRSA(t, "rsa1")
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.ec["ec1"] = ec
+	return iss
+}
+
+// addRSA rotates in a new RSA key
+func (iss *testIssuer) addRSA(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.rsa[kid] = key
+}
+
+// ServeHTTP publishes the JWKS
+func (iss *testIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iss.fetches.Add(1)
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var keys []jwk
+	for kid, k := range iss.rsa {
+		keys = append(keys, jwk{Kty: "RSA", Kid: kid, Use: "sig", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())})
+	}
+	for kid, k := range iss.ec {
+		keys = append(keys, jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: b64(k.X.FillBytes(make([]byte, 32))), Y: b64(k.Y.FillBytes(make([]byte, 32)))})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// sign returns a token with the given header alg and claims, signed by the
+// key kid names (or by signer, when set, to forge a signature)
+func (iss *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}, signer crypto.Signer) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	body, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+
+	iss.mu.Lock()
+	if signer == nil {
+		if k, ok := iss.rsa[kid]; ok {
+			signer = k
+		} else if k, ok := iss.ec[kid]; ok {
+			signer = k
+		}
+	}
+	iss.mu.Unlock()
+
+	var sig []byte
+	switch k := signer.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claims returns a valid claim set with the given overrides; a nil value removes the claim
+func claims(overrides map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"sub":   "alice",
+		"iss":   "auth-service",
+		"aud":   "api-gateway",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{"user"},
+		"scope": "user:read payment:read",
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func TestJWTVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	srv := httptest.NewServer(iss)
+	defer srv.Close()
+
+	v := newJWTVerifier(&JWTConfig{JWKSURL: srv.URL, Issuer: "auth-service", Audience: "api-gateway", Leeway: Duration(30 * time.Second)})
+	if err := v.keys.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"RS256", iss.sign(t, "RS256", "rsa1", claims(nil), nil), ""},
+		{"ES256", iss.sign(t, "ES256", "ec1", claims(nil), nil), ""},
+		{"alg none", iss.sign(t, "none", "rsa1", claims(nil), nil), `algorithm "none" does not match RSA key`},
+		{"HS256 against an RSA key", iss.sign(t, "HS256", "rsa1", claims(nil), nil), "does not match RSA key"},
+		{"RS256 header on an EC key", iss.sign(t, "RS256", "ec1", claims(nil), nil), "does not match EC key"},
+		{"ES256 header on an RSA key", iss.sign(t, "ES256", "rsa1", claims(nil), nil), "does not match RSA key"},
+		{"signed by another key", iss.sign(t, "RS256", "rsa1", claims(nil), other), "invalid signature"},
+		{"unknown kid", iss.sign(t, "RS256", "rsa9", claims(nil), other), `unknown signing key "rsa9"`},
+		{"malformed", "not-a-token", "malformed token"},
+		{"expired", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}), nil), "token expired"},
+		{"expired within leeway", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}), nil), ""},
+		{"no expiry", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": nil}), nil), "token has no expiry"},
+		{"not valid yet", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}), nil), "token not valid yet"},
+		{"nbf within leeway", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"nbf": now.Add(10 * time.Second).Unix()}), nil), ""},
+		{"wrong issuer", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"iss": "someone"}), nil), "wrong issuer"},
+		{"wrong audience", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"aud": "billing"}), nil), "wrong audience"},
+		{"audience list", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"aud": []string{"billing", "api-gateway"}}), nil), ""},
+		{"no subject", iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"sub": nil}), nil), "token has no subject"},
+	}
+	for _, tt := range tests {
+		got, err := v.verify(context.Background(), tt.token)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr == "" && got.Subject != "alice":
+			t.Errorf("%s: subject %q, want alice", tt.name, got.Subject)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Scopes come from scope, or from scp when there is no scope claim
+	c, err := v.verify(context.Background(), iss.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"scope": nil, "scp": []string{"a", "b"}}), nil))
+	if err != nil || strings.Join(c.Scopes, " ") != "a b" {
+		t.Fatalf("scp claim: scopes %v, error %v", c, err)
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	srv := httptest.NewServer(iss)
+	defer srv.Close()
+	v := newJWTVerifier(&JWTConfig{JWKSURL: srv.URL})
+	ctx := context.Background()
+
+	// An empty set fetches on first use
+	if _, err := v.verify(ctx, iss.sign(t, "RS256", "rsa1", claims(nil), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches after first use, want 1", n)
+	}
+
+	// A key rotated in right after a fetch waits for the refresh limit
+	iss.addRSA(t, "rsa2")
+	rotated := iss.sign(t, "RS256", "rsa2", claims(nil), nil)
+	if _, err := v.verify(ctx, rotated); err == nil {
+		t.Fatal("new kid verified without a fetch")
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches, want the unknown kid held back by the refresh limit", n)
+	}
+
+	// Once the limit has passed, the unknown kid forces one fetch
+	age := func() {
+		v.keys.mu.Lock()
+		v.keys.lastRefresh = time.Now().Add(-2 * minForcedRefresh)
+		v.keys.mu.Unlock()
+	}
+	age()
+	if _, err := v.verify(ctx, rotated); err != nil {
+		t.Fatalf("rotated key after the limit: %v", err)
+	}
+	if n := iss.fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+
+	// A burst of tokens with a kid nobody publishes shares one fetch
+	age()
+	ghost := iss.sign(t, "RS256", "ghost", claims(nil), iss.rsa["rsa1"])
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.verify(ctx, ghost)
+		}()
+	}
+	wg.Wait()
+	if n := iss.fetches.Load(); n != 3 {
+		t.Fatalf("%d fetches after a burst of unknown kids, want 3", n)
+	}
+
+	// A reload keeps the keys and the refresh limit
+	next := newJWTVerifier(&JWTConfig{JWKSURL: srv.URL})
+	next.keys.inherit(v.keys)
+	if _, err := next.verify(ctx, rotated); err != nil {
+		t.Fatalf("after reload: %v", err)
+	}
+	if _, err := next.verify(ctx, ghost); err == nil || iss.fetches.Load() != 3 {
+		t.Fatalf("after reload: unknown kid error %v with %d fetches, want no new fetch", err, iss.fetches.Load())
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	iss := newTestIssuer(t)
+	srv := httptest.NewServer(iss)
+	defer srv.Close()
+	v := newJWTVerifier(&JWTConfig{JWKSURL: srv.URL})
+
+	var seen http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r.Header.Clone() })
+	token := iss.sign(t, "RS256", "rsa1", claims(nil), nil)
+
+	tests := []struct {
+		name   string
+		mode   string
+		scopes []string
+		auth   string
+		want   int
+		user   string
+	}{
+		{"public route drops forged identity", AuthPublic, nil, "", http.StatusOK, ""},
+		{"missing token", AuthRequired, nil, "", http.StatusUnauthorized, ""},
+		{"not a bearer token", AuthRequired, nil, "Basic YWxpY2U6eA==", http.StatusUnauthorized, ""},
+		{"bad token", AuthRequired, nil, "Bearer x.y.z", http.StatusUnauthorized, ""},
+		{"valid token", AuthRequired, nil, "Bearer " + token, http.StatusOK, "alice"},
+		{"scheme in lower case", AuthRequired, nil, "bearer " + token, http.StatusOK, "alice"},
+		{"scheme in upper case", AuthRequired, nil, "BEARER " + token, http.StatusOK, "alice"},
+		{"scheme without a token", AuthRequired, nil, "Bearer ", http.StatusUnauthorized, ""},
+		{"has the scopes", AuthRequired, []string{"user:read"}, "Bearer " + token, http.StatusOK, "alice"},
+		{"missing a scope", AuthRequired, []string{"user:read", "user:write"}, "Bearer " + token, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		seen = nil
+		r := httptest.NewRequest("GET", "/user/1", nil)
+		r.Header.Set(userIDHeader, "admin")
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		withAuth("user", tt.mode, tt.scopes, v, next).ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: no WWW-Authenticate challenge", tt.name)
+			}
+			continue
+		}
+		if got := seen.Get(userIDHeader); got != tt.user {
+			t.Errorf("%s: upstream saw user %q, want %q", tt.name, got, tt.user)
+		}
+	}
+}
@@ -1,58 +1,207 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
-	// Create a new router using the Gorilla Mux package
-	// The router will handle routing requests to the appropriate handlers
-	r := mux.NewRouter()
+	// The route table lives in a config file so adding a service does not need a rebuild
+	configPath := flag.String("config", "gateway.json", "path to the gateway route config")
+	watchInterval := flag.Duration("watch", 2*time.Second, "how often to check the config file for changes (0 disables)")
+	keysPath := flag.String("api-keys", "api-keys.json", "path to the consumer API key store")
+	adminToken := flag.String("admin-token", os.Getenv("GATEWAY_ADMIN_TOKEN"), "bearer token for the admin endpoints (default $GATEWAY_ADMIN_TOKEN)")
+	flag.Parse()
 
-	// Define a route for the /auth/ path prefix
-	// Requests starting with /auth/ will be forwarded to the auth service running on port 8001
-	r.PathPrefix("/auth/").Handler(reverseproxy("http://localhost:8001"))
+	// Consumer API keys are issued at runtime and kept in their own file
+	keys, err := loadAPIKeyStore(*keysPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Define a route for the /user/ path prefix
-	// Requests starting with /user/ will be forwarded to the user service running on port 8002
-	r.PathPrefix("/user/").Handler(reverseproxy("http://localhost:8002"))
+	// Load and validate the config; a broken route table should stop the gateway from starting
+	gw, err := newGateway(*configPath, keys)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Define a route for the /payment/ path prefix
-	// Requests starting with /payment/ will be forwarded to the payment service running on port 8003
-	r.PathPrefix("/payment/").Handler(reverseproxy("http://localhost:8003"))
+	// Pick up route changes on SIGHUP and, optionally, whenever the file is edited
+	go gw.watchSignals()
+	if *watchInterval > 0 {
+		go gw.watchFile(*watchInterval)
+	}
+
+	// Only the overall health status shares the client listener, for load balancer
+	// probes; everything that inspects or changes the gateway is on the admin one
+	root := http.NewServeMux()
+	root.HandleFunc("/gateway/health", gw.publicHealthHandler)
+	root.Handle("/", gw)
+
+	// The admin API has a listener of its own, kept off the client network
+	adminListen := gw.Config().Admin.Listen
+	admin := newServer(adminListen, ServerConfig{}, withRequestID(gw.adminHandler(*adminToken)))
 
 	// Log a message indicating the API Gateway is running
 	// This helps in identifying that the gateway has started successfully
-	log.Println("API gateway running on 8080")
+	listen := gw.Config().Listen
+	log.Printf("API gateway running on %s", listen)
+	log.Printf("Admin API running on %s", adminListen)
+
+	// Streams are hijacked or long-lived, so Shutdown has to be told to end them
+	srv := newServer(listen, gw.Config().Server, withRequestID(root))
+	srv.RegisterOnShutdown(gw.streams.close)
+
+	failed := make(chan error, 2)
+	go func() { failed <- admin.ListenAndServe() }()
+	go func() {
+		if gw.certs == nil {
+			failed <- srv.ListenAndServe()
+			return
+		}
+
+		// Terminate TLS with the certificates from the config, picked by SNI
+		// They are re-read whenever their files change, so renewal needs no restart
+		go gw.certs.watch()
+		srv.TLSConfig = gw.certs.serverConfig()
+		failed <- srv.ListenAndServeTLS("", "")
+	}()
 
-	// Start the HTTP server on port 8080 and use the router to handle requests
-	// This will block the main goroutine and listen for incoming requests
-	log.Fatal(http.ListenAndServe(":8080", r))
+	// Serve until SIGTERM or Ctrl-C, then drain; the exit status says whether
+	// every request finished or some had to be cut off
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case sig := <-stop:
+		if err := gw.shutdown(fmt.Sprintf("Received %v", sig), srv, admin); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
-// reverseproxy creates a reverse proxy for a given target URL
-// It forwards incoming requests to the target and sends back the response to the client
-func reverseproxy(target string) http.Handler {
-	// Parse the target URL into a URL object
-	// This is required to create the reverse proxy
-	url, _ := url.Parse(target)
-
-	// Create a new single-host reverse proxy for the target URL
-	proxy := httputil.NewSingleHostReverseProxy(url)
-
-	// Return an HTTP handler that uses the reverse proxy to handle requests
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Log the path of the request being proxied
-		// This helps in debugging and monitoring the requests being forwarded
-		log.Println("🔁 Proxying:", r.URL.Path)
-
-		// Use the reverse proxy to forward the request to the target service
-		// The proxy will handle sending the request and returning the response
-		proxy.ServeHTTP(w, r)
-	})
-}
\ No newline at end of file
+// buildRouteTable turns the config into a Gorilla Mux router with one route per entry
+func (g *Gateway) buildRouteTable(cfg *Config) (*routeTable, error) {
+	t := &routeTable{cfg: cfg, router: mux.NewRouter(), loaded: time.Now()}
+	t.verifier = newJWTVerifier(cfg.JWT)
+	t.budget = newRetryBudget(cfg.RetryBudget)
+
+	// The new table takes over what the current one has learned at runtime
+	prev := g.table.Load()
+	if prev != nil {
+		t.budget.inherit(prev.budget)
+		if t.verifier != nil && prev.verifier != nil {
+			t.verifier.keys.inherit(prev.verifier.keys)
+		}
+	}
+
+	// Composite endpoints go first so a route prefix cannot shadow them; their
+	// calls are dispatched back through the same router
+	for _, ag := range cfg.Aggregates {
+		t.router.Path(ag.Path).Methods(http.MethodGet).Handler(newAggregateHandler(ag, t.router))
+		log.Printf("aggregate %s: %s -> %d call(s)", ag.Name, ag.Path, len(ag.Calls))
+	}
+
+	for _, rc := range cfg.Routes {
+		pool, err := newPool(rc)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+		}
+		t.pools = append(t.pools, pool)
+		pool.inherit(prev.pool(rc.Name))
+		if rc.Bulkhead != nil {
+			if pool.bulkhead, err = t.sharedBulkhead(*rc.Bulkhead, pool, prev); err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+			}
+		}
+		g.restoreDrained(pool)
+		g.restoreFaults(pool)
+		if pool.split != nil && !g.restoreWeights(pool.split) {
+			t.staleWeights = append(t.staleWeights, rc.Name)
+		}
+
+		proxy, err := reverseproxy(pool, rc, cfg, t.budget)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+		}
+
+		// Requests matching the prefix (and host/methods, when set) go to this
+		// route's pool; the deadline also bounds the wait for a bulkhead slot
+		handler := withBulkhead(rc.Name, pool.bulkhead, proxy)
+		handler = withDeadline(time.Duration(rc.Timeouts.Request), handler)
+		handler = withCache(rc.Name, rc.Cache, g.cache, handler)
+		handler = withStreams(rc.Name, rc.Streams, g.streams, proxy, handler)
+		handler = withVersion(pool.split, handler)
+		handler = withFaults(rc.Name, pool.faults, handler)
+		handler = withAuth(rc.Name, rc.Auth, rc.Scopes, t.verifier, handler)
+		handler = withClientCert(rc.Name, rc.ClientCert, handler)
+		handler = withAPIKey(rc.Name, rc.APIKey, g.keys, handler)
+		handler = withMetrics(g.routeStats(rc.Name), handler)
+		route := t.router.PathPrefix(rc.PathPrefix).Handler(handler)
+		if rc.Host != "" {
+			route.Host(rc.Host)
+		}
+		if len(rc.Methods) > 0 {
+			route.Methods(rc.Methods...)
+		}
+
+		log.Printf("route %s: %s -> %d upstream(s), %s, auth %s", rc.Name, rc.PathPrefix, len(pool.Upstreams), pool.Strategy, rc.Auth)
+	}
+
+	return t, nil
+}
+
+// reverseproxy creates a reverse proxy for a pool of upstream instances
+// It forwards incoming requests to one of them and sends back the response to the client
+func reverseproxy(pool *Pool, rc RouteConfig, cfg *Config, budget *retryBudget) (http.Handler, error) {
+	rewriter, err := newPathRewriter(rc.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	// Redirects pointing at any instance of the pool are turned back into gateway paths
+	upstreamHosts := make(map[string]bool)
+	for _, u := range pool.Upstreams {
+		upstreamHosts[u.URL.Host] = true
+	}
+
+	return &httputil.ReverseProxy{
+		// The Director only prepares the request; upstreamTransport picks
+		// the instance and fills in the scheme and host for every attempt
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = pool.Route
+			rewriter.rewriteRequest(req)
+			setForwardedHeaders(req, cfg.TrustForwardedHeaders)
+			rc.Headers.Request.apply(req.Header)
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			rewriter.rewriteResponse(resp, upstreamHosts)
+			removeHeaders(resp.Header, cfg.StripResponseHeaders)
+			rc.Headers.Response.apply(resp.Header)
+			pool.pinSession(resp)
+			return nil
+		},
+		Transport: &upstreamTransport{
+			pool:         pool,
+			base:         newBaseTransport(rc.Timeouts, pool.tlsConfig),
+			preserveHost: rc.Options.PreserveHost,
+			retry:        newRetryPolicy(rc.Retry, budget),
+		},
+		ErrorHandler:  newErrorHandler(rc.Name),
+		FlushInterval: time.Duration(rc.Options.FlushInterval),
+	}, nil
+}
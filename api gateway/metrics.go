@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sizes of the windows the route statistics are computed over
+const (
+	rateWindowSeconds = 60   // requests and errors per second are kept for the last minute
+	latencySamples    = 1024 // latency percentiles come from the most recent requests
+)
+
+// statsBucket counts the requests of one second
+type statsBucket struct {
+	second   int64
+	requests int64
+	errors   int64
+}
+
+// routeStats keeps a route's traffic counters for the admin API: lifetime
+// totals, a one-minute rate and the latency of recent requests
+type routeStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	buckets   [rateWindowSeconds]statsBucket
+	latencies [latencySamples]time.Duration
+	samples   int
+}
+
+// record counts one finished request; streams pass a zero elapsed time since
+// their duration says nothing about the route's latency
+func (s *routeStats) record(status int, elapsed time.Duration) {
+	failed := status >= 500
+	s.requests.Add(1)
+	if failed {
+		s.errors.Add(1)
+	}
+
+	now := time.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &s.buckets[now%rateWindowSeconds]
+	if b.second != now {
+		*b = statsBucket{second: now}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+
+	if elapsed > 0 {
+		s.latencies[s.samples%latencySamples] = elapsed
+		s.samples++
+	}
+}
+
+// routeStatsSnapshot is the admin view of a route's traffic
+type routeStatsSnapshot struct {
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	InFlight      int64   `json:"in_flight"`
+	RatePerSecond float64 `json:"rate_per_second"`
+	ErrorRate     float64 `json:"error_rate"`
+	LatencyMs     latency `json:"latency_ms"`
+}
+
+// latency summarises recent request durations in milliseconds
+type latency struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Max     float64 `json:"max"`
+}
+
+// snapshot returns the counters, the rate over the last minute and the
+// latency percentiles of the most recent requests
+func (s *routeStats) snapshot() routeStatsSnapshot {
+	out := routeStatsSnapshot{
+		Requests: s.requests.Load(),
+		Errors:   s.errors.Load(),
+		InFlight: s.inFlight.Load(),
+	}
+
+	now := time.Now().Unix()
+	s.mu.Lock()
+	var requests, errors int64
+	for _, b := range s.buckets {
+		if now-b.second < rateWindowSeconds {
+			requests += b.requests
+			errors += b.errors
+		}
+	}
+	n := min(s.samples, latencySamples)
+	recent := make([]time.Duration, n)
+	copy(recent, s.latencies[:n])
+	s.mu.Unlock()
+
+	out.RatePerSecond = float64(requests) / rateWindowSeconds
+	if requests > 0 {
+		out.ErrorRate = float64(errors) / float64(requests)
+	}
+
+	if n > 0 {
+		sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+		ms := func(q float64) float64 {
+			return float64(recent[int(q*float64(n-1))]) / float64(time.Millisecond)
+		}
+		out.LatencyMs = latency{Samples: n, P50: ms(0.5), P90: ms(0.9), P99: ms(0.99), Max: ms(1)}
+	}
+	return out
+}
+
+// withMetrics counts every request a route receives, including the ones its
+// own middleware rejects, and how long the gateway took to answer
+func withMetrics(stats *routeStats, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats.inFlight.Add(1)
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+
+		// Deferred so a request the proxy aborts with a panic is still counted
+		defer func() {
+			stats.inFlight.Add(-1)
+			elapsed := time.Since(start)
+			if streamKind(r) != "" {
+				elapsed = 0
+			}
+			status := sr.status
+			switch {
+			case status != 0:
+			case sr.hijacked && streamKind(r) != "":
+				status = http.StatusSwitchingProtocols
+			case sr.hijacked:
+				// The connection was dropped without an answer, e.g. by a reset fault
+				status = http.StatusBadGateway
+			default:
+				status = http.StatusOK
+			}
+			stats.record(status, elapsed)
+		}()
+
+		next.ServeHTTP(sr, r)
+	})
+}
+
+// statusRecorder remembers the status code written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints come before the real one
+	if sr.status == 0 && status >= 200 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Flush passes through so streamed responses are not held back
+func (sr *statusRecorder) Flush() {
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+// Hijack hands over the client connection, for an upgrade or to drop it
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sr.ResponseWriter).Hijack()
+	if err == nil {
+		sr.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OutlierDetectionConfig ejects instances based on the route's real traffic,
+// alongside any active health checks: after runs of consecutive failures, or
+// when an instance's success rate falls well below its peers'
+type OutlierDetectionConfig struct {
+	// Consecutive5xx ejects an instance after this many 5xx responses or
+	// failed attempts in a row (default 5)
+	Consecutive5xx int `json:"consecutive_5xx,omitempty"`
+
+	// ConsecutiveGatewayFailures ejects an instance after this many connection
+	// failures, timeouts, 502s, 503s or 504s in a row (default 3)
+	ConsecutiveGatewayFailures int `json:"consecutive_gateway_failures,omitempty"`
+
+	// Interval is how often success rates are compared and ejections reviewed (default 10s)
+	Interval Duration `json:"interval,omitempty"`
+
+	// SuccessRateMinHosts is how many instances with enough traffic are
+	// needed before success rates are compared (default 3)
+	SuccessRateMinHosts int `json:"success_rate_min_hosts,omitempty"`
+
+	// SuccessRateMinRequests is how many requests an instance needs in an
+	// interval for its success rate to count (default 20)
+	SuccessRateMinRequests int `json:"success_rate_min_requests,omitempty"`
+
+	// SuccessRateStdevFactor ejects instances whose success rate is more than
+	// this many standard deviations below the mean of their peers (default 1.9)
+	SuccessRateStdevFactor float64 `json:"success_rate_stdev_factor,omitempty"`
+
+	// BaseEjectionTime is multiplied by the number of times an instance has
+	// been ejected, so repeat offenders stay out longer (default 30s)
+	BaseEjectionTime Duration `json:"base_ejection_time,omitempty"`
+
+	// MaxEjectionTime caps the ejection time (default 5m)
+	MaxEjectionTime Duration `json:"max_ejection_time,omitempty"`
+
+	// MaxEjectionPercent caps the share of the pool that may be ejected at
+	// once, so detection can never empty the pool (default 50)
+	MaxEjectionPercent int `json:"max_ejection_percent,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c OutlierDetectionConfig) withDefaults() OutlierDetectionConfig {
+	if c.Consecutive5xx == 0 {
+		c.Consecutive5xx = 5
+	}
+	if c.ConsecutiveGatewayFailures == 0 {
+		c.ConsecutiveGatewayFailures = 3
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(10 * time.Second)
+	}
+	if c.SuccessRateMinHosts == 0 {
+		c.SuccessRateMinHosts = 3
+	}
+	if c.SuccessRateMinRequests == 0 {
+		c.SuccessRateMinRequests = 20
+	}
+	if c.SuccessRateStdevFactor == 0 {
+		c.SuccessRateStdevFactor = 1.9
+	}
+	if c.BaseEjectionTime == 0 {
+		c.BaseEjectionTime = Duration(30 * time.Second)
+	}
+	if c.MaxEjectionTime == 0 {
+		c.MaxEjectionTime = Duration(5 * time.Minute)
+	}
+	if c.MaxEjectionPercent == 0 {
+		c.MaxEjectionPercent = 50
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c OutlierDetectionConfig) validate() error {
+	if c.Consecutive5xx < 0 || c.ConsecutiveGatewayFailures < 0 || c.SuccessRateMinHosts < 0 || c.SuccessRateMinRequests < 0 {
+		return errors.New("outlier_detection thresholds must not be negative")
+	}
+	if c.Interval < 0 || c.BaseEjectionTime < 0 || c.MaxEjectionTime < 0 {
+		return errors.New("outlier_detection times must not be negative")
+	}
+	if c.SuccessRateStdevFactor < 0 {
+		return errors.New("outlier_detection success_rate_stdev_factor must not be negative")
+	}
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent >= 100 {
+		return fmt.Errorf("outlier_detection max_ejection_percent %d must be below 100", c.MaxEjectionPercent)
+	}
+	return nil
+}
+
+// outlierState is the traffic history of one upstream instance
+type outlierState struct {
+	consecutive5xx     int
+	consecutiveGateway int
+
+	// the current success-rate interval
+	requests  int
+	successes int
+
+	ejectedUntil time.Time
+	ejections    int
+}
+
+// outlierDetector watches the responses of one pool's instances and takes
+// misbehaving ones out of rotation for a while
+type outlierDetector struct {
+	route string
+	cfg   OutlierDetectionConfig
+	pool  *Pool
+
+	mu    sync.Mutex
+	state map[*Upstream]*outlierState
+}
+
+// newOutlierDetector returns a detector for the pool, or nil when detection is not configured
+func newOutlierDetector(pool *Pool, cfg *OutlierDetectionConfig) *outlierDetector {
+	if cfg == nil {
+		return nil
+	}
+	d := &outlierDetector{route: pool.Route, cfg: cfg.withDefaults(), pool: pool, state: make(map[*Upstream]*outlierState)}
+	for _, u := range pool.Upstreams {
+		d.state[u] = &outlierState{}
+	}
+	return d
+}
+
+// inherit takes over the history of an instance from the previous table's
+// detector, so an ejected instance stays out for the rest of its time
+func (d *outlierDetector) inherit(u *Upstream, old *outlierDetector, prev *Upstream) {
+	if d == nil || old == nil {
+		return
+	}
+	old.mu.Lock()
+	s := *old.state[prev]
+	old.mu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*d.state[u] = s
+}
+
+// ejected reports whether the instance is currently ejected
+func (d *outlierDetector) ejected(u *Upstream) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Now().Before(d.state[u].ejectedUntil)
+}
+
+// record applies the outcome of one attempt. Attempts the client cancelled
+// say nothing about the instance and are not recorded; timeouts are
+// gateway failures like any other.
+func (d *outlierDetector) record(r *http.Request, u *Upstream, resp *http.Response, err error) {
+	if d == nil || errors.Is(r.Context().Err(), context.Canceled) {
+		return
+	}
+	gatewayFailure := err != nil
+	failed := err != nil
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			gatewayFailure = true
+		}
+		failed = resp.StatusCode >= 500
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.state[u]
+	s.requests++
+	if !failed {
+		s.successes++
+		s.consecutive5xx, s.consecutiveGateway = 0, 0
+		return
+	}
+	s.consecutive5xx++
+	if gatewayFailure {
+		s.consecutiveGateway++
+	} else {
+		s.consecutiveGateway = 0
+	}
+
+	now := time.Now()
+	switch {
+	case d.cfg.ConsecutiveGatewayFailures > 0 && s.consecutiveGateway >= d.cfg.ConsecutiveGatewayFailures:
+		d.eject(now, u, fmt.Sprintf("%d consecutive gateway failures", s.consecutiveGateway))
+	case d.cfg.Consecutive5xx > 0 && s.consecutive5xx >= d.cfg.Consecutive5xx:
+		d.eject(now, u, fmt.Sprintf("%d consecutive 5xx", s.consecutive5xx))
+	}
+}
+
+// eject takes an instance out of rotation unless it already is, or the pool
+// has reached its ejection cap. d.mu must be held.
+func (d *outlierDetector) eject(now time.Time, u *Upstream, reason string) {
+	s := d.state[u]
+	if now.Before(s.ejectedUntil) {
+		return
+	}
+
+	ejected := 0
+	for _, other := range d.state {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > d.cfg.MaxEjectionPercent*len(d.state) {
+		s.consecutive5xx, s.consecutiveGateway = 0, 0
+		log.Printf("🚷 Not ejecting %s from %s (%s): %d of %d instance(s) already ejected", u.URL.Host, d.route, reason, ejected, len(d.state))
+		return
+	}
+
+	s.ejections++
+	duration := min(time.Duration(d.cfg.BaseEjectionTime)*time.Duration(s.ejections), time.Duration(d.cfg.MaxEjectionTime))
+	s.ejectedUntil = now.Add(duration)
+	s.consecutive5xx, s.consecutiveGateway = 0, 0
+	log.Printf("🚷 Ejecting %s from %s for %v: %s (ejection #%d)", u.URL.Host, d.route, duration, reason, s.ejections)
+}
+
+// run reviews the pool every interval until ctx is cancelled
+func (d *outlierDetector) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(d.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.review(time.Now())
+		}
+	}
+}
+
+// review ejects instances whose success rate over the last interval is well
+// below their peers', and lets instances that stayed in rotation work off
+// their past ejections so the next one is shorter
+func (d *outlierDetector) review(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var rates []float64
+	for _, s := range d.state {
+		if s.requests >= d.cfg.SuccessRateMinRequests {
+			rates = append(rates, float64(s.successes)/float64(s.requests))
+		}
+	}
+	if len(rates) >= d.cfg.SuccessRateMinHosts {
+		mean, stdev := meanStdev(rates)
+		threshold := mean - d.cfg.SuccessRateStdevFactor*stdev
+		for _, u := range d.pool.Upstreams {
+			s := d.state[u]
+			if s.requests < d.cfg.SuccessRateMinRequests {
+				continue
+			}
+			if rate := float64(s.successes) / float64(s.requests); rate < threshold {
+				d.eject(now, u, fmt.Sprintf("success rate %.1f%% against a pool mean of %.1f%%", rate*100, mean*100))
+			}
+		}
+	}
+
+	for u, s := range d.state {
+		if !s.ejectedUntil.IsZero() && !now.Before(s.ejectedUntil) {
+			log.Printf("✅ %s back in rotation on %s after ejection", u.URL.Host, d.route)
+			s.ejectedUntil = time.Time{}
+		} else if s.ejectedUntil.IsZero() && s.ejections > 0 && s.requests > 0 && s.successes == s.requests {
+			// A clean interval back in rotation earns a shorter next ejection
+			s.ejections--
+		}
+		s.requests, s.successes = 0, 0
+	}
+}
+
+// meanStdev returns the mean and population standard deviation of xs
+func meanStdev(xs []float64) (mean, stdev float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	for _, x := range xs {
+		stdev += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(stdev / float64(len(xs)))
+}
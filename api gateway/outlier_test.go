@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// outlierPool returns a detector over n healthy instances
+func outlierPool(n int, cfg OutlierDetectionConfig) (*outlierDetector, []*Upstream) {
+	weights := make([]int, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	pool := &Pool{Route: "user", Upstreams: testUpstreams(weights...)}
+	return newOutlierDetector(pool, &cfg), pool.Upstreams
+}
+
+// answer records one attempt on u: a status code, or 0 for a connection failure
+func answer(ctx context.Context, d *outlierDetector, u *Upstream, status int) {
+	r := httptest.NewRequest("GET", "/user/1", nil).WithContext(ctx)
+	if status == 0 {
+		d.record(r, u, nil, errors.New("connection refused"))
+		return
+	}
+	d.record(r, u, &http.Response{StatusCode: status}, nil)
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		statuses []int
+		ctx      context.Context
+		ejected  bool
+	}{
+		{"four 5xx", []int{500, 500, 500, 500}, context.Background(), false},
+		{"five 5xx", []int{500, 500, 500, 500, 500}, context.Background(), true},
+		{"a success resets the run", []int{500, 500, 500, 500, 200, 500}, context.Background(), false},
+		{"three gateway failures", []int{502, 0, 503}, context.Background(), true},
+		{"a plain 5xx breaks a gateway run", []int{503, 503, 500, 503}, context.Background(), false},
+		{"4xx is not a failure", []int{404, 404, 404, 404, 404, 404}, context.Background(), false},
+		{"cancelled attempts are ignored", []int{503, 503, 503}, cancelled, false},
+	}
+	for _, tt := range tests {
+		d, ups := outlierPool(4, OutlierDetectionConfig{})
+		for _, status := range tt.statuses {
+			answer(tt.ctx, d, ups[0], status)
+		}
+		if got := d.ejected(ups[0]); got != tt.ejected {
+			t.Errorf("%s: ejected %v, want %v", tt.name, got, tt.ejected)
+		}
+		if d.ejected(ups[1]) {
+			t.Errorf("%s: an instance without failures was ejected", tt.name)
+		}
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	d, ups := outlierPool(4, OutlierDetectionConfig{MaxEjectionPercent: 50})
+
+	// Every instance fails, but at most half of the pool is taken out
+	for _, u := range ups {
+		for i := 0; i < 3; i++ {
+			answer(context.Background(), d, u, 503)
+		}
+	}
+	ejected := 0
+	for _, u := range ups {
+		if d.ejected(u) {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("%d of 4 instances ejected, want the cap of 2", ejected)
+	}
+}
+
+func TestOutlierBackoff(t *testing.T) {
+	base, limit := 30*time.Second, 45*time.Second
+	d, ups := outlierPool(4, OutlierDetectionConfig{BaseEjectionTime: Duration(base), MaxEjectionTime: Duration(limit)})
+	u := ups[0]
+
+	// ejectFor fails u until it is ejected and returns how long for
+	ejectFor := func() time.Duration {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			answer(context.Background(), d, u, 503)
+		}
+		if !d.ejected(u) {
+			t.Fatal("instance not ejected")
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return time.Until(d.state[u].ejectedUntil).Round(time.Second)
+	}
+	// cleanInterval sends u successful traffic for one review interval
+	cleanInterval := func() {
+		answer(context.Background(), d, u, 200)
+		d.review(time.Now())
+	}
+
+	if got := ejectFor(); got != base {
+		t.Fatalf("first ejection %v, want %v", got, base)
+	}
+
+	// Still out while the ejection lasts, back once it is over
+	d.review(time.Now().Add(base / 2))
+	if !d.ejected(u) {
+		t.Fatal("instance re-admitted before its ejection ended")
+	}
+	d.review(time.Now().Add(base + time.Second))
+	if d.ejected(u) {
+		t.Fatal("instance not re-admitted after its ejection")
+	}
+
+	// A repeat offender stays out longer, up to the cap
+	if got := ejectFor(); got != limit {
+		t.Fatalf("second ejection %v, want %v", got, limit)
+	}
+	d.review(time.Now().Add(limit + time.Second))
+
+	// Clean intervals back in rotation work the history off again
+	cleanInterval()
+	cleanInterval()
+	if got := ejectFor(); got != base {
+		t.Fatalf("ejection after clean intervals %v, want %v", got, base)
+	}
+}
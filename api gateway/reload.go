@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routeTable is one immutable generation of the gateway's routing state
+type routeTable struct {
+	cfg    *Config
+	router *mux.Router
+	pools  []*Pool
+	loaded time.Time
+
+	// verifier checks bearer tokens; nil when the config has no jwt section
+	verifier *jwtVerifier
+
+	// budget is the gateway-wide retry budget every route draws on
+	budget *retryBudget
+
+	// staleWeights lists routes whose runtime weights no longer fit this table
+	staleWeights []string
+
+	// bulkheads are shared by every route to the same upstream service, by service
+	bulkheads map[string]*bulkhead
+
+	// stop ends the background work (health checks, key refresh) owned by this table
+	stop context.CancelFunc
+}
+
+// start launches the table's background work
+func (t *routeTable) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.stop = cancel
+	for _, p := range t.pools {
+		if p.checker != nil {
+			p.checker.run(ctx)
+		}
+		if p.outlier != nil {
+			go p.outlier.run(ctx)
+		}
+	}
+	if t.verifier != nil {
+		go t.verifier.keys.run(ctx, t.verifier.interval)
+	}
+}
+
+// close stops the table's background work once it no longer serves new requests
+func (t *routeTable) close() {
+	if t.stop != nil {
+		t.stop()
+	}
+}
+
+// Gateway serves client traffic through whichever route table is current
+// and swaps in a new one when the config file changes
+type Gateway struct {
+	configPath string
+
+	// keys holds consumer API keys; they are managed at runtime, not in the config file
+	keys *apiKeyStore
+
+	// cache outlives route tables so a reload does not throw away every cached response
+	cache *responseCache
+
+	// certs holds the listener's TLS certificates; nil when the gateway serves plain HTTP
+	certs *certStore
+
+	// weights holds traffic splits set through the admin API, by route, drained
+	// the instances an operator took out of rotation, as "route/host", faults
+	// the fault rules switched on or off, as "route/rule", and stats the
+	// per-route traffic counters; all of them outlive reloads
+	overridesMu sync.Mutex
+	weights     map[string]map[string]int
+	drained     map[string]bool
+	faults      map[string]bool
+	stats       map[string]*routeStats
+
+	// streams are the open WebSocket and SSE connections, ended on shutdown
+	streams *streamGroup
+
+	// stopping makes health checks fail once shutdown has begun
+	stopping atomic.Bool
+
+	// table is read on every request and replaced wholesale on reload, so a
+	// request that already picked up the old table finishes on it
+	table atomic.Pointer[routeTable]
+
+	// mu serialises reloads so two triggers cannot race each other
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// newGateway loads the initial config; unlike a reload, failure here is fatal to the caller
+func newGateway(configPath string, keys *apiKeyStore) (*Gateway, error) {
+	g := &Gateway{configPath: configPath, keys: keys, streams: newStreamGroup()}
+	if err := g.Reload("startup"); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ServeHTTP hands the request to the current route table's router
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.table.Load().router.ServeHTTP(w, r)
+}
+
+// Config returns the config of the route table currently serving traffic
+func (g *Gateway) Config() *Config {
+	return g.table.Load().cfg
+}
+
+// Reload reads the config file and atomically installs a new route table.
+// If the file is invalid the current table is kept and the error returned.
+func (g *Gateway) Reload(reason string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Remember the file's mtime up front so a bad file is not retried on every poll
+	if fi, err := os.Stat(g.configPath); err == nil {
+		g.modTime = fi.ModTime()
+	}
+
+	cfg, err := loadConfig(g.configPath)
+	if err != nil {
+		return err
+	}
+
+	// Routes hold on to the shared cache, so it has to exist before the first table
+	if g.cache == nil {
+		g.cache = newResponseCache(cfg.Cache)
+	}
+
+	// Building the table changes nothing the running gateway depends on, so a
+	// config rejected here or below leaves the gateway exactly as it was
+	table, err := g.buildRouteTable(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Whether to use TLS is decided when the listener starts; after that a
+	// reload can only change which certificates are served
+	startup := g.table.Load() == nil
+	switch {
+	case cfg.TLS != nil && startup:
+		certs, err := newCertStore(*cfg.TLS)
+		if err != nil {
+			return err
+		}
+		g.certs = certs
+	case cfg.TLS != nil && g.certs != nil:
+		if err := g.certs.load(*cfg.TLS); err != nil {
+			return err
+		}
+	case (cfg.TLS != nil) != (g.certs != nil):
+		log.Printf("⚠️ tls was turned on or off; restart the gateway to apply it")
+	}
+
+	// Nothing can fail from here on
+	g.cache.resize(cfg.Cache)
+	table.start()
+	old := g.table.Swap(table)
+	g.forgetWeights(table.staleWeights)
+	if old != nil {
+		old.close()
+		if old.cfg.Listen != cfg.Listen {
+			log.Printf("⚠️ listen address changed to %s; restart the gateway to apply it", cfg.Listen)
+		}
+		if old.cfg.Admin.Listen != cfg.Admin.Listen {
+			log.Printf("⚠️ admin listen address changed to %s; restart the gateway to apply it", cfg.Admin.Listen)
+		}
+	}
+
+	log.Printf("🔄 Route table loaded (%s): %d routes", reason, len(cfg.Routes))
+	return nil
+}
+
+// ==================== STATE ACROSS RELOADS ====================
+
+// pool returns the table's pool for the named route, or nil when it has none
+func (t *routeTable) pool(route string) *Pool {
+	if t == nil {
+		return nil
+	}
+	for _, p := range t.pools {
+		if p.Route == route {
+			return p
+		}
+	}
+	return nil
+}
+
+// inherit carries the runtime state of the same route's pool in the previous
+// table into a freshly built one, so a reload does not put instances known
+// to be down back into rotation or forget what the route has learned.
+// Instances are matched by host; new instances and features start fresh.
+func (p *Pool) inherit(old *Pool) {
+	if old == nil {
+		return
+	}
+	prev := make(map[string]*Upstream, len(old.Upstreams))
+	for _, u := range old.Upstreams {
+		prev[u.URL.Host] = u
+	}
+	for _, u := range p.Upstreams {
+		o, ok := prev[u.URL.Host]
+		if !ok {
+			continue
+		}
+		u.inflight = o.inflight
+		u.requests.Store(o.requests.Load())
+		if p.checker != nil && old.checker != nil {
+			// Without a checker in both tables nothing would bring a down instance back
+			u.inheritHealth(o)
+		}
+		u.breaker.inherit(o.breaker)
+		p.outlier.inherit(u, old.outlier, o)
+	}
+	p.shadow.inherit(old.shadow)
+	p.hedge.inherit(old.hedge)
+}
+
+// reloadAndLog reloads and logs the outcome, for triggers that have nobody to report to
+func (g *Gateway) reloadAndLog(reason string) {
+	if err := g.Reload(reason); err != nil {
+		log.Printf("❌ Reload (%s) rejected, keeping previous routes: %v", reason, err)
+	}
+}
+
+// watchSignals reloads the route table every time the process receives SIGHUP
+func (g *Gateway) watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	for range ch {
+		g.reloadAndLog("SIGHUP")
+	}
+}
+
+// watchFile polls the config file and reloads when its modification time changes.
+// Polling keeps the gateway free of platform-specific file notification code.
+func (g *Gateway) watchFile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fi, err := os.Stat(g.configPath)
+		if err != nil {
+			continue
+		}
+
+		g.mu.Lock()
+		changed := !fi.ModTime().Equal(g.modTime)
+		g.mu.Unlock()
+
+		if changed {
+			g.reloadAndLog("file changed")
+		}
+	}
+}
+
+// reloadHandler lets an operator trigger a reload with POST /gateway/reload
+func (g *Gateway) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := g.Reload("admin endpoint"); err != nil {
+		log.Printf("❌ Reload (admin endpoint) rejected, keeping previous routes: %v", err)
+		http.Error(w, fmt.Sprintf("reload rejected: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	fmt.Fprintf(w, "reloaded %d routes\n", len(g.Config().Routes))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// testGateway starts a gateway on the given config file contents and stops
+// its background work when the test ends
+func testGateway(t *testing.T, config string) *Gateway {
+	t.Helper()
+	path := writeFile(t, t.TempDir(), "gateway.json", []byte(config))
+	g, err := newGateway(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.table.Load().close() })
+	return g
+}
+
+// reloadConfig replaces the gateway's config file and reloads it
+func reloadConfig(t *testing.T, g *Gateway, config string) error {
+	t.Helper()
+	writeFile(t, filepath.Dir(g.configPath), "gateway.json", []byte(config))
+	return g.Reload("test")
+}
+
+// upstreamsConfig is a config with one user route over the given upstreams
+func upstreamsConfig(extra string, upstreams ...string) string {
+	list := ""
+	for i, u := range upstreams {
+		if i > 0 {
+			list += ", "
+		}
+		list += fmt.Sprintf("%q", u)
+	}
+	return fmt.Sprintf(`{"routes": [{"name": "user", "path_prefix": "/user/", "upstreams": [%s]%s}]}`, list, extra)
+}
+
+func TestReloadRejected(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	g := testGateway(t, upstreamsConfig("", backend.URL))
+	before := g.table.Load()
+
+	for _, bad := range []string{
+		`{"routes": [`,
+		upstreamsConfig(""),
+		upstreamsConfig(`, "load_balancer": "fastest"`, backend.URL),
+	} {
+		if err := reloadConfig(t, g, bad); err == nil {
+			t.Errorf("config %s was accepted", bad)
+		}
+		if g.table.Load() != before {
+			t.Fatalf("config %s replaced the route table", bad)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("after rejected reloads: %d, want the old routes still served", w.Code)
+	}
+}
+
+func TestReloadKeepsRuntimeState(t *testing.T) {
+	// Every instance fails its health check, but one failure is not enough to take it out
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+	const extra = `, "health_check": {"path": "/health", "interval": "1h", "unhealthy_threshold": 3},
+		"circuit_breaker": {"consecutive_failures": 2, "open_timeout": "1h"}`
+	g := testGateway(t, upstreamsConfig(extra, a.URL))
+
+	// The old table has learned that a is down, opened its breaker and has a request on it
+	old := g.table.Load().pool("user").Upstreams[0]
+	old.health.mu.Lock()
+	old.health.failures = 3
+	old.health.mu.Unlock()
+	old.healthy.Store(false)
+	for i := 0; i < 2; i++ {
+		done, err := old.breaker.allow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(outcomeFailure)
+	}
+	old.inflight.Add(1)
+	old.requests.Store(7)
+
+	if err := reloadConfig(t, g, upstreamsConfig(extra, a.URL, b.URL)); err != nil {
+		t.Fatal(err)
+	}
+	ups := g.table.Load().pool("user").Upstreams
+	kept, added := ups[0], ups[1]
+	if kept == old {
+		t.Fatal("reload reused the old instance")
+	}
+	if kept.Healthy() || kept.breaker.State() != "open" || kept.InFlight() != 1 || kept.requests.Load() != 7 {
+		t.Errorf("kept instance: healthy %v, breaker %s, %d in flight, %d requests, want down, open, 1, 7",
+			kept.Healthy(), kept.breaker.State(), kept.InFlight(), kept.requests.Load())
+	}
+	if !added.Healthy() || added.breaker.State() != "closed" || added.InFlight() != 0 {
+		t.Errorf("new instance: healthy %v, breaker %s, %d in flight, want a fresh start",
+			added.Healthy(), added.breaker.State(), added.InFlight())
+	}
+
+	// The request started before the reload finishes on the old instance
+	old.inflight.Add(-1)
+	if n := kept.InFlight(); n != 0 {
+		t.Errorf("%d in flight once the old request finished", n)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryConfig configures automatic retries for one route
+type RetryConfig struct {
+	// Attempts is the total number of tries, including the first one
+	Attempts int `json:"attempts,omitempty"`
+
+	// RetryOn lists the upstream status codes that are worth another try
+	RetryOn []int `json:"retry_on,omitempty"`
+
+	// BaseDelay is the backoff before the first retry; it doubles for every retry after that
+	BaseDelay Duration `json:"base_delay,omitempty"`
+
+	// MaxDelay caps the backoff between two tries
+	MaxDelay Duration `json:"max_delay,omitempty"`
+
+	// MaxBodyBytes is the largest request body buffered for replay; larger requests are tried once
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+
+	// IdempotencyHeader marks a non-idempotent request as safe to repeat
+	IdempotencyHeader string `json:"idempotency_header,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.Attempts <= 0 {
+		c.Attempts = 3
+	}
+	if len(c.RetryOn) == 0 {
+		c.RetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = Duration(25 * time.Millisecond)
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = Duration(time.Second)
+	}
+	if c.MaxBodyBytes <= 0 {
+		c.MaxBodyBytes = 64 << 10
+	}
+	if c.IdempotencyHeader == "" {
+		c.IdempotencyHeader = "Idempotency-Key"
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c RetryConfig) validate() error {
+	for _, code := range c.RetryOn {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retry retry_on status %d is not an HTTP status code", code)
+		}
+	}
+	if c.BaseDelay > 0 && c.MaxDelay > 0 && c.BaseDelay > c.MaxDelay {
+		return fmt.Errorf("retry base_delay %v is longer than max_delay %v", c.BaseDelay, c.MaxDelay)
+	}
+	return nil
+}
+
+// RetryBudgetConfig limits retries across the whole gateway so a struggling
+// upstream is not buried under a storm of repeated requests
+type RetryBudgetConfig struct {
+	// Ratio is how many retries each original request earns (0.2 allows retries to add 20% load)
+	Ratio float64 `json:"ratio,omitempty"`
+
+	// MinPerSecond is a floor of retries always allowed, so low-traffic routes can still retry
+	MinPerSecond float64 `json:"min_per_second,omitempty"`
+}
+
+// retryBudget is a token bucket: requests deposit Ratio tokens, a retry spends one
+type retryBudget struct {
+	mu        sync.Mutex
+	ratio     float64
+	perSecond float64
+	max       float64
+	tokens    float64
+	last      time.Time
+}
+
+// newRetryBudget returns the gateway-wide budget, using defaults for unset fields
+func newRetryBudget(cfg RetryBudgetConfig) *retryBudget {
+	if cfg.Ratio <= 0 {
+		cfg.Ratio = 0.2
+	}
+	if cfg.MinPerSecond <= 0 {
+		cfg.MinPerSecond = 10
+	}
+
+	// Allow a burst of one second's worth of minimum retries
+	max := cfg.MinPerSecond
+	return &retryBudget{ratio: cfg.Ratio, perSecond: cfg.MinPerSecond, max: max, tokens: max, last: time.Now()}
+}
+
+// inherit takes over the tokens left in the budget this one replaces, so a
+// reload neither refills nor empties it
+func (b *retryBudget) inherit(old *retryBudget) {
+	if old == nil {
+		return
+	}
+	old.mu.Lock()
+	tokens, last := old.tokens, old.last
+	old.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens, b.last = min(b.max, tokens), last
+}
+
+// deposit credits the budget for one original request
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens = min(b.max, b.tokens+b.ratio)
+}
+
+// withdraw spends one retry, or reports false when the budget is exhausted
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the minimum per-second allowance for the time since the last call
+func (b *retryBudget) refill() {
+	now := time.Now()
+	b.tokens = min(b.max, b.tokens+now.Sub(b.last).Seconds()*b.perSecond)
+	b.last = now
+}
+
+// retryPolicy is a route's RetryConfig prepared for use on the request path
+type retryPolicy struct {
+	cfg    RetryConfig
+	retry  map[int]bool
+	budget *retryBudget
+}
+
+// newRetryPolicy returns the policy for a route, or nil when retries are not configured
+func newRetryPolicy(cfg *RetryConfig, budget *retryBudget) *retryPolicy {
+	if cfg == nil {
+		return nil
+	}
+	p := &retryPolicy{cfg: cfg.withDefaults(), retry: make(map[int]bool), budget: budget}
+	for _, code := range p.cfg.RetryOn {
+		p.retry[code] = true
+	}
+	return p
+}
+
+// replayable reports whether the request may be sent more than once
+func (p *retryPolicy) replayable(req *http.Request) bool {
+	if p == nil || p.cfg.Attempts < 2 {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(p.cfg.IdempotencyHeader) != ""
+}
+
+// shouldRetry decides whether the outcome of an attempt is worth another try
+func (p *retryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return isConnError(err)
+	}
+	return p.retry[resp.StatusCode]
+}
+
+// backoff returns the delay before the given retry (1 for the first retry),
+// exponential with full jitter so clients do not retry in lock-step
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	d := time.Duration(p.cfg.BaseDelay) << (retry - 1)
+	if d <= 0 || d > time.Duration(p.cfg.MaxDelay) {
+		d = time.Duration(p.cfg.MaxDelay)
+	}
+	return rand.N(d) + 1
+}
+
+// isConnError reports whether err means the request never got a usable
+// answer from the instance: refused, reset, or a circuit that just opened
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	var open *errCircuitOpen
+	switch {
+	case errors.As(err, &opErr),
+		errors.As(err, &open),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	return false
+}
+
+// bufferBody reads up to limit bytes of the request body so it can be replayed.
+// If the body is larger it is stitched back together and ok is false.
+func bufferBody(req *http.Request, limit int64) (body []byte, ok bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return buf, true, nil
+}
+
+// readCloser pairs a reader with the closer of the body it was built from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sleepCtx waits for d or until ctx is done, whichever is first
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
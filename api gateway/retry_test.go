@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	p := newRetryPolicy(&RetryConfig{}, newRetryBudget(RetryBudgetConfig{}))
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+		err    error
+		want   bool
+	}{
+		{"ok", context.Background(), http.StatusOK, nil, false},
+		{"bad gateway", context.Background(), http.StatusBadGateway, nil, true},
+		{"unavailable", context.Background(), http.StatusServiceUnavailable, nil, true},
+		{"gateway timeout", context.Background(), http.StatusGatewayTimeout, nil, true},
+		{"internal error", context.Background(), http.StatusInternalServerError, nil, false},
+		{"not found", context.Background(), http.StatusNotFound, nil, false},
+		{"refused", context.Background(), 0, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"reset", context.Background(), 0, fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"closed early", context.Background(), 0, io.ErrUnexpectedEOF, true},
+		{"circuit opened", context.Background(), 0, &errCircuitOpen{retryAfter: time.Second}, true},
+		{"other error", context.Background(), 0, errors.New("tls: bad certificate"), false},
+		{"client gone", cancelled, http.StatusBadGateway, nil, false},
+		{"client gone mid-dial", cancelled, 0, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(tt.ctx)
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := p.shouldRetry(req, resp, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRetry %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	custom := newRetryPolicy(&RetryConfig{RetryOn: []int{http.StatusTooManyRequests}}, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	if !custom.shouldRetry(req, &http.Response{StatusCode: http.StatusTooManyRequests}, nil) {
+		t.Error("retry_on 429: want 429 retried")
+	}
+	if custom.shouldRetry(req, &http.Response{StatusCode: http.StatusBadGateway}, nil) {
+		t.Error("retry_on 429: want 502 not retried")
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	p := newRetryPolicy(&RetryConfig{}, nil)
+	tests := []struct {
+		method string
+		key    string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodPut, "", true},
+		{http.MethodDelete, "", true},
+		{http.MethodPost, "", false},
+		{http.MethodPatch, "", false},
+		{http.MethodPost, "order-42", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		if tt.key != "" {
+			req.Header.Set("Idempotency-Key", tt.key)
+		}
+		if got := p.replayable(req); got != tt.want {
+			t.Errorf("%s (key %q): replayable %v, want %v", tt.method, tt.key, got, tt.want)
+		}
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/", nil)
+	if newRetryPolicy(&RetryConfig{Attempts: 1}, nil).replayable(get) {
+		t.Error("attempts 1: want nothing replayed")
+	}
+	var none *retryPolicy
+	if none.replayable(get) {
+		t.Error("no retry config: want nothing replayed")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := newRetryPolicy(&RetryConfig{BaseDelay: Duration(10 * time.Millisecond), MaxDelay: Duration(50 * time.Millisecond)}, nil)
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{40, 50 * time.Millisecond},
+		{80, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(tt.retry); d <= 0 || d > tt.max {
+				t.Fatalf("retry %d: backoff %v, want within (0, %v]", tt.retry, d, tt.max)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(RetryBudgetConfig{Ratio: 0.5, MinPerSecond: 2})
+
+	// It starts with a burst of one second's minimum
+	for i := 0; i < 2; i++ {
+		if !b.withdraw() {
+			t.Fatalf("retry %d of the initial burst refused", i+1)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("retry allowed with the budget spent")
+	}
+
+	// Every request earns half a retry
+	b.deposit()
+	if b.withdraw() {
+		t.Fatal("retry allowed after half a token")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatal("retry refused after two requests at ratio 0.5")
+	}
+
+	// Time refills the minimum, but never past the burst
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+	allowed := 0
+	for b.withdraw() {
+		allowed++
+	}
+	if allowed != 2 {
+		t.Fatalf("%d retries after an idle hour, want the burst of 2", allowed)
+	}
+
+	// A reload keeps the spent budget instead of refilling it
+	fresh := newRetryBudget(RetryBudgetConfig{Ratio: 0.5, MinPerSecond: 2})
+	fresh.inherit(b)
+	if fresh.withdraw() {
+		t.Fatal("reloaded budget was refilled")
+	}
+	fresh.inherit(nil)
+}
+
+func TestBufferBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		limit  int64
+		wantOK bool
+	}{
+		{"empty", "", 10, true},
+		{"fits", "hello", 10, true},
+		{"exactly the limit", "0123456789", 10, true},
+		{"too large", "0123456789abc", 10, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+		if tt.body == "" {
+			req.Body = http.NoBody
+		}
+		buf, ok, err := bufferBody(req, tt.limit)
+		if err != nil || ok != tt.wantOK {
+			t.Errorf("%s: ok %v, err %v, want ok %v", tt.name, ok, err, tt.wantOK)
+			continue
+		}
+		if ok {
+			if string(buf) != tt.body {
+				t.Errorf("%s: buffered %q, want %q", tt.name, buf, tt.body)
+			}
+			continue
+		}
+
+		// A body too large to replay is passed on whole
+		rest, _ := io.ReadAll(req.Body)
+		if string(rest) != tt.body {
+			t.Errorf("%s: body read back as %q, want %q", tt.name, rest, tt.body)
+		}
+	}
+}
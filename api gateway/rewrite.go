@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteConfig describes how a route changes the request path before proxying.
+// The steps run in order: strip_prefix, then each regex rule, then add_prefix.
+type RewriteConfig struct {
+	// StripPrefix is removed from the front of the path, e.g. "/payment"
+	StripPrefix string `json:"strip_prefix,omitempty"`
+
+	// Regex rules are applied to the path in order
+	Regex []RegexRewrite `json:"regex,omitempty"`
+
+	// AddPrefix is put in front of the path, e.g. "/api/v2"
+	AddPrefix string `json:"add_prefix,omitempty"`
+}
+
+// RegexRewrite replaces matches of Match with Replace, which may refer to capture groups as $1 or ${name}
+type RegexRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// compiledRewrite is a RegexRewrite with its expression compiled
+type compiledRewrite struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// pathRewriter applies a route's RewriteConfig to requests and undoes it on responses
+type pathRewriter struct {
+	strip string
+	add   string
+	rules []compiledRewrite
+}
+
+// newPathRewriter compiles a route's rewrite rules, or returns nil when it has none
+func newPathRewriter(cfg *RewriteConfig) (*pathRewriter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	p := &pathRewriter{strip: cfg.StripPrefix, add: cfg.AddPrefix}
+	for _, c := range []struct{ name, value string }{{"strip_prefix", p.strip}, {"add_prefix", p.add}} {
+		if c.value != "" && !strings.HasPrefix(c.value, "/") {
+			return nil, fmt.Errorf("rewrite %s %q must start with \"/\"", c.name, c.value)
+		}
+	}
+
+	for _, r := range cfg.Regex {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite regex %q: %w", r.Match, err)
+		}
+		p.rules = append(p.rules, compiledRewrite{re: re, replace: r.Replace})
+	}
+	return p, nil
+}
+
+// rewrite maps a gateway path to the path the upstream expects
+func (p *pathRewriter) rewrite(path string) string {
+	if p == nil {
+		return path
+	}
+
+	if rest, ok := trimPathPrefix(path, p.strip); ok {
+		path = rest
+	}
+	for _, r := range p.rules {
+		path = r.re.ReplaceAllString(path, r.replace)
+	}
+	if p.add != "" {
+		path = singleJoiningSlash(p.add, path)
+	}
+	return path
+}
+
+// reverse maps an upstream path back to the gateway path it is exposed under.
+// Regex rewrites cannot be undone in general, so routes using them only get
+// Location and cookie paths rewritten when no regex rule is configured.
+func (p *pathRewriter) reverse(path string) (string, bool) {
+	if p == nil || len(p.rules) > 0 {
+		return path, false
+	}
+
+	if p.add != "" {
+		rest, ok := trimPathPrefix(path, p.add)
+		if !ok {
+			return path, false
+		}
+		path = rest
+	}
+	if p.strip != "" {
+		path = singleJoiningSlash(p.strip, path)
+	}
+	return path, true
+}
+
+// rewriteRequest changes the outgoing request path; the encoded form is
+// dropped so it cannot disagree with the rewritten one
+func (p *pathRewriter) rewriteRequest(req *http.Request) {
+	if p == nil {
+		return
+	}
+	req.URL.Path = p.rewrite(req.URL.Path)
+	req.URL.RawPath = ""
+}
+
+// rewriteResponse fixes Location headers and cookie paths coming back from
+// the upstream so they point at the gateway path rather than the upstream's
+func (p *pathRewriter) rewriteResponse(resp *http.Response, upstreamHosts map[string]bool) {
+	if p == nil {
+		return
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if u, err := url.Parse(loc); err == nil {
+			// Only redirects into the upstream itself are rewritten; others go elsewhere on purpose
+			if u.Host == "" || upstreamHosts[u.Host] {
+				if path, ok := p.reverse(u.Path); ok {
+					u.Scheme, u.Host, u.User = "", "", nil
+					u.Path, u.RawPath = path, ""
+					resp.Header.Set("Location", u.String())
+				}
+			}
+		}
+	}
+
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	resp.Header.Del("Set-Cookie")
+	for _, line := range cookies {
+		c, err := http.ParseSetCookie(line)
+		if err == nil && c.Path != "" {
+			if path, ok := p.reverse(c.Path); ok {
+				c.Path = path
+				line = c.String()
+			}
+		}
+		resp.Header.Add("Set-Cookie", line)
+	}
+}
+
+// trimPathPrefix removes prefix from the front of path when it covers whole
+// segments, so "/payment" comes off "/payment/42" and "/payment" but not
+// "/paymentfoo". ok is false when the path does not start with the prefix.
+func trimPathPrefix(path, prefix string) (rest string, ok bool) {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+	rest = path[len(prefix):]
+	if rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasSuffix(prefix, "/") {
+		return path, false
+	}
+	return ensureLeadingSlash(rest), true
+}
+
+// ensureLeadingSlash makes sure a path is absolute
+func ensureLeadingSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrimPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         string
+		ok           bool
+	}{
+		{"/payment/42", "/payment", "/42", true},
+		{"/payment", "/payment", "/", true},
+		{"/payment/", "/payment", "/", true},
+		{"/paymentfoo", "/payment", "/paymentfoo", false},
+		{"/payment/42", "/payment/", "/42", true},
+		{"/user/1", "/payment", "/user/1", false},
+		{"/user/1", "", "/user/1", false},
+	}
+	for _, tt := range tests {
+		got, ok := trimPathPrefix(tt.path, tt.prefix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("trim %q from %q: %q, %v, want %q, %v", tt.prefix, tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      RewriteConfig
+		path     string
+		upstream string
+		back     string
+		reverses bool
+	}{
+		{"strip", RewriteConfig{StripPrefix: "/payment"}, "/payment/42", "/42", "/payment/42", true},
+		{"strip the whole path", RewriteConfig{StripPrefix: "/payment"}, "/payment", "/", "/payment/", true},
+		{"strip only on a segment boundary", RewriteConfig{StripPrefix: "/payment"}, "/paymentfoo", "/paymentfoo", "/payment/paymentfoo", true},
+		{"add", RewriteConfig{AddPrefix: "/api/v2"}, "/user/1", "/api/v2/user/1", "/user/1", true},
+		{"strip and add", RewriteConfig{StripPrefix: "/user", AddPrefix: "/v2/users"}, "/user/1", "/v2/users/1", "/user/1", true},
+		{"regex cannot be undone", RewriteConfig{Regex: []RegexRewrite{{Match: `^/user/(\d+)$`, Replace: "/users/$1"}}}, "/user/7", "/users/7", "/users/7", false},
+	}
+	for _, tt := range tests {
+		p, err := newPathRewriter(&tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := p.rewrite(tt.path); got != tt.upstream {
+			t.Errorf("%s: rewrite %q to %q, want %q", tt.name, tt.path, got, tt.upstream)
+		}
+		back, ok := p.reverse(tt.upstream)
+		if back != tt.back || ok != tt.reverses {
+			t.Errorf("%s: reverse %q to %q, %v, want %q, %v", tt.name, tt.upstream, back, ok, tt.back, tt.reverses)
+		}
+	}
+
+	// Upstream paths outside the added prefix are not the route's to map back
+	p, _ := newPathRewriter(&RewriteConfig{AddPrefix: "/api"})
+	if got, ok := p.reverse("/apiary/1"); ok {
+		t.Errorf("reverse of a path outside the added prefix gave %q", got)
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	upstreamHosts := map[string]bool{"10.0.0.1:8003": true}
+	tests := []struct {
+		name     string
+		cfg      RewriteConfig
+		location string
+		cookie   string
+		wantLoc  string
+		wantPath string
+	}{
+		{
+			name:     "relative redirect",
+			cfg:      RewriteConfig{StripPrefix: "/payment"},
+			location: "/receipts/9?format=pdf", wantLoc: "/payment/receipts/9?format=pdf",
+		},
+		{
+			name:     "absolute redirect to the upstream",
+			cfg:      RewriteConfig{StripPrefix: "/payment"},
+			location: "http://10.0.0.1:8003/receipts/9", wantLoc: "/payment/receipts/9",
+		},
+		{
+			name:     "redirect elsewhere is left alone",
+			cfg:      RewriteConfig{StripPrefix: "/payment"},
+			location: "https://bank.example.com/receipts/9", wantLoc: "https://bank.example.com/receipts/9",
+		},
+		{
+			name:     "redirect outside the added prefix is left alone",
+			cfg:      RewriteConfig{AddPrefix: "/api"},
+			location: "/apiary/1", wantLoc: "/apiary/1",
+		},
+		{
+			name:   "cookie path",
+			cfg:    RewriteConfig{StripPrefix: "/payment", AddPrefix: "/v1"},
+			cookie: "sid=1; Path=/v1/cart", wantPath: "/payment/cart",
+		},
+		{
+			name:   "root cookie path",
+			cfg:    RewriteConfig{StripPrefix: "/payment"},
+			cookie: "sid=1; Path=/", wantPath: "/payment/",
+		},
+		{
+			name:   "cookie without a path",
+			cfg:    RewriteConfig{StripPrefix: "/payment"},
+			cookie: "sid=1", wantPath: "",
+		},
+		{
+			name:   "cookie path under a regex rewrite",
+			cfg:    RewriteConfig{Regex: []RegexRewrite{{Match: "^/pay/", Replace: "/payment/"}}},
+			cookie: "sid=1; Path=/payment", wantPath: "/payment",
+		},
+	}
+	for _, tt := range tests {
+		p, err := newPathRewriter(&tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp := &http.Response{Header: http.Header{}}
+		if tt.location != "" {
+			resp.Header.Set("Location", tt.location)
+		}
+		if tt.cookie != "" {
+			resp.Header.Add("Set-Cookie", tt.cookie)
+		}
+		p.rewriteResponse(resp, upstreamHosts)
+
+		if got := resp.Header.Get("Location"); got != tt.wantLoc {
+			t.Errorf("%s: Location %q, want %q", tt.name, got, tt.wantLoc)
+		}
+		if tt.cookie == "" {
+			continue
+		}
+		cookies := (&http.Response{Header: resp.Header}).Cookies()
+		if len(cookies) != 1 || cookies[0].Path != tt.wantPath {
+			t.Errorf("%s: cookies %v, want one with path %q", tt.name, cookies, tt.wantPath)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shadowHeader marks mirrored requests so the shadow service can tell them apart
+const shadowHeader = "X-Shadow-Request"
+
+// alwaysIgnoredHeaders differ between any two responses and are never compared
+var alwaysIgnoredHeaders = []string{"Date", "Content-Length", "Age", requestIDHeader, servedVersionHeader}
+
+// ShadowConfig mirrors a sample of a route's traffic to a second upstream.
+// Shadow responses never reach the client; they are only compared with the
+// primary response and the differences recorded.
+type ShadowConfig struct {
+	// URL is the shadow upstream, e.g. the rewritten service under test
+	URL string `json:"url"`
+
+	// SampleRate is the fraction of requests mirrored, from 0 to 1
+	SampleRate float64 `json:"sample_rate"`
+
+	// MaxBodyBytes bounds the request and response bodies that are kept for
+	// mirroring and comparison; requests with larger bodies are not mirrored
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+
+	// Timeout bounds each shadow request
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// MaxConcurrent caps outstanding shadow requests; beyond it requests are not mirrored
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// IgnoreHeaders are response headers not compared, on top of Date, Content-Length and the like
+	IgnoreHeaders []string `json:"ignore_headers,omitempty"`
+
+	// IgnoreFields are JSON body fields not compared: a key name such as
+	// "created_at" anywhere in the body, or a path such as "$.payment.id"
+	IgnoreFields []string `json:"ignore_fields,omitempty"`
+
+	// MaxMismatches is how many recent mismatches are kept for review
+	MaxMismatches int `json:"max_mismatches,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c ShadowConfig) withDefaults() ShadowConfig {
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 1 << 20
+	}
+	if c.Timeout == 0 {
+		c.Timeout = Duration(5 * time.Second)
+	}
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 100
+	}
+	if c.MaxMismatches == 0 {
+		c.MaxMismatches = 100
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c ShadowConfig) validate() error {
+	if _, err := parseUpstream(c.URL); err != nil {
+		return fmt.Errorf("shadow: %w", err)
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		return fmt.Errorf("shadow sample_rate must be above 0 and at most 1, not %v", c.SampleRate)
+	}
+	if c.MaxBodyBytes < 0 || c.Timeout < 0 || c.MaxConcurrent < 0 || c.MaxMismatches < 0 {
+		return errors.New("shadow limits must not be negative")
+	}
+	return nil
+}
+
+// shadowMismatch is one request whose shadow response differed from the primary
+type shadowMismatch struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	PrimaryStatus int       `json:"primary_status"`
+	ShadowStatus  int       `json:"shadow_status"`
+	ShadowError   string    `json:"shadow_error,omitempty"`
+	Headers       []string  `json:"headers,omitempty"`
+	Body          []string  `json:"body,omitempty"`
+}
+
+// shadowRequest is what is kept of a primary request to replay it
+type shadowRequest struct {
+	id       string
+	method   string
+	path     string
+	rawPath  string
+	rawQuery string
+	header   http.Header
+	body     []byte
+}
+
+// shadower mirrors one route's traffic and compares the answers
+type shadower struct {
+	route  string
+	cfg    ShadowConfig
+	target *url.URL
+	client *http.Client
+
+	ignoreHeaders map[string]bool
+	ignoreFields  map[string]bool
+
+	inflight   atomic.Int64
+	mirrored   atomic.Int64
+	matched    atomic.Int64
+	mismatched atomic.Int64
+	failed     atomic.Int64
+	skipped    atomic.Int64
+
+	mu         sync.Mutex
+	mismatches []shadowMismatch
+}
+
+// newShadower returns the route's shadower, or nil when the route has no shadow
+func newShadower(rc RouteConfig, tlsConfig *tls.Config) (*shadower, error) {
+	if rc.Shadow == nil {
+		return nil, nil
+	}
+	cfg := rc.Shadow.withDefaults()
+	target, err := parseUpstream(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &shadower{
+		route:  rc.Name,
+		cfg:    cfg,
+		target: target,
+		client: &http.Client{
+			Transport: newBaseTransport(TimeoutConfig{}, tlsConfig),
+			Timeout:   time.Duration(cfg.Timeout),
+			// Redirects are part of the answer being compared, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		ignoreHeaders: make(map[string]bool),
+		ignoreFields:  make(map[string]bool),
+	}
+	for _, h := range append(alwaysIgnoredHeaders, cfg.IgnoreHeaders...) {
+		s.ignoreHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, f := range cfg.IgnoreFields {
+		s.ignoreFields[f] = true
+	}
+	return s, nil
+}
+
+// mirror sends the request with send as usual and, if it is sampled, replays
+// it against the shadow once the primary response has been fully read. The
+// client never waits for the shadow.
+func (s *shadower) mirror(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if rand.Float64() >= s.cfg.SampleRate || streamKind(req) != "" {
+		return send(req)
+	}
+
+	// Protect the gateway: when the shadow is slow, stop mirroring rather than pile up requests
+	if s.inflight.Add(1) > int64(s.cfg.MaxConcurrent) {
+		s.inflight.Add(-1)
+		s.skipped.Add(1)
+		return send(req)
+	}
+	release := func() { s.inflight.Add(-1) }
+
+	body, ok, err := bufferBody(req, s.cfg.MaxBodyBytes)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if !ok {
+		release()
+		s.skipped.Add(1)
+		return send(req)
+	}
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// Keep the request as the primary upstream receives it: rewritten and with the route's headers
+	sr := shadowRequest{
+		id:       requestID(req),
+		method:   req.Method,
+		path:     req.URL.Path,
+		rawPath:  req.URL.RawPath,
+		rawQuery: req.URL.RawQuery,
+		header:   req.Header.Clone(),
+		body:     body,
+	}
+
+	resp, err := send(req)
+	if err != nil {
+		// Nothing to compare against; the shadow is not worth the load
+		release()
+		return nil, err
+	}
+
+	status, header := resp.StatusCode, resp.Header.Clone()
+	resp.Body = &captureBody{ReadCloser: resp.Body, limit: s.cfg.MaxBodyBytes, done: func(primary []byte, complete bool) {
+		if !complete {
+			release()
+			s.skipped.Add(1)
+			return
+		}
+		go func() {
+			defer release()
+			s.compare(sr, status, header, primary)
+		}()
+	}}
+	return resp, nil
+}
+
+// compare replays the request against the shadow and records how its answer differs
+func (s *shadower) compare(sr shadowRequest, status int, header http.Header, body []byte) {
+	s.mirrored.Add(1)
+	m := shadowMismatch{
+		Time:          time.Now(),
+		RequestID:     sr.id,
+		Method:        sr.method,
+		Path:          sr.path,
+		PrimaryStatus: status,
+	}
+
+	shadowCode, shadowHdr, shadowBody, err := s.send(sr)
+	if err != nil {
+		s.failed.Add(1)
+		m.ShadowError = err.Error()
+		s.record(m)
+		return
+	}
+	m.ShadowStatus = shadowCode
+	m.Headers = s.diffHeaders(header, shadowHdr)
+	switch {
+	case shadowBody == nil || body == nil:
+		// One of the bodies was too large to keep; there is nothing fair to compare
+	case isJSON(header) && isJSON(shadowHdr):
+		m.Body = s.diffJSON(body, shadowBody)
+	case !bytes.Equal(body, shadowBody):
+		m.Body = []string{fmt.Sprintf("body differs: %d vs %d bytes", len(body), len(shadowBody))}
+	}
+
+	if m.PrimaryStatus == m.ShadowStatus && len(m.Headers) == 0 && len(m.Body) == 0 {
+		s.matched.Add(1)
+		return
+	}
+	s.mismatched.Add(1)
+	s.record(m)
+}
+
+// send replays a request against the shadow upstream
+func (s *shadower) send(sr shadowRequest) (int, http.Header, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.Timeout))
+	defer cancel()
+
+	u := *s.target
+	u.Path, u.RawPath = joinURLPath(s.target, &url.URL{Path: sr.path, RawPath: sr.rawPath})
+	u.RawQuery = sr.rawQuery
+
+	req, err := http.NewRequestWithContext(ctx, sr.method, u.String(), bytes.NewReader(sr.body))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header = sr.header.Clone()
+	req.Header.Del(deadlineHeader)
+	req.Header.Set(shadowHeader, "true")
+	if sr.body == nil {
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, s.cfg.MaxBodyBytes+1))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if int64(len(body)) > s.cfg.MaxBodyBytes {
+		body = nil
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
+
+// record keeps a mismatch for review, dropping the oldest once the list is full
+func (s *shadower) record(m shadowMismatch) {
+	log.Printf("🪞 Shadow mismatch on %s [%s] %s %s: status %d vs %d%s%s%s", s.route, m.RequestID, m.Method, m.Path,
+		m.PrimaryStatus, m.ShadowStatus, prefixed("; error: ", m.ShadowError),
+		prefixed("; headers: ", strings.Join(m.Headers, ", ")), prefixed("; body: ", strings.Join(m.Body, ", ")))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mismatches = append(s.mismatches, m)
+	if over := len(s.mismatches) - s.cfg.MaxMismatches; over > 0 {
+		s.mismatches = append([]shadowMismatch(nil), s.mismatches[over:]...)
+	}
+}
+
+// inherit carries the counters and recent mismatches of the route's previous
+// shadower over a reload, as long as it mirrored to the same target
+func (s *shadower) inherit(old *shadower) {
+	if s == nil || old == nil || s.target.String() != old.target.String() {
+		return
+	}
+	s.mirrored.Store(old.mirrored.Load())
+	s.matched.Store(old.matched.Load())
+	s.mismatched.Store(old.mismatched.Load())
+	s.failed.Store(old.failed.Load())
+	s.skipped.Store(old.skipped.Load())
+
+	old.mu.Lock()
+	mismatches := append([]shadowMismatch(nil), old.mismatches...)
+	old.mu.Unlock()
+	if over := len(mismatches) - s.cfg.MaxMismatches; over > 0 {
+		mismatches = mismatches[over:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mismatches = mismatches
+}
+
+// prefixed returns prefix+s, or "" when s is empty
+func prefixed(prefix, s string) string {
+	if s == "" {
+		return ""
+	}
+	return prefix + s
+}
+
+// ==================== DIFFING ====================
+
+// maxDiffs bounds how many differences are listed for one response
+const maxDiffs = 20
+
+// diffHeaders lists the headers whose values differ, ignoring the configured ones
+func (s *shadower) diffHeaders(primary, shadow http.Header) []string {
+	names := make(map[string]bool)
+	for k := range primary {
+		names[k] = true
+	}
+	for k := range shadow {
+		names[k] = true
+	}
+
+	var diffs []string
+	for _, k := range sortedNames(names) {
+		if s.ignoreHeaders[k] {
+			continue
+		}
+		a, b := strings.Join(primary.Values(k), ", "), strings.Join(shadow.Values(k), ", ")
+		if a != b && len(diffs) < maxDiffs {
+			diffs = append(diffs, fmt.Sprintf("%s: %q vs %q", k, a, b))
+		}
+	}
+	return diffs
+}
+
+// diffJSON lists the differing fields of two JSON bodies by path, e.g. "$.amount: 10 vs 12"
+func (s *shadower) diffJSON(primary, shadow []byte) []string {
+	var a, b interface{}
+	errA, errB := json.Unmarshal(primary, &a), json.Unmarshal(shadow, &b)
+	switch {
+	case errA != nil && errB != nil:
+		if bytes.Equal(primary, shadow) {
+			return nil
+		}
+		return []string{"bodies differ and neither is valid JSON"}
+	case errA != nil:
+		return []string{"primary body is not valid JSON"}
+	case errB != nil:
+		return []string{"shadow body is not valid JSON"}
+	}
+
+	var diffs []string
+	s.diffValue("$", "", a, b, &diffs)
+	return diffs
+}
+
+// diffValue compares two decoded JSON values, appending a line per difference
+func (s *shadower) diffValue(path, key string, a, b interface{}, diffs *[]string) {
+	if len(*diffs) >= maxDiffs || s.ignoreFields[path] || (key != "" && s.ignoreFields[key]) {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		for _, k := range sortedNames(keys) {
+			p := path + "." + k
+			if s.ignoreFields[p] || s.ignoreFields[k] {
+				continue
+			}
+			x, inA := av[k]
+			y, inB := bv[k]
+			switch {
+			case !inB:
+				s.addDiff(diffs, "%s: missing in shadow", p)
+			case !inA:
+				s.addDiff(diffs, "%s: only in shadow", p)
+			default:
+				s.diffValue(p, k, x, y, diffs)
+			}
+		}
+		return
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(av) != len(bv) {
+			s.addDiff(diffs, "%s: %d vs %d elements", path, len(av), len(bv))
+		}
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			s.diffValue(fmt.Sprintf("%s[%d]", path, i), "", av[i], bv[i], diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		s.addDiff(diffs, "%s: %s vs %s", path, compactJSON(a), compactJSON(b))
+	}
+}
+
+// addDiff appends one difference unless the list is already full
+func (s *shadower) addDiff(diffs *[]string, format string, args ...interface{}) {
+	if len(*diffs) < maxDiffs {
+		*diffs = append(*diffs, fmt.Sprintf(format, args...))
+	}
+}
+
+// compactJSON renders a value for a diff line, shortened if long
+func compactJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 80 {
+		return string(b[:77]) + "..."
+	}
+	return string(b)
+}
+
+// isJSON reports whether a response claims a JSON body
+func isJSON(h http.Header) bool {
+	ct := strings.ToLower(h.Get("Content-Type"))
+	return strings.Contains(ct, "application/json") || strings.Contains(ct, "+json")
+}
+
+// sortedNames returns the keys of a set in order
+func sortedNames(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// captureBody passes a response body through to the client while keeping a
+// copy, and reports it once the body is closed
+type captureBody struct {
+	io.ReadCloser
+	limit    int64
+	buf      bytes.Buffer
+	overflow bool
+	eof      bool
+	done     func(body []byte, complete bool)
+	once     sync.Once
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.overflow {
+		if int64(c.buf.Len()+n) > c.limit {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// Close reports the body: complete when it was read to the end, and nil when it was too large to keep
+func (c *captureBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() {
+		var body []byte
+		if !c.overflow {
+			body = c.buf.Bytes()
+			if body == nil {
+				body = []byte{}
+			}
+		}
+		c.done(body, c.eof)
+	})
+	return err
+}
+
+// ==================== ADMIN ENDPOINT ====================
+
+// shadowStatus is the admin view of one route's shadowing
+type shadowStatus struct {
+	Route      string           `json:"route"`
+	Target     string           `json:"target"`
+	SampleRate float64          `json:"sample_rate"`
+	Mirrored   int64            `json:"mirrored"`
+	Matched    int64            `json:"matched"`
+	Mismatched int64            `json:"mismatched"`
+	Failed     int64            `json:"failed"`
+	Skipped    int64            `json:"skipped"`
+	Mismatches []shadowMismatch `json:"mismatches"`
+}
+
+// status returns the counters and the recent mismatches, newest first
+func (s *shadower) status() shadowStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := shadowStatus{
+		Route:      s.route,
+		Target:     s.target.String(),
+		SampleRate: s.cfg.SampleRate,
+		Mirrored:   s.mirrored.Load(),
+		Matched:    s.matched.Load(),
+		Mismatched: s.mismatched.Load(),
+		Failed:     s.failed.Load(),
+		Skipped:    s.skipped.Load(),
+		Mismatches: make([]shadowMismatch, 0, len(s.mismatches)),
+	}
+	for i := len(s.mismatches) - 1; i >= 0; i-- {
+		st.Mismatches = append(st.Mismatches, s.mismatches[i])
+	}
+	return st
+}
+
+// shadowHandler serves the shadowing admin API:
+//
+//	GET    /gateway/shadow   counters and recent mismatches of every shadowed route
+//	DELETE /gateway/shadow   forget the recorded mismatches
+func (g *Gateway) shadowHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		out := []shadowStatus{}
+		for _, p := range g.table.Load().pools {
+			if p.shadow != nil {
+				out = append(out, p.shadow.status())
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodDelete:
+		for _, p := range g.table.Load().pools {
+			if p.shadow != nil {
+				p.shadow.mu.Lock()
+				p.shadow.mismatches = nil
+				p.shadow.mu.Unlock()
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
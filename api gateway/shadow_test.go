@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testShadower returns a shadower mirroring to target at the given sample rate
+func testShadower(t *testing.T, target string, rate float64, ignoreHeaders, ignoreFields []string) *shadower {
+	t.Helper()
+	s, err := newShadower(RouteConfig{Name: "user", Shadow: &ShadowConfig{
+		URL:           target,
+		SampleRate:    rate,
+		IgnoreHeaders: ignoreHeaders,
+		IgnoreFields:  ignoreFields,
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// primaryAnswer returns a send function standing in for the primary upstream
+func primaryAnswer(status int, contentType, body string) func(*http.Request) (*http.Response, error) {
+	return func(*http.Request) (*http.Response, error) {
+		h := http.Header{"Content-Type": {contentType}}
+		return &http.Response{StatusCode: status, Header: h, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+}
+
+// mirrorAndRead sends one request through the shadower and reads the primary answer to the end
+func mirrorAndRead(t *testing.T, s *shadower, r *http.Request, send func(*http.Request) (*http.Response, error)) string {
+	t.Helper()
+	resp, err := s.mirror(r, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return string(body)
+}
+
+// waitShadows waits until no shadow request is outstanding
+func waitShadows(t *testing.T, s *shadower) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.inflight.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("shadow requests still outstanding")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShadowSampling(t *testing.T) {
+	var hits atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(shadowHeader) != "true" {
+			t.Error("mirrored request not marked as a shadow request")
+		}
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	for _, rate := range []float64{0.25, 1} {
+		hits.Store(0)
+		s := testShadower(t, target.URL, rate, nil, nil)
+		const n = 600
+		for i := 0; i < n; i++ {
+			mirrorAndRead(t, s, httptest.NewRequest("GET", "/user/1", nil), primaryAnswer(200, "text/plain", "ok"))
+			waitShadows(t, s)
+		}
+		if got := float64(hits.Load()) / n; got < rate-0.07 || got > rate+0.07 {
+			t.Errorf("rate %v: mirrored %.3f of requests", rate, got)
+		}
+		if st := s.status(); st.Mirrored != hits.Load() || st.Matched != st.Mirrored {
+			t.Errorf("rate %v: status %+v for %d mirrored requests", rate, st, hits.Load())
+		}
+	}
+
+	// Streams are never mirrored
+	hits.Store(0)
+	s := testShadower(t, target.URL, 1, nil, nil)
+	r := httptest.NewRequest("GET", "/user/events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	mirrorAndRead(t, s, r, primaryAnswer(200, "text/event-stream", ""))
+	waitShadows(t, s)
+	if hits.Load() != 0 {
+		t.Error("event stream was mirrored")
+	}
+}
+
+func TestShadowDiff(t *testing.T) {
+	s := testShadower(t, "http://10.0.0.9:8002", 1, []string{"X-Build"}, []string{"created_at", "$.payment.id"})
+
+	headerTests := []struct {
+		name            string
+		primary, shadow http.Header
+		want            []string
+	}{
+		{"same", http.Header{"Content-Type": {"application/json"}}, http.Header{"Content-Type": {"application/json"}}, nil},
+		{"always ignored", http.Header{"Date": {"Mon"}, "Content-Length": {"10"}}, http.Header{"Date": {"Tue"}, "Content-Length": {"12"}}, nil},
+		{"configured ignore", http.Header{"X-Build": {"1"}}, http.Header{"X-Build": {"2"}}, nil},
+		{"changed", http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Cache-Control": {"no-store"}}, []string{`Cache-Control: "max-age=60" vs "no-store"`}},
+		{"missing", http.Header{"Etag": {`"v1"`}}, http.Header{}, []string{`Etag: "\"v1\"" vs ""`}},
+	}
+	for _, tt := range headerTests {
+		if got := s.diffHeaders(tt.primary, tt.shadow); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("headers %s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	bodyTests := []struct {
+		name            string
+		primary, shadow string
+		want            []string
+	}{
+		{"same", `{"id": 1, "amount": 10}`, `{"amount": 10, "id": 1}`, nil},
+		{"changed value", `{"amount": 10}`, `{"amount": 12}`, []string{"$.amount: 10 vs 12"}},
+		{"missing and extra fields", `{"a": 1}`, `{"b": 1}`, []string{"$.a: missing in shadow", "$.b: only in shadow"}},
+		{"ignored key anywhere", `{"x": {"created_at": "mon"}}`, `{"x": {"created_at": "tue"}}`, nil},
+		{"ignored path", `{"payment": {"id": "p1", "total": 5}}`, `{"payment": {"id": "p2", "total": 5}}`, nil},
+		{"ignored path only at that path", `{"order": {"id": "o1"}}`, `{"order": {"id": "o2"}}`, []string{`$.order.id: "o1" vs "o2"`}},
+		{"array length", `{"items": [1, 2]}`, `{"items": [1]}`, []string{"$.items: 2 vs 1 elements"}},
+		{"shadow not JSON", `{}`, `oops`, []string{"shadow body is not valid JSON"}},
+	}
+	for _, tt := range bodyTests {
+		if got := s.diffJSON([]byte(tt.primary), []byte(tt.shadow)); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("body %s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShadowDoesNotAffectPrimary(t *testing.T) {
+	// The shadow is slow and answers differently
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"amount": 12}`)
+	}))
+	defer target.Close()
+	s := testShadower(t, target.URL, 1, nil, nil)
+
+	start := time.Now()
+	body := mirrorAndRead(t, s, httptest.NewRequest("GET", "/user/1", nil), primaryAnswer(200, "application/json", `{"amount": 10}`))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("client waited %v for the primary answer", elapsed)
+	}
+	if body != `{"amount": 10}` {
+		t.Errorf("client got %q, want the primary body", body)
+	}
+
+	waitShadows(t, s)
+	st := s.status()
+	if st.Mismatched != 1 || len(st.Mismatches) != 1 {
+		t.Fatalf("status %+v, want one mismatch", st)
+	}
+	m := st.Mismatches[0]
+	if m.PrimaryStatus != 200 || m.ShadowStatus != 500 || strings.Join(m.Body, "|") != "$.amount: 10 vs 12" {
+		t.Errorf("mismatch %+v", m)
+	}
+
+	// An unreachable shadow is recorded as a failure, and the client still gets its answer
+	target.Close()
+	body = mirrorAndRead(t, s, httptest.NewRequest("GET", "/user/2", nil), primaryAnswer(200, "text/plain", "fine"))
+	waitShadows(t, s)
+	if body != "fine" || s.status().Failed != 1 {
+		t.Errorf("with the shadow down: body %q, %d failures", body, s.status().Failed)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamGroup tracks the gateway's open streams so they can be ended on
+// shutdown: http.Server.Shutdown neither interrupts an SSE response nor
+// waits for a hijacked WebSocket connection
+type streamGroup struct {
+	closing chan struct{}
+	once    sync.Once
+	open    atomic.Int64
+}
+
+func newStreamGroup() *streamGroup {
+	return &streamGroup{closing: make(chan struct{})}
+}
+
+// close tells every open stream to end and refuses new ones
+func (sg *streamGroup) close() {
+	sg.once.Do(func() { close(sg.closing) })
+}
+
+// closed reports whether close has been called
+func (sg *streamGroup) closed() bool {
+	select {
+	case <-sg.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until every stream has ended or ctx is done
+func (sg *streamGroup) wait(ctx context.Context) error {
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for sg.open.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// shutdown stops the gateway gracefully. Health checks start failing at
+// once; after the configured delay the servers stop accepting connections,
+// streams are ended, and in-flight requests get the grace period to finish.
+// Anything still open after that is cut off and an error returned.
+func (g *Gateway) shutdown(reason string, servers ...*http.Server) error {
+	cfg := g.Config().Server
+	grace := time.Duration(cfg.ShutdownGrace)
+	if grace <= 0 {
+		grace = 30 * time.Second
+	}
+
+	g.stopping.Store(true)
+	log.Printf("🛑 %s: shutting down, in-flight requests have %v to finish", reason, grace)
+
+	if delay := time.Duration(cfg.ShutdownDelay); delay > 0 {
+		log.Printf("⏳ Reporting not ready for %v before closing the listeners", delay)
+		for _, srv := range servers {
+			srv.SetKeepAlivesEnabled(false)
+		}
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	done := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { done <- srv.Shutdown(ctx) }()
+	}
+	var err error
+	for range servers {
+		err = errors.Join(err, <-done)
+	}
+	if err == nil {
+		err = g.streams.wait(ctx)
+	}
+
+	// Health checks and key refreshes have nobody left to serve
+	g.table.Load().close()
+
+	if err != nil {
+		for _, srv := range servers {
+			srv.Close()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("grace period of %v ran out with requests still in flight; they were cut off", grace)
+		}
+		return err
+	}
+
+	log.Printf("👋 All requests finished, gateway stopped")
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// upstreamStatus is the debug view of one upstream instance
+type upstreamStatus struct {
+	URL      string `json:"url"`
+	Version  string `json:"version,omitempty"`
+	Weight   int    `json:"weight"`
+	InFlight int64  `json:"in_flight"`
+	Requests int64  `json:"requests"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining,omitempty"`
+	Ejected  bool   `json:"ejected,omitempty"`
+	Circuit  string `json:"circuit,omitempty"`
+}
+
+// poolStatus is the debug view of one route's pool
+type poolStatus struct {
+	Route     string           `json:"route"`
+	Strategy  string           `json:"strategy"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+// status returns a snapshot of the pool's counters
+func (p *Pool) status() poolStatus {
+	ps := poolStatus{Route: p.Route, Strategy: p.Strategy}
+	for _, u := range p.Upstreams {
+		ps.Upstreams = append(ps.Upstreams, upstreamStatus{
+			URL:      u.URL.String(),
+			Version:  u.Version,
+			Weight:   u.Weight,
+			InFlight: u.InFlight(),
+			Requests: u.requests.Load(),
+			Healthy:  u.Healthy(),
+			Draining: u.Draining(),
+			Ejected:  p.outlier.ejected(u),
+			Circuit:  u.breaker.State(),
+		})
+	}
+	return ps
+}
+
+// upstreamsHandler serves GET /gateway/upstreams with per-instance in-flight counters
+func (g *Gateway) upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	var out []poolStatus
+	for _, p := range g.table.Load().pools {
+		out = append(out, p.status())
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// writeJSON sends v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
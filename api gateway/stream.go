@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StreamConfig bounds long-lived connections on a route: WebSocket upgrades
+// and Server-Sent Events. They skip the route's request timeout and the
+// server's read/write timeouts, so these limits are what keeps them in check.
+type StreamConfig struct {
+	// IdleTimeout closes a stream after this long without data in either direction
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+
+	// MaxLifetime closes a stream after this long, however busy it is
+	MaxLifetime Duration `json:"max_lifetime,omitempty"`
+
+	// MaxConcurrent caps the route's open streams; further ones get a 503
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c StreamConfig) withDefaults() StreamConfig {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = Duration(5 * time.Minute)
+	}
+	if c.MaxLifetime == 0 {
+		c.MaxLifetime = Duration(time.Hour)
+	}
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 1000
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c StreamConfig) validate() error {
+	if c.IdleTimeout < 0 || c.MaxLifetime < 0 {
+		return errors.New("streams timeouts must not be negative")
+	}
+	if c.MaxConcurrent < 0 {
+		return errors.New("streams max_concurrent must not be negative")
+	}
+	return nil
+}
+
+// streamKind tells a stream request apart from an ordinary one: it returns
+// the upgrade protocol (e.g. "websocket"), "sse", or "" for a normal request
+func streamKind(r *http.Request) string {
+	if up := r.Header.Get("Upgrade"); up != "" && headerHasToken(r.Header, "Connection", "upgrade") {
+		return strings.ToLower(up)
+	}
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return "sse"
+	}
+	return ""
+}
+
+// headerHasToken reports whether a comma-separated header contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withStreams sends stream requests to stream and everything else to next.
+// Streams bypass the cache and request timeout that next applies, and are
+// instead bounded by the route's idle timeout, lifetime and concurrency cap.
+// Every stream joins group so the gateway can end it on shutdown.
+func withStreams(route string, cfg StreamConfig, group *streamGroup, stream, next http.Handler) http.Handler {
+	cfg = cfg.withDefaults()
+	var active atomic.Int64
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := streamKind(r)
+		if kind == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if group.closed() {
+			log.Printf("🚫 %s [%s] %s stream refused: gateway shutting down", route, requestID(r), kind)
+			writeJSON(w, http.StatusServiceUnavailable, errorDocument{
+				Error:     "shutting_down",
+				Message:   "gateway is shutting down",
+				Status:    http.StatusServiceUnavailable,
+				Route:     route,
+				RequestID: requestID(r),
+			})
+			return
+		}
+
+		if n := active.Add(1); n > int64(cfg.MaxConcurrent) {
+			active.Add(-1)
+			log.Printf("🚫 %s [%s] %s stream refused: %d streams already open", route, requestID(r), kind, cfg.MaxConcurrent)
+			writeJSON(w, http.StatusServiceUnavailable, errorDocument{
+				Error:     "too_many_streams",
+				Message:   fmt.Sprintf("route already has %d open streams", cfg.MaxConcurrent),
+				Status:    http.StatusServiceUnavailable,
+				Route:     route,
+				RequestID: requestID(r),
+			})
+			return
+		}
+		defer active.Add(-1)
+		group.open.Add(1)
+		defer group.open.Add(-1)
+
+		// The server's read/write timeouts are sized for ordinary requests and
+		// would cut a healthy stream off; the idle timeout takes their place
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg.MaxLifetime))
+		defer cancel()
+
+		sw := &streamWriter{ResponseWriter: w, flush: kind == "sse"}
+		sw.touch()
+		go sw.watch(ctx, cancel, time.Duration(cfg.IdleTimeout), group.closing)
+
+		// Log when the stream ends rather than when its headers went out, so the
+		// line carries how long it lasted and why it stopped. It is deferred
+		// because the proxy aborts the handler with a panic on a broken stream.
+		start := time.Now()
+		defer func() {
+			reason := "closed"
+			switch {
+			case sw.idle.Load():
+				reason = "idle timeout"
+			case sw.shutdown.Load():
+				reason = "gateway shutting down"
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				reason = "max lifetime reached"
+			case r.Context().Err() != nil:
+				reason = "client went away"
+			}
+			log.Printf("🔌 %s stream %s [%s] %s ended after %v (%s): status %d, %d bytes in, %d bytes out",
+				kind, route, requestID(r), r.URL.Path, time.Since(start).Round(time.Millisecond), reason,
+				sw.status, sw.in.Load(), sw.out.Load())
+		}()
+
+		// The proxy aborts a response whose context is cancelled. An event
+		// stream ended by shutdown is finished properly instead, so the client
+		// sees a complete response and simply reconnects elsewhere.
+		defer func() {
+			if kind == "sse" && sw.shutdown.Load() {
+				if p := recover(); p != nil && p != http.ErrAbortHandler {
+					panic(p)
+				}
+			}
+		}()
+
+		stream.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// streamWriter tracks traffic on a stream, both before and after a
+// WebSocket upgrade takes the connection over, to enforce the idle timeout
+type streamWriter struct {
+	http.ResponseWriter
+
+	// flush pushes every write straight to the client; SSE events must not sit in a buffer
+	flush bool
+
+	status     int
+	lastActive atomic.Int64
+	in, out    atomic.Int64
+	idle       atomic.Bool
+	shutdown   atomic.Bool
+}
+
+// touch records activity on the stream
+func (sw *streamWriter) touch() {
+	sw.lastActive.Store(time.Now().UnixNano())
+}
+
+func (sw *streamWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.out.Add(int64(n))
+	sw.touch()
+	if sw.flush {
+		sw.Flush()
+	}
+	return n, err
+}
+
+// Flush passes through to the client connection
+func (sw *streamWriter) Flush() {
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// Hijack hands the proxy the client connection for an upgraded stream,
+// wrapped so traffic in both directions still counts as activity
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	sw.status = http.StatusSwitchingProtocols
+	return &streamConn{Conn: conn, sw: sw}, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// watch cancels the stream once nothing has moved for idle, or when closing
+// is closed because the gateway is shutting down. Cancelling also closes a
+// hijacked connection: the proxy tears an upgraded stream down with its context.
+func (sw *streamWriter) watch(ctx context.Context, cancel context.CancelFunc, idle time.Duration, closing <-chan struct{}) {
+	t := time.NewTimer(idle)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closing:
+			sw.shutdown.Store(true)
+			cancel()
+			return
+		case <-t.C:
+			left := idle - time.Since(time.Unix(0, sw.lastActive.Load()))
+			if left <= 0 {
+				sw.idle.Store(true)
+				cancel()
+				return
+			}
+			t.Reset(left)
+		}
+	}
+}
+
+// streamConn is a hijacked client connection that reports its traffic
+type streamConn struct {
+	net.Conn
+	sw *streamWriter
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.sw.in.Add(int64(n))
+		c.sw.touch()
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.sw.out.Add(int64(n))
+		c.sw.touch()
+	}
+	return n, err
+}
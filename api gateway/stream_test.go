@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logLines collects the gateway's log output until the test ends
+type logLines struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logLines) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// waitFor returns the first line containing substr, waiting up to a second for it
+func (l *logLines) waitFor(t *testing.T, substr string) string {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		out := l.buf.String()
+		l.mu.Unlock()
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, substr) {
+				return line
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no log line with %q in:\n%s", substr, out)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// captureLog sends the log to a logLines for the rest of the test
+func captureLog(t *testing.T) *logLines {
+	l := &logLines{}
+	log.SetOutput(l)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return l
+}
+
+// streamGateway serves the route "events" with withStreams in front of a
+// reverse proxy to backend; ordinary requests are answered by the gateway itself
+func streamGateway(t *testing.T, cfg StreamConfig, backend http.Handler) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "not a stream") })
+
+	gw := httptest.NewServer(withStreams("events", cfg, newStreamGroup(), httputil.NewSingleHostReverseProxy(target), next))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+// sseRequest opens an event stream on the gateway
+func sseRequest(t *testing.T, gw *httptest.Server) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", gw.URL+"/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestStreamSSE(t *testing.T) {
+	logs := captureLog(t)
+	release := make(chan struct{})
+	gw := streamGateway(t, StreamConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: two\n\n")
+	}))
+
+	// The first event reaches the client while the backend is still holding the stream open
+	resp := sseRequest(t, gw)
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	got := make(chan string)
+	go func() {
+		line, _ := lines.ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if line != "data: one\n" {
+			t.Fatalf("first event %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first event held back until the stream ends")
+	}
+
+	close(release)
+	rest, _ := io.ReadAll(lines)
+	if string(rest) != "\ndata: two\n\n" {
+		t.Errorf("rest of the stream %q", rest)
+	}
+	line := logs.waitFor(t, "sse stream events")
+	if !strings.Contains(line, "(closed): status 200") || !strings.Contains(line, "22 bytes out") {
+		t.Errorf("close logged as %q", line)
+	}
+
+	// Ordinary requests on the route skip the stream handling
+	plain, err := http.Get(gw.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(plain.Body)
+	plain.Body.Close()
+	if string(body) != "not a stream" {
+		t.Errorf("plain request answered %q", body)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	logs := captureLog(t)
+	gw := streamGateway(t, StreamConfig{IdleTimeout: Duration(50 * time.Millisecond)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+
+	resp := sseRequest(t, gw)
+	start := time.Now()
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("silent stream stayed open for %v", elapsed)
+	}
+	if line := logs.waitFor(t, "sse stream events"); !strings.Contains(line, "(idle timeout)") {
+		t.Errorf("close logged as %q", line)
+	}
+}
+
+func TestStreamMaxConcurrent(t *testing.T) {
+	captureLog(t)
+	gw := streamGateway(t, StreamConfig{MaxConcurrent: 1}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+
+	open := sseRequest(t, gw)
+	defer open.Body.Close()
+
+	refused := sseRequest(t, gw)
+	var doc errorDocument
+	json.NewDecoder(refused.Body).Decode(&doc)
+	refused.Body.Close()
+	if refused.StatusCode != http.StatusServiceUnavailable || doc.Error != "too_many_streams" {
+		t.Fatalf("second stream: %d %+v, want 503 too_many_streams", refused.StatusCode, doc)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	logs := captureLog(t)
+
+	// The backend accepts the upgrade and echoes whatever it is sent
+	gw := streamGateway(t, StreamConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gw.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: gateway\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade answered %d", resp.StatusCode)
+	}
+
+	fmt.Fprint(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo %q, %v", echo, err)
+	}
+	conn.Close()
+
+	line := logs.waitFor(t, "websocket stream events")
+	if !strings.Contains(line, "/chat ended after") || !strings.Contains(line, "status 101, 4 bytes in, 4 bytes out") {
+		t.Errorf("close logged as %q", line)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deadlineHeader carries the time a caller is still willing to wait, in
+// milliseconds, so the next hop can give up when the caller has
+const deadlineHeader = "X-Request-Timeout-Ms"
+
+// TimeoutConfig holds per-route limits on talking to the upstream
+type TimeoutConfig struct {
+	// Connect bounds establishing the TCP (and TLS) connection to an instance
+	Connect Duration `json:"connect,omitempty"`
+
+	// ResponseHeader bounds the wait for the upstream's response headers once the request is sent
+	ResponseHeader Duration `json:"response_header,omitempty"`
+
+	// Request bounds the whole request, retries and response body included
+	Request Duration `json:"request,omitempty"`
+}
+
+// ServerConfig holds the timeouts of the gateway's own listener
+type ServerConfig struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout,omitempty"`
+	ReadTimeout       Duration `json:"read_timeout,omitempty"`
+	WriteTimeout      Duration `json:"write_timeout,omitempty"`
+	IdleTimeout       Duration `json:"idle_timeout,omitempty"`
+
+	// ShutdownGrace is how long in-flight requests get to finish after SIGTERM (default 30s)
+	ShutdownGrace Duration `json:"shutdown_grace,omitempty"`
+
+	// ShutdownDelay keeps the gateway serving for this long after health
+	// checks start failing, so load balancers stop sending it traffic first
+	ShutdownDelay Duration `json:"shutdown_delay,omitempty"`
+}
+
+// newServer returns the gateway's HTTP server. WriteTimeout stays off unless
+// configured because it would cut long-lived streaming responses.
+func newServer(addr string, cfg ServerConfig, h http.Handler) *http.Server {
+	if cfg.ReadHeaderTimeout <= 0 {
+		cfg.ReadHeaderTimeout = Duration(5 * time.Second)
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = Duration(2 * time.Minute)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+}
+
+// newBaseTransport returns the HTTP transport a route uses to reach its
+// upstreams; tlsConfig, when set, is used for https instances
+func newBaseTransport(cfg TimeoutConfig, tlsConfig *tls.Config) *http.Transport {
+	connect := time.Duration(cfg.Connect)
+	if connect <= 0 {
+		connect = 30 * time.Second
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = connect
+	t.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeader)
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig.Clone()
+	}
+	return t
+}
+
+// withDeadline bounds each request by the route's total timeout, or by the
+// caller's own deadline header when that is shorter
+func withDeadline(total time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := total
+		if caller, ok := parseDeadlineHeader(r.Header); ok && (d <= 0 || caller < d) {
+			d = caller
+		}
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setDeadlineHeader tells the upstream how long is left on the request's
+// context, and drops any value that arrived from the client otherwise
+func setDeadlineHeader(req *http.Request) {
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		req.Header.Del(deadlineHeader)
+		return
+	}
+	left := max(time.Until(deadline).Milliseconds(), 1)
+	req.Header.Set(deadlineHeader, strconv.FormatInt(left, 10))
+}
+
+// parseDeadlineHeader reads the caller's remaining time from the request
+func parseDeadlineHeader(h http.Header) (time.Duration, bool) {
+	v := h.Get(deadlineHeader)
+	if v == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
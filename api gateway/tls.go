@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers that tell the upstream which client certificate the caller presented
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// TLSConfig turns on TLS termination for the gateway's listener
+type TLSConfig struct {
+	// Certificates are served by SNI: each is picked for the names it covers,
+	// and the first one is used when the client sends no or an unknown name
+	Certificates []CertificateConfig `json:"certificates"`
+
+	// ClientCAFile is a PEM bundle of CAs trusted to sign client certificates;
+	// routes with client_cert only accept certificates that chain to it
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval Duration `json:"reload_interval,omitempty"`
+}
+
+// CertificateConfig is one certificate/key pair on disk
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// ClientCertConfig requires callers of a route to present a verified client certificate
+type ClientCertConfig struct {
+	// AllowedNames optionally restricts the certificate's common name or DNS names
+	AllowedNames []string `json:"allowed_names,omitempty"`
+}
+
+// UpstreamTLSConfig configures how a route's https upstreams are reached
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle of CAs trusted to sign the upstream's certificate;
+	// the system roots are used when it is empty
+	CAFile string `json:"ca_file,omitempty"`
+
+	// CertFile and KeyFile are the gateway's client certificate, for upstreams that require mTLS
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// ServerName overrides the name the upstream certificate is checked against
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// withDefaults fills in any setting the config file left out
+func (c TLSConfig) withDefaults() TLSConfig {
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = Duration(30 * time.Second)
+	}
+	return c
+}
+
+// validate rejects settings that cannot work
+func (c TLSConfig) validate() error {
+	if len(c.Certificates) == 0 {
+		return errors.New("tls needs at least one certificate")
+	}
+	for _, cc := range c.Certificates {
+		if cc.CertFile == "" || cc.KeyFile == "" {
+			return errors.New("tls certificates need both cert_file and key_file")
+		}
+	}
+	if c.ReloadInterval < 0 {
+		return errors.New("tls reload_interval must not be negative")
+	}
+	return nil
+}
+
+// validate rejects settings that cannot work
+func (c UpstreamTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("upstream_tls needs both cert_file and key_file, or neither")
+	}
+	return nil
+}
+
+// ==================== SERVER CERTIFICATES ====================
+
+// certStore holds the listener's certificates and client CAs, and swaps in
+// new ones when the files change so certificates can be renewed in place
+type certStore struct {
+	mu        sync.RWMutex
+	cfg       TLSConfig
+	certs     []*tls.Certificate
+	byName    map[string]*tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// newCertStore loads the certificates named in cfg
+func newCertStore(cfg TLSConfig) (*certStore, error) {
+	s := &certStore{}
+	if err := s.load(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads every file in cfg and installs them together; on any error the
+// certificates in use are kept
+func (s *certStore) load(cfg TLSConfig) error {
+	cfg = cfg.withDefaults()
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+
+	var certs []*tls.Certificate
+	for _, cc := range cfg.Certificates {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls certificate %s: %w", cc.CertFile, err)
+		}
+		certs = append(certs, &cert)
+
+		// Index by every name the certificate covers; the first certificate wins a name
+		for _, name := range certNames(cert.Leaf) {
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		for _, f := range []string{cc.CertFile, cc.KeyFile} {
+			modTimes[f] = fileModTime(f)
+		}
+	}
+
+	var clientCAs *x509.CertPool
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = pool
+		modTimes[cfg.ClientCAFile] = fileModTime(cfg.ClientCAFile)
+	}
+
+	s.mu.Lock()
+	s.cfg, s.certs, s.byName, s.clientCAs, s.modTimes = cfg, certs, byName, clientCAs, modTimes
+	s.mu.Unlock()
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("🔐 Loaded %d TLS certificate(s) for %s", len(certs), strings.Join(names, ", "))
+	return nil
+}
+
+// certNames returns the lower-cased DNS names (or the common name) a certificate covers
+func certNames(leaf *x509.Certificate) []string {
+	if leaf == nil {
+		return nil
+	}
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = strings.ToLower(n)
+	}
+	return out
+}
+
+// serverConfig returns the listener's tls.Config. Everything is looked up
+// per handshake, so reloaded certificates and CAs apply to new connections.
+func (s *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				NextProtos:     []string{"h2", "http/1.1"},
+				GetCertificate: s.getCertificate,
+			}
+			// Certificates are checked when offered but only routes with
+			// client_cert insist on one, so other routes share the listener
+			if s.clientCAs != nil {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				cfg.ClientCAs = s.clientCAs
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// getCertificate picks the certificate for the SNI name: an exact match, then
+// a wildcard one level up, then the first certificate
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	if len(s.certs) == 0 {
+		return nil, errors.New("no TLS certificate configured")
+	}
+	return s.certs[0], nil
+}
+
+// watch reloads the certificates whenever one of their files changes
+func (s *certStore) watch() {
+	for {
+		s.mu.RLock()
+		interval := time.Duration(s.cfg.ReloadInterval)
+		s.mu.RUnlock()
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+
+		s.mu.RLock()
+		cfg, changed := s.cfg, false
+		for f, mt := range s.modTimes {
+			if !fileModTime(f).Equal(mt) {
+				changed = true
+			}
+		}
+		s.mu.RUnlock()
+
+		if changed {
+			if err := s.load(cfg); err != nil {
+				log.Printf("❌ Reloading TLS certificates: %v (keeping the current ones)", err)
+
+				// Wait for the files to change again rather than retrying a bad set every time
+				s.mu.Lock()
+				for f := range s.modTimes {
+					s.modTimes[f] = fileModTime(f)
+				}
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// fileModTime returns a file's mtime, or the zero time if it cannot be read
+func fileModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// ==================== CLIENT CERTIFICATES ====================
+
+// withClientCert rejects requests without a verified client certificate and
+// tells the upstream who the caller is. The identity headers are always
+// stripped from the client's request so they cannot be forged.
+func withClientCert(route string, cfg *ClientCertConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(clientCertSubjectHeader)
+		r.Header.Del(clientCertFingerprintHeader)
+
+		if cfg == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			clientCertError(w, r, route, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		if len(cfg.AllowedNames) > 0 && !certAllowed(leaf, cfg.AllowedNames) {
+			clientCertError(w, r, route, http.StatusForbidden, fmt.Sprintf("client certificate %q not allowed", leaf.Subject.CommonName))
+			return
+		}
+
+		sum := sha256.Sum256(leaf.Raw)
+		r.Header.Set(clientCertSubjectHeader, leaf.Subject.String())
+		r.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(sum[:]))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certAllowed reports whether the certificate's common name or one of its DNS names is allowed
+func certAllowed(leaf *x509.Certificate, allowed []string) bool {
+	if containsString(allowed, leaf.Subject.CommonName) {
+		return true
+	}
+	for _, name := range leaf.DNSNames {
+		if containsString(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCertError rejects a request at the edge with the gateway's JSON error document
+func clientCertError(w http.ResponseWriter, r *http.Request, route string, status int, msg string) {
+	class := "client_certificate_required"
+	if status == http.StatusForbidden {
+		class = "forbidden"
+	}
+	log.Printf("🚫 %s [%s] %s %s: %s", route, requestID(r), r.Method, r.URL.Path, msg)
+
+	writeJSON(w, status, errorDocument{
+		Error:     class,
+		Message:   msg,
+		Status:    status,
+		Route:     route,
+		RequestID: requestID(r),
+	})
+}
+
+// ==================== UPSTREAM TLS ====================
+
+// newUpstreamTLS builds the client-side TLS config for a route's upstreams,
+// or returns nil to use Go's defaults
+func newUpstreamTLS(cfg *UpstreamTLSConfig) (*tls.Config, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: %w", err)
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls certificate %s: %w", cfg.CertFile, err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
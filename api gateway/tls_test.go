@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority for issuing test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a leaf certificate usable by both servers and clients and
+// returns it and its key as PEM
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// tlsCert issues a leaf certificate ready for use in a tls.Config
+func (ca *testCA) tlsCert(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(ca.issue(t, cn, dnsNames...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeFile writes data to name in dir and returns the path
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeCert writes an issued certificate and key to dir and returns their config
+func writeCert(t *testing.T, dir, name string, certPEM, keyPEM []byte) CertificateConfig {
+	t.Helper()
+	return CertificateConfig{
+		CertFile: writeFile(t, dir, name+".crt", certPEM),
+		KeyFile:  writeFile(t, dir, name+".key", keyPEM),
+	}
+}
+
+// servedName returns the common name of the certificate picked for an SNI name
+func servedName(t *testing.T, s *certStore, sni string) string {
+	t.Helper()
+	cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatalf("getCertificate(%q): %v", sni, err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreGetCertificate(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	dir := t.TempDir()
+
+	defaultCrt, defaultKey := ca.issue(t, "default", "default.example.com")
+	apiCrt, apiKey := ca.issue(t, "api", "api.example.com", "API2.example.com")
+	wildCrt, wildKey := ca.issue(t, "wildcard", "*.example.org")
+	cnCrt, cnKey := ca.issue(t, "legacy.example.net")
+
+	s, err := newCertStore(TLSConfig{Certificates: []CertificateConfig{
+		writeCert(t, dir, "default", defaultCrt, defaultKey),
+		writeCert(t, dir, "api", apiCrt, apiKey),
+		writeCert(t, dir, "wildcard", wildCrt, wildKey),
+		writeCert(t, dir, "cn", cnCrt, cnKey),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sni  string
+		want string
+	}{
+		{"api.example.com", "api"},
+		{"api2.example.com", "api"},
+		{"API.Example.COM.", "api"},
+		{"shop.example.org", "wildcard"},
+		{"a.shop.example.org", "default"},
+		{"example.org", "default"},
+		{"legacy.example.net", "legacy.example.net"},
+		{"unknown.example.com", "default"},
+		{"", "default"},
+	}
+	for _, tt := range tests {
+		if got := servedName(t, s, tt.sni); got != tt.want {
+			t.Errorf("SNI %q: got certificate %q, want %q", tt.sni, got, tt.want)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	dir := t.TempDir()
+
+	oldCrt, oldKey := ca.issue(t, "old", "api.example.com")
+	cfg := TLSConfig{Certificates: []CertificateConfig{writeCert(t, dir, "api", oldCrt, oldKey)}}
+	s, err := newCertStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, s, "api.example.com"); got != "old" {
+		t.Fatalf("before reload: got %q, want old", got)
+	}
+
+	// A renewed certificate written over the old files is served after a reload
+	newCrt, newKey := ca.issue(t, "new", "api.example.com")
+	writeCert(t, dir, "api", newCrt, newKey)
+	if err := s.load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, s, "api.example.com"); got != "new" {
+		t.Fatalf("after reload: got %q, want new", got)
+	}
+
+	// A broken set is rejected and the certificate in use is kept
+	writeFile(t, dir, "api.key", []byte("not a key"))
+	if err := s.load(cfg); err == nil {
+		t.Fatal("reload with a broken key: want an error")
+	}
+	if got := servedName(t, s, "api.example.com"); got != "new" {
+		t.Fatalf("after failed reload: got %q, want new", got)
+	}
+}
+
+func TestWithClientCert(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	other := newTestCA(t, "other CA")
+	dir := t.TempDir()
+
+	srvCrt, srvKey := ca.issue(t, "gateway", "gateway.test")
+	s, err := newCertStore(TLSConfig{
+		Certificates: []CertificateConfig{writeCert(t, dir, "gateway", srvCrt, srvKey)},
+		ClientCAFile: writeFile(t, dir, "clients.pem", ca.pem),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream answers with the identity headers the gateway forwarded
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(clientCertSubjectHeader))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/open/", withClientCert("open", nil, upstream))
+	mux.Handle("/mtls/", withClientCert("mtls", &ClientCertConfig{AllowedNames: []string{"billing", "reports.internal"}}, upstream))
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = s.serverConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "gateway.test",
+			Certificates: certs,
+		}}}
+	}
+
+	billing := ca.tlsCert(t, "billing")
+	reports := ca.tlsCert(t, "reports", "reports.internal")
+	stranger := ca.tlsCert(t, "stranger")
+	untrusted := other.tlsCert(t, "billing")
+
+	tests := []struct {
+		name    string
+		client  *http.Client
+		path    string
+		forged  string
+		want    int
+		subject string
+	}{
+		{"no certificate", client(), "/mtls/x", "", http.StatusUnauthorized, ""},
+		{"allowed common name", client(billing), "/mtls/x", "", http.StatusOK, "CN=billing"},
+		{"allowed DNS name", client(reports), "/mtls/x", "", http.StatusOK, "CN=reports"},
+		{"name not allowed", client(stranger), "/mtls/x", "", http.StatusForbidden, ""},
+		{"forged header replaced", client(billing), "/mtls/x", "CN=admin", http.StatusOK, "CN=billing"},
+		{"forged header stripped on open route", client(), "/open/x", "CN=admin", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if tt.forged != "" {
+				req.Header.Set(clientCertSubjectHeader, tt.forged)
+			}
+			resp, err := tt.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d (%s)", resp.StatusCode, tt.want, body)
+			}
+			if tt.want == http.StatusOK && string(body) != tt.subject {
+				t.Fatalf("upstream saw subject %q, want %q", body, tt.subject)
+			}
+		})
+	}
+
+	// Go clients only offer a certificate from a CA the server asked for, so
+	// one from another CA is not sent and the route sees no certificate
+	resp, err := client(untrusted).Get(srv.URL + "/mtls/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("certificate from another CA: status %d, want 401", resp.StatusCode)
+	}
+
+	// Presented anyway, it fails the handshake even on a route without client_cert
+	forced := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    roots,
+		ServerName: "gateway.test",
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &untrusted, nil
+		},
+	}}}
+	if resp, err := forced.Get(srv.URL + "/open/x"); err == nil {
+		resp.Body.Close()
+		t.Fatal("untrusted client certificate: want a handshake error")
+	}
+}
+
+func TestNewUpstreamTLS(t *testing.T) {
+	ca := newTestCA(t, "internal CA")
+	dir := t.TempDir()
+
+	// The upstream only talks to callers with a certificate from the internal CA
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(ca.pem)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.tlsCert(t, "upstream", "upstream.internal")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := writeFile(t, dir, "ca.pem", ca.pem)
+	gwCrt, gwKey := ca.issue(t, "gateway")
+	gw := writeCert(t, dir, "gateway", gwCrt, gwKey)
+
+	get := func(cfg *UpstreamTLSConfig) (string, error) {
+		tc, err := newUpstreamTLS(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	got, err := get(&UpstreamTLSConfig{CAFile: caFile, CertFile: gw.CertFile, KeyFile: gw.KeyFile, ServerName: "upstream.internal"})
+	if err != nil {
+		t.Fatalf("mTLS request: %v", err)
+	}
+	if got != "gateway" {
+		t.Fatalf("upstream saw client %q, want gateway", got)
+	}
+
+	if _, err := get(&UpstreamTLSConfig{CAFile: caFile, ServerName: "upstream.internal"}); err == nil {
+		t.Fatal("request without a client certificate: want an error")
+	}
+	if _, err := get(&UpstreamTLSConfig{CertFile: gw.CertFile, KeyFile: gw.KeyFile, ServerName: "upstream.internal"}); err == nil {
+		t.Fatal("request without the internal CA: want a verification error")
+	}
+	if _, err := get(&UpstreamTLSConfig{CAFile: caFile, CertFile: gw.CertFile, KeyFile: gw.KeyFile, ServerName: "other.internal"}); err == nil {
+		t.Fatal("request checking the wrong server name: want an error")
+	}
+
+	if _, err := newUpstreamTLS(&UpstreamTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatal("missing CA file: want an error")
+	}
+	if err := (UpstreamTLSConfig{CertFile: gw.CertFile}).validate(); err == nil {
+		t.Fatal("cert_file without key_file: want a validation error")
+	}
+	if tc, err := newUpstreamTLS(nil); tc != nil || err != nil {
+		t.Fatalf("nil config: got %v, %v, want Go's defaults", tc, err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoUpstream is returned when a route has no instance it can send a request to
+var errNoUpstream = errors.New("no upstream available")
+
+// upstreamTransport is the RoundTripper behind every route's reverse proxy.
+// The proxy's Director leaves the target host unset; the transport picks an
+// instance from the pool for each request and points the request at it.
+type upstreamTransport struct {
+	pool         *Pool
+	base         http.RoundTripper
+	preserveHost bool
+	retry        *retryPolicy
+}
+
+// RoundTrip sends the request upstream and, when the route has a shadow,
+// mirrors a sample of requests to it once the primary response is done
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.pool.shadow != nil {
+		return t.pool.shadow.mirror(req, t.send)
+	}
+	return t.send(req)
+}
+
+// send sends the request to an upstream instance chosen by the pool's
+// balancer, retrying on another instance when the route allows it
+func (t *upstreamTransport) send(req *http.Request) (*http.Response, error) {
+	if t.retry != nil {
+		t.retry.budget.deposit()
+	}
+	if !t.retry.replayable(req) {
+		return t.try(req, nil)
+	}
+
+	// Buffer the body so every attempt can send it again
+	body, ok, err := bufferBody(req, t.retry.cfg.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return t.try(req, nil)
+	}
+
+	tried := make(map[*Upstream]bool)
+	for n := 1; ; n++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.try(req, tried)
+		if n >= t.retry.cfg.Attempts || !t.retry.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		if !t.retry.budget.withdraw() {
+			log.Printf("↩️ Retry budget exhausted, not retrying %s %s", req.Method, req.URL.Path)
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+
+		delay := t.retry.backoff(n)
+		log.Printf("↩️ Retrying %s %s (attempt %d/%d) in %v: %s", req.Method, req.URL.Path, n+1, t.retry.cfg.Attempts, delay, reason)
+		if err := sleepCtx(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// try makes one attempt, hedged when the route hedges this kind of request
+func (t *upstreamTransport) try(req *http.Request, tried map[*Upstream]bool) (*http.Response, error) {
+	if t.pool.hedge.applies(req) {
+		return t.hedged(req, tried)
+	}
+	return t.attempt(req, tried)
+}
+
+// attempt sends the request once, to an instance not already in tried when there is one
+func (t *upstreamTransport) attempt(req *http.Request, tried map[*Upstream]bool) (*http.Response, error) {
+	// Nothing to do once the route's deadline has passed or the client has gone
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	up, err := t.pool.Pick(req, tried)
+	if err != nil {
+		return nil, err
+	}
+	if tried != nil {
+		tried[up] = true
+	}
+	return t.sendTo(req, up)
+}
+
+// sendTo sends the request to the given instance
+func (t *upstreamTransport) sendTo(req *http.Request, up *Upstream) (*http.Response, error) {
+	// Reserve a slot with the instance's circuit breaker; it may have opened since Pick
+	done, err := up.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	// Log which instance the request is being proxied to
+	// This helps in debugging and monitoring the requests being forwarded
+	if up.Version != "" {
+		log.Printf("🔁 Proxying: %s -> %s (%s)", req.URL.Path, up.URL.Host, up.Version)
+	} else {
+		log.Printf("🔁 Proxying: %s -> %s", req.URL.Path, up.URL.Host)
+	}
+
+	up.requests.Add(1)
+	up.inflight.Add(1)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(t.target(req, up))
+	t.pool.outlier.record(req, up, resp, err)
+
+	done(attemptOutcome(req, resp, err))
+	if err != nil {
+		up.inflight.Add(-1)
+		return nil, err
+	}
+
+	// Record which version answered, so versions can be compared
+	if t.pool.split != nil {
+		t.pool.split.record(up.Version, resp.StatusCode, time.Since(start))
+		resp.Header.Set(servedVersionHeader, up.Version)
+	}
+
+	// The request is outstanding until the proxy has finished copying the body
+	resp.Body = trackBody(resp.Body, func() { up.inflight.Add(-1) })
+	return resp, nil
+}
+
+// target returns a copy of req addressed to the given upstream instance
+func (t *upstreamTransport) target(req *http.Request, up *Upstream) *http.Request {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = up.URL.Scheme
+	out.URL.Host = up.URL.Host
+	out.URL.Path, out.URL.RawPath = joinURLPath(up.URL, req.URL)
+
+	// Merge any query string configured on the upstream URL itself
+	if up.URL.RawQuery == "" || req.URL.RawQuery == "" {
+		out.URL.RawQuery = up.URL.RawQuery + req.URL.RawQuery
+	} else {
+		out.URL.RawQuery = up.URL.RawQuery + "&" + req.URL.RawQuery
+	}
+
+	// By default the outgoing Host header is the upstream's; keep the client's when asked
+	if !t.preserveHost {
+		out.Host = up.URL.Host
+	}
+
+	// Tell the upstream how long the gateway will wait, so it can give up in step
+	setDeadlineHeader(out)
+	return out
+}
+
+// joinURLPath appends the request path to the upstream's base path, the same
+// way httputil.NewSingleHostReverseProxy does
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	// Same as singleJoiningSlash, but uses EscapedPath to determine whether a slash should be added
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+// singleJoiningSlash joins two path segments with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// trackBody wraps a response body so done runs exactly once when it is closed.
+// Bodies of upgraded (101) responses are also writable, and the proxy relies on
+// that, so the wrapper keeps the io.Writer side when the original has one.
+func trackBody(body io.ReadCloser, done func()) io.ReadCloser {
+	t := &trackedBody{ReadCloser: body, done: done}
+	if rw, ok := body.(io.ReadWriteCloser); ok {
+		return &trackedRWBody{trackedBody: t, w: rw}
+	}
+	return t
+}
+
+// trackedBody is a response body that reports when it has been closed
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// trackedRWBody is a trackedBody for the writable body of an upgraded connection
+type trackedRWBody struct {
+	*trackedBody
+	w io.Writer
+}
+
+func (b *trackedRWBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenIssuer is the iss claim of every token this service signs
+const tokenIssuer = "auth-service"
+
+// tokenTTL is how long an issued token stays valid
+const tokenTTL = 15 * time.Minute
+
+// signingKey is the RSA key tokens are signed with, plus its key ID
+type signingKey struct {
+	priv *rsa.PrivateKey
+	kid  string
+}
+
+// loadOrCreateKey reads the PEM-encoded RSA key at path, creating one on first run
+// so the key (and every token signed with it) survives a restart
+func loadOrCreateKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, err
+		}
+		return newSigningKey(priv), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newSigningKey(priv), nil
+}
+
+// newSigningKey derives a stable key ID from the public key
+func newSigningKey(priv *rsa.PrivateKey) *signingKey {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(&priv.PublicKey))
+	return &signingKey{priv: priv, kid: base64.RawURLEncoding.EncodeToString(sum[:12])}
+}
+
+// jwksHandler publishes the public half of the signing key as a JSON Web Key Set,
+// which the API gateway fetches to verify tokens at the edge
+func (k *signingKey) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	pub := k.priv.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": k.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// sign issues an RS256 token for the user
+func (k *signingKey) sign(subject string, roles, scopes []string) (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": k.kid})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   tokenIssuer,
+		"sub":   subject,
+		"iat":   now.Unix(),
+		"exp":   now.Add(tokenTTL).Unix(),
+		"roles": roles,
+		"scope": strings.Join(scopes, " "),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.priv, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// account is a user the auth service can issue tokens for
+type account struct {
+	password string
+	roles    []string
+	scopes   []string
+}
+
+// accounts is an in-memory user store
+// For demonstration - use a real user database and hashed passwords in production
+var accounts = map[string]account{
+	"alice": {password: "alice-password", roles: []string{"user"}, scopes: []string{"user:read", "payment:read"}},
+	"admin": {password: "password", roles: []string{"admin"}, scopes: []string{"user:read", "user:write", "payment:read", "payment:write"}},
+}
+
+// loginHandler exchanges a username and password for a signed bearer token
+func (k *signingKey) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, pass := r.FormValue("username"), r.FormValue("password")
+	acct, ok := accounts[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(acct.password)) != 1 {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := k.sign(user, acct.roles, acct.scopes)
+	if err != nil {
+		log.Printf("Auth service: signing token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL.Seconds()),
+	})
+}
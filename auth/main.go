@@ -1,14 +1,43 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 )
 
 func main() {
+	// The signing key lives on disk so tokens stay valid across restarts
+	keyPath := flag.String("key", "auth-key.pem", "path to the RSA token signing key (created if missing)")
+	shutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "how long in-flight requests get to finish on shutdown")
+	shutdownDelay := flag.Duration("shutdown-delay", 0, "how long to keep serving after reporting not ready, so callers stop sending traffic")
+	flag.Parse()
+
+	key, err := loadOrCreateKey(*keyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Publish the token verification keys and let users log in for a token
+	// The gateway fetches the key set to check tokens before proxying
+	http.HandleFunc("/auth/.well-known/jwks.json", key.jwksHandler)
+	http.HandleFunc("/auth/login", key.loginHandler)
+
+	// Report readiness to the gateway's health checks; it fails once shutdown starts
+	http.HandleFunc("/auth/health", healthHandler)
+
 	// Define a route for the auth service
 	// This route will handle all requests starting with /auth/
 	http.HandleFunc("/auth/", func(w http.ResponseWriter, r *http.Request) {
+		// Stop early if the gateway has already given up on this request
+		// There is no point doing work nobody is waiting for
+		if err := r.Context().Err(); err != nil {
+			log.Printf("Auth service: abandoning %s: %v", r.URL.Path, err)
+			return
+		}
+
 		// Respond with a message indicating the auth service is handling the request
 		// The URL path is included in the response for debugging purposes
 		fmt.Fprintf(w, "Auth Service: %s", r.URL.Path)
@@ -18,7 +47,9 @@ func main() {
 	// This helps in identifying that the service has started successfully
 	fmt.Println("Auth service running on port 8001")
 
-	// Start the HTTP server on port 8001
-	// This will block the main goroutine and listen for incoming requests
-	http.ListenAndServe(":8001", nil)
+	// Serve until SIGTERM, then let in-flight requests finish before exiting
+	// A non-zero exit status means requests were cut off or the server failed
+	if err := serve(newServer(":8001", http.DefaultServeMux), *shutdownGrace, *shutdownDelay); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,44 @@
+// This file is copied as-is into auth, user and payment: each service is a
+// standalone package main with no shared module to import it from.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deadlineHeader is set by the API gateway to the number of milliseconds it
+// is still willing to wait for this request
+const deadlineHeader = "X-Request-Timeout-Ms"
+
+// withDeadline puts the gateway's remaining time on the request context,
+// so handlers can stop working once the caller has given up
+func withDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.ParseInt(r.Header.Get(deadlineHeader), 10, 64)
+		if err != nil || ms <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newServer returns an HTTP server with timeouts, so slow or stuck clients
+// cannot hold connections open forever
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           withDeadline(h),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// paymentSteps are the states a demo payment moves through
+var paymentSteps = []string{"pending", "authorized", "captured", "settled"}
+
+// eventsHandler streams a payment's status changes as Server-Sent Events,
+// so browsers get updates pushed through the gateway instead of polling
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// The server's write timeout is meant for ordinary requests, not a stream
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+
+	for i, step := range paymentSteps {
+		if i > 0 {
+			select {
+			case <-r.Context().Done():
+				log.Printf("Payment service: status stream for %s closed by client", id)
+				return
+			case <-draining:
+				// End the stream cleanly; the client reconnects to another instance
+				log.Printf("Payment service: closing status stream for %s, shutting down", id)
+				return
+			case <-tick.C:
+			}
+		}
+		fmt.Fprintf(w, "event: status\ndata: {\"id\":%q,\"status\":%q}\n\n", id, step)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -1,14 +1,35 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 )
 
 func main() {
+	shutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "how long in-flight requests get to finish on shutdown")
+	shutdownDelay := flag.Duration("shutdown-delay", 0, "how long to keep serving after reporting not ready, so callers stop sending traffic")
+	flag.Parse()
+
+	// Push payment status updates to the client as they happen
+	// ServeMux picks the longest matching pattern, so this wins over /payment/ in any order
+	http.HandleFunc("/payment/events", eventsHandler)
+
+	// Report readiness to the gateway's health checks; it fails once shutdown starts
+	http.HandleFunc("/payment/health", healthHandler)
+
 	// Define a route for the payment service
 	// This route will handle all requests starting with /payment/
 	http.HandleFunc("/payment/", func(w http.ResponseWriter, r *http.Request) {
+		// Stop early if the gateway has already given up on this request
+		// There is no point doing work nobody is waiting for
+		if err := r.Context().Err(); err != nil {
+			log.Printf("Payment service: abandoning %s: %v", r.URL.Path, err)
+			return
+		}
+
 		// Respond with a message indicating the payment service is handling the request
 		// The URL path is included in the response for debugging purposes
 		fmt.Fprintf(w, "Payment Service: %s", r.URL.Path)
@@ -18,7 +39,9 @@ func main() {
 	// This helps in identifying that the service has started successfully
 	fmt.Println("Payment service running on port 8003")
 
-	// Start the HTTP server on port 8003
-	// This will block the main goroutine and listen for incoming requests
-	http.ListenAndServe(":8003", nil)
+	// Serve until SIGTERM, then let in-flight requests finish before exiting
+	// A non-zero exit status means requests were cut off or the server failed
+	if err := serve(newServer(":8003", http.DefaultServeMux), *shutdownGrace, *shutdownDelay); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,56 @@
+// This file is copied as-is into auth, user and payment: each service is a
+// standalone package main with no shared module to import it from.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowWork is a handler that takes d to answer, like one waiting on a database,
+// and reports through done whether it finished or gave up
+func slowWork(d time.Duration, done chan<- error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			done <- r.Context().Err()
+		case <-time.After(d):
+			done <- nil
+		}
+	})
+}
+
+func TestWithDeadline(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		work   time.Duration
+		gaveUp bool
+		within time.Duration
+	}{
+		{"no deadline", "", 50 * time.Millisecond, false, time.Second},
+		{"malformed deadline", "soon", 50 * time.Millisecond, false, time.Second},
+		{"work fits the deadline", "1000", 20 * time.Millisecond, false, time.Second},
+		{"work outlasts the deadline", "30", 5 * time.Second, true, time.Second},
+	}
+	for _, tt := range tests {
+		done := make(chan error, 1)
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set(deadlineHeader, tt.header)
+		}
+
+		start := time.Now()
+		withDeadline(slowWork(tt.work, done)).ServeHTTP(httptest.NewRecorder(), r)
+		err := <-done
+		if (err != nil) != tt.gaveUp {
+			t.Errorf("%s: work ended with %v, want gave up %v", tt.name, err, tt.gaveUp)
+		}
+		if elapsed := time.Since(start); elapsed > tt.within {
+			t.Errorf("%s: handler ran for %v, want under %v", tt.name, elapsed, tt.within)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// This file is copied as-is into auth, user and payment: each service is a
+// standalone package main with no shared module to import it from.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// stopping is set as soon as a shutdown signal arrives
+var stopping atomic.Bool
+
+// draining is closed once the server stops accepting connections. Long-lived
+// handlers watch it to end their streams instead of holding up the exit.
+var draining = make(chan struct{})
+
+// healthHandler answers the gateway's health checks. It fails as soon as
+// shutdown starts, so the gateway takes the instance out of rotation.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if stopping.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serve runs srv until SIGTERM or SIGINT, then shuts down gracefully: the
+// service reports itself not ready, keeps serving for delay so callers notice,
+// stops accepting connections and gives in-flight requests grace to finish.
+// It returns an error if the server failed or the grace period ran out.
+func serve(srv *http.Server, grace, delay time.Duration) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	// Hijacked connections are not tracked by Shutdown, so streams are told to end
+	srv.RegisterOnShutdown(func() { close(draining) })
+
+	failed := make(chan error, 1)
+	go func() { failed <- srv.ListenAndServe() }()
+
+	var sig os.Signal
+	select {
+	case err := <-failed:
+		return err
+	case sig = <-stop:
+	}
+
+	stopping.Store(true)
+	log.Printf("Received %v: shutting down, in-flight requests have %v to finish", sig, grace)
+	if delay > 0 {
+		srv.SetKeepAlivesEnabled(false)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("grace period of %v ran out with requests still in flight", grace)
+		}
+		return err
+	}
+	log.Printf("All requests finished, exiting")
+	return nil
+}